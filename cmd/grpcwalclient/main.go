@@ -1,5 +1,313 @@
 package main
 
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/wal"
+	flag "github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	minRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+type clientConfig struct {
+	server        string
+	from          string
+	fromTs        uint64
+	fromSeen      int
+	print         bool
+	walDir        string
+	walPrefix     string
+	walMaxEntries int
+	reconnect     bool
+	useTLS        bool
+	caFile        string
+	certFile      string
+	keyFile       string
+	serverName    string
+	skipVerify    bool
+}
+
+// tailRecord is a single line of output, in the same shape as walinspect's dump output.
+type tailRecord struct {
+	File      string      `json:"file"`
+	Timestamp uint64      `json:"timestamp"`
+	Time      string      `json:"time"`
+	Action    string      `json:"action"`
+	Key       string      `json:"key"`
+	Pattern   interface{} `json:"pattern"`
+}
+
 func main() {
+	cfg := clientConfig{}
+	flag.StringVar(&cfg.server, "server", "localhost:7070", "Address (host:port) of the server's WAL gRPC service")
+	flag.StringVar(&cfg.from, "from", "", "Start from entries at or after this time (RFC3339 or nanoseconds since the epoch); defaults to the newest entry in --walDir, or the beginning")
+	flag.BoolVar(&cfg.print, "print", true, "Print received entries to stdout as NDJSON")
+	flag.StringVar(&cfg.walDir, "walDir", "", "Directory to mirror received entries into as WAL files")
+	flag.StringVar(&cfg.walPrefix, "walPrefix", "mwal-", "Prefix for mirrored WAL files")
+	flag.IntVar(&cfg.walMaxEntries, "walMaxEntries", 10000, "Maximum number of entries to store in any single mirrored WAL file")
+	flag.BoolVar(&cfg.reconnect, "reconnect", true, "Reconnect and resume from the last received entry when the stream is interrupted")
+	flag.BoolVar(&cfg.useTLS, "tls", false, "Connect with TLS")
+	flag.StringVar(&cfg.caFile, "caFile", "", "PEM file of CA certificates to verify the server with (defaults to the system pool)")
+	flag.StringVar(&cfg.certFile, "certFile", "", "PEM client certificate, for servers that require one")
+	flag.StringVar(&cfg.keyFile, "keyFile", "", "PEM key for --certFile")
+	flag.StringVar(&cfg.serverName, "serverName", "", "Name to verify the server's certificate against (defaults to the host in --server)")
+	flag.BoolVar(&cfg.skipVerify, "insecureSkipVerify", false, "Don't verify the server's certificate")
+	flag.Parse()
+
+	if !cfg.print && cfg.walDir == "" {
+		log.Fatal("Nothing to do: pass --walDir, or leave --print on")
+	}
+	if (cfg.certFile == "") != (cfg.keyFile == "") {
+		log.Fatal("--certFile and --keyFile must be used together")
+	}
+	var err error
+	if cfg.fromTs, err = parseTime(cfg.from); err != nil {
+		log.Fatal("--from: " + err.Error())
+	}
+
+	var mirror *walMirror
+	if cfg.walDir != "" {
+		mirror = newWalMirror(cfg.walDir, cfg.walPrefix, cfg.walMaxEntries)
+		if cfg.from == "" {
+			last, seen, err := mirror.lastTimestamp()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if last > 0 {
+				cfg.fromTs, cfg.fromSeen = last, seen
+				log.Printf("Resuming from %d, the newest entry in %s (%d entries with that timestamp already mirrored)", last, cfg.walDir, seen)
+			}
+		}
+	}
+
+	creds, err := transportCredentials(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := grpc.Dial(cfg.server, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	err = follow(ctx, cfg, api.NewWalClient(conn), mirror)
+	if mirror != nil {
+		if cerr := mirror.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseTime accepts either an RFC3339 time or a timestamp in nanoseconds since the epoch. An empty
+// string is returned as 0.
+func parseTime(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(t.UnixNano()), nil
+}
+
+func transportCredentials(cfg clientConfig) (credentials.TransportCredentials, error) {
+	if !cfg.useTLS {
+		return insecure.NewCredentials(), nil
+	}
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.serverName,
+		InsecureSkipVerify: cfg.skipVerify,
+	}
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.caFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// follow streams entries from the server until ctx is cancelled. If the stream is interrupted and
+// cfg.reconnect is set, it reconnects with a growing delay and resumes from the last entry it
+// received. Several entries can share a timestamp, so the stream is resumed at that timestamp and
+// the entries with it that have already been handled, which the server sends again in the same
+// order, are skipped.
+func follow(ctx context.Context, cfg clientConfig, client api.WalClient, mirror *walMirror) error {
+	from, seen := cfg.fromTs, cfg.fromSeen
+	delay := minRetryDelay
+	for {
+		last, atLast, err := streamFrom(ctx, client, from, seen, cfg.print, mirror)
+		if last != from || atLast != seen {
+			from, seen = last, atLast
+			delay = minRetryDelay
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !cfg.reconnect || !retryable(err) {
+			return err
+		}
+		log.Printf("Stream interrupted (%s); resuming from %d in %s", err.Error(), from, delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryable reports whether reconnecting might get past an error.
+func retryable(err error) bool {
+	if err == nil || err == io.EOF {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return false
+	}
+	return true
+}
+
+// streamFrom runs a single stream starting at from, skipping the first seen entries with that
+// timestamp, and prints and mirrors each entry after them. It returns the timestamp of the last
+// entry handled and how many entries with that timestamp have been handled (counting the ones
+// skipped), along with whatever ended the stream.
+func streamFrom(ctx context.Context, client api.WalClient, from uint64, seen int, printEntries bool, mirror *walMirror) (uint64, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.PublishEntryStream(ctx, &api.PublishEntryRequest{Timestamp: from})
+	if err != nil {
+		return from, seen, err
+	}
+
+	// Receive on another goroutine, so that the mirror can be synced while the stream is idle.
+	type received struct {
+		res *api.PublishEntryResponse
+		err error
+	}
+	chReceived := make(chan received)
+	go func() {
+		for {
+			res, err := stream.Recv()
+			select {
+			case chReceived <- received{res, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(os.Stdout)
+	ticker := time.NewTicker(mirrorSyncEvery)
+	defer ticker.Stop()
+	last, atLast, skip := from, seen, seen
+	for {
+		select {
+		case <-ctx.Done():
+			return last, atLast, ctx.Err()
+		case <-ticker.C:
+			if mirror != nil {
+				if err = mirror.sync(); err != nil {
+					return last, atLast, err
+				}
+			}
+		case r := <-chReceived:
+			if r.err != nil {
+				return last, atLast, r.err
+			}
+			e := r.res.GetEntry()
+			if e == nil || e.GetTimestamp() < last {
+				continue
+			}
+			if e.GetTimestamp() == last && skip > 0 {
+				skip--
+				continue
+			}
+			entry := wal.WalEntry{
+				Timestamp: e.GetTimestamp(),
+				Key:       e.GetKey(),
+				Pattern:   e.GetPattern(),
+				Action:    uint16(e.GetAction()),
+			}
+			if mirror != nil {
+				if err = mirror.write(entry); err != nil {
+					return last, atLast, err
+				}
+			}
+			if printEntries {
+				if err = enc.Encode(newTailRecord(r.res.GetFileName(), entry)); err != nil {
+					return last, atLast, fmt.Errorf("writing to stdout: %w", err)
+				}
+			}
+			if entry.Timestamp == last {
+				atLast++
+			} else {
+				last, atLast, skip = entry.Timestamp, 1, 0
+			}
+		}
+	}
+}
 
+func newTailRecord(fileName string, e wal.WalEntry) tailRecord {
+	rec := tailRecord{
+		File:      fileName,
+		Timestamp: e.Timestamp,
+		Time:      time.Unix(0, int64(e.Timestamp)).UTC().Format(time.RFC3339Nano),
+		Action:    wal.ActionName(e.Action),
+		Key:       string(e.Key),
+	}
+	// Patterns are embedded as JSON where possible, and as strings otherwise.
+	if js, err := e.GetPatternAsJson(); err == nil {
+		rec.Pattern = json.RawMessage(js)
+	} else {
+		rec.Pattern = string(e.Pattern)
+	}
+	return rec
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"github.com/highgrav/munchkin/internal/wal"
+	"log"
+	"os"
+	"time"
+)
+
+// mirrorSyncEvery is the longest a received entry waits before the mirror is synced to disk.
+const mirrorSyncEvery = 100 * time.Millisecond
+
+// walMirror writes received entries to a local WAL directory. Each file is named for the
+// timestamp of the first entry in it, so that, as with files written by the server, every entry
+// in a file comes before the next file's name.
+type walMirror struct {
+	dir        string
+	prefix     string
+	maxEntries int
+	file       *wal.WalFile
+	entries    int
+	lastSync   time.Time
+	unsynced   bool
+}
+
+func newWalMirror(dir, prefix string, maxEntries int) *walMirror {
+	return &walMirror{
+		dir:        dir,
+		prefix:     prefix,
+		maxEntries: maxEntries,
+	}
+}
+
+// lastTimestamp returns the timestamp of the newest entry already in the mirror, or 0 if it is
+// empty, along with how many entries in the mirror have that timestamp (they can run back across
+// several files). Opening the newest files for writing cuts off any record that was only partly
+// written when the client last stopped.
+func (m *walMirror) lastTimestamp() (uint64, int, error) {
+	files, err := wal.ListWalFiles(m.dir, m.prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	var last uint64
+	var ct int
+	for x := len(files) - 1; x >= 0; x-- {
+		wf, err := wal.OpenWalFile(files[x])
+		if err != nil {
+			return 0, 0, err
+		}
+		earlier := false
+		for wf.HasNext() {
+			e, err := wf.Next()
+			if errors.Is(err, wal.ErrCorruptRecord) {
+				log.Printf("%s: %s", files[x], err.Error())
+				continue
+			}
+			if err != nil {
+				wf.Close()
+				return 0, 0, err
+			}
+			switch {
+			case e.Timestamp > last:
+				last, ct = e.Timestamp, 1
+			case e.Timestamp == last:
+				ct++
+			default:
+				earlier = true
+			}
+		}
+		wf.Close()
+		if last > 0 && earlier {
+			break
+		}
+	}
+	return last, ct, nil
+}
+
+// write appends an entry to the mirror, starting a new file when the current one is full. Writes
+// are synced at least every mirrorSyncEvery, and whenever the mirror is closed.
+func (m *walMirror) write(e wal.WalEntry) error {
+	if m.file == nil || (m.maxEntries > 0 && m.entries >= m.maxEntries) {
+		if err := m.rotate(e.Timestamp); err != nil {
+			return err
+		}
+	}
+	if err := m.file.Append([]wal.WalEntry{e}); err != nil {
+		return err
+	}
+	m.entries++
+	m.unsynced = true
+	if time.Since(m.lastSync) >= mirrorSyncEvery {
+		return m.sync()
+	}
+	return nil
+}
+
+func (m *walMirror) rotate(firstTs uint64) error {
+	if m.file != nil {
+		if err := m.sync(); err != nil {
+			return err
+		}
+		m.file.Close()
+		m.file = nil
+	}
+	// If the newest file is already named for this timestamp (every entry in it shares the
+	// timestamp, or the client stopped partway through them), carry on appending to it.
+	fileName, err := wal.CreateWalFileAt(m.dir, m.prefix, int64(firstTs))
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	wf, err := wal.OpenWalFile(fileName)
+	if err != nil {
+		return err
+	}
+	m.file = wf
+	m.entries = 0
+	return nil
+}
+
+func (m *walMirror) sync() error {
+	m.lastSync = time.Now()
+	if m.file == nil || !m.unsynced {
+		return nil
+	}
+	m.unsynced = false
+	return m.file.Sync()
+}
+
+// close syncs and closes the current file.
+func (m *walMirror) close() error {
+	if m.file == nil {
+		return nil
+	}
+	err := m.sync()
+	m.file.Close()
+	m.file = nil
+	return err
+}
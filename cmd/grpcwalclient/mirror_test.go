@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/wal"
+	"testing"
+)
+
+func mirrorEntry(ts uint64, x int) wal.WalEntry {
+	return wal.WalEntry{
+		Timestamp: ts,
+		Key:       []byte(fmt.Sprintf("key-%02d", x)),
+		Pattern:   []byte(`{"sys":["filestore"]}`),
+		Action:    wal.WAL_ADD,
+	}
+}
+
+func TestMirrorResumesWithinATimestamp(t *testing.T) {
+	dir := t.TempDir()
+	m := newWalMirror(dir, "mwal-", 2)
+	// Entries 1-4 share a timestamp and run across two files. The last one would start a third
+	// file, but the second is already named for its timestamp, so it is appended to instead.
+	for x, ts := range []uint64{90, 100, 100, 100, 100} {
+		if err := m.write(mirrorEntry(ts, x)); err != nil {
+			t.Fatal("write: " + err.Error())
+		}
+	}
+	if err := m.close(); err != nil {
+		t.Fatal("close: " + err.Error())
+	}
+
+	last, seen, err := newWalMirror(dir, "mwal-", 2).lastTimestamp()
+	if err != nil {
+		t.Fatal("lastTimestamp: " + err.Error())
+	}
+	if last != 100 || seen != 4 {
+		t.Errorf("Expected 4 entries at timestamp 100, got %d at %d", seen, last)
+	}
+
+	// Picking up again at the same timestamp appends to the file already named for it.
+	m = newWalMirror(dir, "mwal-", 2)
+	if err = m.write(mirrorEntry(100, 5)); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+	if err = m.close(); err != nil {
+		t.Fatal("close: " + err.Error())
+	}
+	if last, seen, _ = newWalMirror(dir, "mwal-", 2).lastTimestamp(); last != 100 || seen != 5 {
+		t.Errorf("Expected 5 entries at timestamp 100, got %d at %d", seen, last)
+	}
+}
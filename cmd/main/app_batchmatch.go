@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+const (
+	// maxBatchEventSize is the largest single event accepted in an NDJSON batch.
+	maxBatchEventSize = 4 << 20
+	// batchFlushEvery is how many results are written before the response is flushed.
+	batchFlushEvery = 64
+)
+
+// batchMatchResult is a single line of a batch match response.
+type batchMatchResult struct {
+	Index      int       `json:"index"`
+	Ok         bool      `json:"ok"`
+	Generation uint64    `json:"generation"`
+	Matches    *[]string `json:"matches,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// handleHttpPostMatchBatch matches a batch of events, sent either as a JSON array or as
+// newline-delimited JSON, and streams back one NDJSON result line per event in the order the
+// events were received. Every event in the batch is matched against the same generation. A bad
+// event is reported in its own result line rather than failing the batch; the exception is a
+// malformed JSON array, which can't be read past, so the batch stops at the first error. When the
+// rule set is sharded, the whole batch is read and matched on every shard before any results are
+// sent.
+func (a *application) handleHttpPostMatchBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (POST only)"],"data":{}}`))
+		return
+	}
+
+	br := bufio.NewReaderSize(r.Body, 64*1024)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		if err != io.EOF {
+			a.logger.Warn(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+		}
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Problem reading request body"],"data":{}}`))
+		return
+	}
+
+	g := a.currentGeneration()
+	var results []batchMatchResult
+	var readErr error
+	count := 0
+	sharded := a.shardedMatch(r)
+	if sharded {
+		var events [][]byte
+		count, readErr = forEachBatchEvent(br, first, func(idx int, evt []byte) bool {
+			events = append(events, append([]byte(nil), evt...))
+			return true
+		})
+		if results, err = a.sharder.match(g, events); err != nil {
+			a.logger.Warn(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+			w.WriteHeader(503)
+			w.Write([]byte(`{"ok":false,"errors":["Problem matching across shards"],"data":{}}`))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	sent := 0
+	emit := func(res batchMatchResult) bool {
+		if err := enc.Encode(res); err != nil {
+			a.logger.Warn(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+			return false
+		}
+		sent++
+		if flusher != nil && sent%batchFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	if sharded {
+		for _, res := range results {
+			if !emit(res) {
+				return
+			}
+		}
+	} else {
+		aborted := false
+		count, readErr = forEachBatchEvent(br, first, func(idx int, evt []byte) bool {
+			aborted = !emit(matchEvent(g, idx, evt))
+			return !aborted
+		})
+		if aborted {
+			return
+		}
+	}
+	if readErr != nil {
+		emit(batchMatchResult{Index: count, Generation: g.gen, Error: "Problem reading event: " + readErr.Error()})
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// matchEvent matches a single event from a batch against g.
+func matchEvent(g *matcherGeneration, idx int, evt []byte) batchMatchResult {
+	res := batchMatchResult{
+		Index:      idx,
+		Generation: g.gen,
+	}
+	matches, err := g.matchesForEvent(evt)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	matchList := matchedKeys(matches)
+	res.Ok = true
+	res.Matches = &matchList
+	return res
+}
+
+// forEachBatchEvent reads the events in a batch, which starts with first, passing each of them to
+// fn until fn returns false. It returns how many events were read, and the error that stopped it
+// reading the rest of the batch, if any. The event passed to fn is only valid until fn returns.
+func forEachBatchEvent(br *bufio.Reader, first byte, fn func(idx int, evt []byte) bool) (int, error) {
+	if first == '[' {
+		dec := json.NewDecoder(br)
+		// Consume the opening bracket
+		_, _ = dec.Token()
+		idx := 0
+		for ; dec.More(); idx++ {
+			var evt json.RawMessage
+			if err := dec.Decode(&evt); err != nil {
+				return idx, err
+			}
+			if !fn(idx, evt) {
+				return idx + 1, nil
+			}
+		}
+		return idx, nil
+	}
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchEventSize)
+	idx := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !fn(idx, line) {
+			return idx + 1, nil
+		}
+		idx++
+	}
+	return idx, scanner.Err()
+}
+
+// peekNonSpace skips leading whitespace and returns the next byte without consuming it.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends a batch to the batch match handler and decodes the result lines.
+func postBatch(t *testing.T, a *application, body string) []batchMatchResult {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/v1/match/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	a.handleHttpPostMatchBatch(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var results []batchMatchResult
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var res batchMatchResult
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal("Decoding result: " + err.Error())
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestBatchMatch(t *testing.T) {
+	a := newTestApplication(t)
+	a.addRule("first-test-key", `{"sys":["filestore"]}`)
+	a.addRule("second-test-key", `{"sys":["authnz"]}`)
+
+	check := func(format string, results []batchMatchResult) {
+		t.Helper()
+		expected := []string{"first-test-key", "", "second-test-key"}
+		if len(results) != len(expected) {
+			t.Fatalf("%s: expected %d results, got %d", format, len(expected), len(results))
+		}
+		for x, res := range results {
+			if res.Index != x || res.Generation != 2 {
+				t.Errorf("%s: result %d has index %d and generation %d", format, x, res.Index, res.Generation)
+			}
+			if expected[x] == "" {
+				if res.Ok || res.Error == "" {
+					t.Errorf("%s: expected event %d to be reported as bad", format, x)
+				}
+				continue
+			}
+			if !res.Ok || res.Matches == nil || strings.Join(*res.Matches, ",") != expected[x] {
+				t.Errorf("%s: expected event %d to match %s, got %+v", format, x, expected[x], res)
+			}
+		}
+	}
+
+	// A bad event is reported on its own line, and the rest of the batch is still matched.
+	check("NDJSON", postBatch(t, a, "{\"sys\":\"filestore\"}\nnot json\n{\"sys\":\"authnz\"}\n"))
+	check("JSON array", postBatch(t, a, `[{"sys":"filestore"}, "not an event", {"sys":"authnz"}]`))
+
+	// A malformed array can't be read past, so the batch stops with an error at that point.
+	results := postBatch(t, a, `[{"sys":"filestore"}, {"sys":`)
+	if len(results) != 2 || !results[0].Ok || results[1].Ok || results[1].Index != 1 {
+		t.Errorf("Expected one match and then a read error, got %+v", results)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// importLineError reports a line of a bulk import that couldn't be applied.
+type importLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// handleHttpPostImport adds the key/pattern records sent as newline-delimited JSON
+// ({"key":"...","pattern":{...}} per line) in a single batch. By default bad lines are skipped
+// and reported; with 'atomic=true' in the query string a single bad line rejects the whole batch.
+func (a *application) handleHttpPostImport(w http.ResponseWriter, r *http.Request) {
+
+	type responseData struct {
+		Generation uint64            `json:"generation"`
+		Applied    int               `json:"applied"`
+		Failed     int               `json:"failed"`
+		Errors     []importLineError `json:"errors"`
+	}
+	type responseModel struct {
+		Ok   bool         `json:"ok"`
+		Data responseData `json:"data"`
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (POST only)"],"data":{}}`))
+		return
+	}
+	atomic := r.URL.Query().Get("atomic") == "true"
+
+	records := make([]importRecord, 0)
+	lineErrs := make([]importLineError, 0)
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchEventSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var rec importRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			lineErrs = append(lineErrs, importLineError{Line: line, Error: err.Error()})
+			continue
+		}
+		if len(rec.Key) == 0 {
+			lineErrs = append(lineErrs, importLineError{Line: line, Error: "missing key"})
+			continue
+		}
+		if err := validatePattern(string(rec.Pattern)); err != nil {
+			lineErrs = append(lineErrs, importLineError{Line: line, Error: err.Error()})
+			continue
+		}
+		if err := checkEntrySize(rec.Key, string(rec.Pattern)); err != nil {
+			lineErrs = append(lineErrs, importLineError{Line: line, Error: err.Error()})
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		a.logger.Warn(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Problem reading request body"],"data":{}}`))
+		return
+	}
+
+	resp := responseModel{
+		Ok: true,
+		Data: responseData{
+			Generation: a.currentGeneration().gen,
+			Failed:     len(lineErrs),
+			Errors:     lineErrs,
+		},
+	}
+	status := 200
+	if atomic && len(lineErrs) > 0 {
+		resp.Ok = false
+		status = 400
+	} else if len(records) > 0 {
+		timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+		defer cancelFunc()
+
+		doneChan := make(chan uint64, 1)
+		errChan := make(chan error, 1)
+		go a.asyncImportRules(records, doneChan, errChan)
+		select {
+		case <-timeoutCtx.Done():
+			w.WriteHeader(202)
+			w.Write([]byte(`{"ok":true,"errors":["Request timed out, submitted for processing"],"data":{}}`))
+			return
+		case gen := <-doneChan:
+			resp.Data.Generation = gen
+			resp.Data.Applied = len(records)
+		case err := <-errChan:
+			if a.writeNotLoggedError(w, err) || a.writePartialCommitError(w, err) {
+				return
+			}
+			a.logger.Error(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+			w.WriteHeader(500)
+			w.Write([]byte(`{"ok":false,"errors":["Problem importing patterns"],"data":{}}`))
+			return
+		}
+	}
+
+	val, err := json.Marshal(resp)
+	if err != nil {
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem returning results"],"data":{}}`))
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(val)
+}
+
+// handleHttpGetExport streams every key/pattern pair as newline-delimited JSON, in the same
+// format accepted by handleHttpPostImport. Keys are sorted so that exports from two servers can
+// be diffed.
+func (a *application) handleHttpGetExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (GET only)"],"data":{}}`))
+		return
+	}
+
+	snap := a.currentGeneration().registry.Snapshot()
+	keys := make([]string, 0, len(snap))
+	for k := range snap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	enc := json.NewEncoder(w)
+	for _, k := range keys {
+		for _, p := range snap[k] {
+			if err := enc.Encode(importRecord{Key: k, Pattern: json.RawMessage(p)}); err != nil {
+				a.logger.Warn(err.Error(),
+					zap.String("ip", r.RemoteAddr))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/highgrav/munchkin/internal/wal"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postImport sends an NDJSON body to the import handler and decodes the response.
+func postImport(t *testing.T, a *application, query, body string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/admin/v1/import"+query, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	a.handleHttpPostImport(w, req)
+	var resp map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Could not decode import response %q: %s", w.Body.String(), err.Error())
+	}
+	return w.Code, resp
+}
+
+func TestImportExport(t *testing.T) {
+	a := newTestApplication(t)
+	body := `{"key":"first-test-key","pattern":{"sys":["filestore"]}}
+{"key":"first-test-key","pattern":{"sys":["authnz"]}}
+
+not json
+{"key":"second-test-key","pattern":{"sys":["infra"]}}
+{"key":"","pattern":{"sys":["infra"]}}
+`
+	code, resp := postImport(t, a, "", body)
+	if code != 200 {
+		t.Fatalf("Expected 200, got %d: %v", code, resp)
+	}
+	data := resp["data"].(map[string]any)
+	if data["applied"].(float64) != 3 || data["failed"].(float64) != 2 {
+		t.Errorf("Expected 3 applied and 2 failed, got %v", data)
+	}
+	errs := data["errors"].([]any)
+	if len(errs) != 2 || errs[0].(map[string]any)["line"].(float64) != 4 || errs[1].(map[string]any)["line"].(float64) != 6 {
+		t.Errorf("Unexpected line errors: %v", errs)
+	}
+
+	req := httptest.NewRequest("GET", "/api/admin/v1/export", nil)
+	w := httptest.NewRecorder()
+	a.handleHttpGetExport(w, req)
+	want := `{"key":"first-test-key","pattern":{"sys":["filestore"]}}
+{"key":"first-test-key","pattern":{"sys":["authnz"]}}
+{"key":"second-test-key","pattern":{"sys":["infra"]}}
+`
+	if w.Code != 200 || w.Body.String() != want {
+		t.Errorf("Unexpected export (%d):\n%s", w.Code, w.Body.String())
+	}
+
+	// The export can be imported as it is.
+	b := newTestApplication(t)
+	if code, resp = postImport(t, b, "?atomic=true", w.Body.String()); code != 200 {
+		t.Fatalf("Expected 200 re-importing the export, got %d: %v", code, resp)
+	}
+	if b.currentGeneration().registry.Len() != 2 || len(b.currentGeneration().registry.Patterns("first-test-key")) != 2 {
+		t.Errorf("Re-imported export doesn't match: %v", b.currentGeneration().registry.Snapshot())
+	}
+}
+
+func TestAtomicImportFailsWhole(t *testing.T) {
+	a := newTestApplication(t)
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	gen := a.currentGeneration().gen
+
+	body := `{"key":"second-test-key","pattern":{"sys":["authnz"]}}
+{"key":"third-test-key","pattern":{"sys":"not-a-list"}}
+{"key":"fourth-test-key","pattern":{"sys":["infra"]}}
+`
+	code, resp := postImport(t, a, "?atomic=true", body)
+	if code != 400 || resp["ok"].(bool) {
+		t.Errorf("Expected a failed atomic import, got %d: %v", code, resp)
+	}
+	g := a.currentGeneration()
+	if g.gen != gen || g.registry.Len() != 1 {
+		t.Errorf("Failed atomic import changed the rule set: generation %d, %v", g.gen, g.registry.Snapshot())
+	}
+}
+
+func TestBatchFailingPartwayChangesNothing(t *testing.T) {
+	a := newTestApplication(t)
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	gen := a.currentGeneration().gen
+
+	// Every entry is well formed, but the last deletes a pattern the first removed.
+	_, err := a.commitEntries([]wal.WalEntry{
+		newWalEntry(wal.WAL_DEL, "first-test-key", "-"),
+		newWalEntry(wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`),
+		newWalEntry(wal.WAL_DEL, "first-test-key", `{"sys":["filestore"]}`),
+	})
+	if err != ErrPatternNotFound {
+		t.Errorf("Expected ErrPatternNotFound, got %v", err)
+	}
+	// An invalid pattern late in a batch is caught before anything is applied.
+	_, err = a.commitEntries([]wal.WalEntry{
+		newWalEntry(wal.WAL_DEL, "first-test-key", "-"),
+		newWalEntry(wal.WAL_ADD, "second-test-key", `{"sys":"not-a-list"}`),
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "entry 1:") {
+		t.Errorf("Expected entry 1 to be rejected, got %v", err)
+	}
+
+	g := a.currentGeneration()
+	if g.gen != gen {
+		t.Errorf("Expected generation %d to still be current, got %d", gen, g.gen)
+	}
+	if keys := matchKeys(t, g, `{"sys":"filestore"}`); len(keys) != 1 || keys[0] != "first-test-key" {
+		t.Errorf("Failed batches changed the matcher: %v", keys)
+	}
+	if g.registry.Len() != 1 || !g.registry.HasKey("first-test-key") {
+		t.Errorf("Failed batches changed the registry: %v", g.registry.Snapshot())
+	}
+}
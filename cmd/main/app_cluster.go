@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/serf/serf"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+var _ cluster.SerfEventHandler = (*application)(nil)
+
+// startCluster joins the Serf cluster if --serfAddr is set. The server advertises the addresses
+// of its cluster and match APIs as tags, along with its Raft address if Raft is enabled, its
+// shard copies if sharding is enabled, and any --tags given on the command line.
+func (a *application) startCluster() error {
+	cfg := a.config.cluster
+	if cfg.serfAddr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(cfg.serfAddr)
+	if err != nil {
+		return err
+	}
+	if host, err = advertiseHost(host); err != nil {
+		return err
+	}
+	nodeName, err := a.nodeName()
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{
+		cluster.TagRpcAddr:   net.JoinHostPort(host, strconv.Itoa(a.config.clusterServer.port)),
+		cluster.TagMatchAddr: net.JoinHostPort(host, strconv.Itoa(a.config.matchServer.port)),
+		cluster.TagAdminAddr: net.JoinHostPort(host, strconv.Itoa(a.config.adminServer.port)),
+	}
+	if a.consensus != nil {
+		tags[cluster.TagRaftAddr] = a.consensus.Address
+	}
+	if a.sharder != nil {
+		tags[cluster.TagShard] = strconv.Itoa(a.sharder.replicas)
+	}
+	for k, v := range cfg.tags {
+		tags[k] = v
+	}
+
+	member, err := cluster.NewClusterMember(nodeName, cfg.serfAddr, tags, cfg.joinPeers, a, a.logger)
+	if err != nil {
+		return err
+	}
+	a.cluster.setMember(member)
+	// Members that joined while we were still joining were recorded without their tags.
+	for _, mem := range member.Members() {
+		if mem.Name != nodeName && mem.Status == serf.StatusAlive {
+			a.cluster.setPeer(a.newClusterPeer(mem.Name, mem.Tags[cluster.TagRpcAddr]))
+		}
+	}
+	a.logger.Info(fmt.Sprintf("Joined the cluster as %s on %s", nodeName, cfg.serfAddr))
+	if a.consensus != nil {
+		go a.watchLeadership()
+	}
+	if a.sharder != nil {
+		a.sharder.refresh()
+		go a.sharder.run()
+	}
+	return nil
+}
+
+// nodeName returns the name this server goes by in the cluster: --nodeName, or the host it
+// advertises along with its match API port.
+func (a *application) nodeName() (string, error) {
+	if a.config.cluster.nodeName != "" {
+		return a.config.cluster.nodeName, nil
+	}
+	host, _, err := net.SplitHostPort(a.config.cluster.serfAddr)
+	if err != nil {
+		return "", err
+	}
+	if host, err = advertiseHost(host); err != nil {
+		return "", err
+	}
+	return host + ":" + strconv.Itoa(a.config.matchServer.port), nil
+}
+
+// advertiseHost returns the host other servers should use to reach one bound to host: the host
+// itself, or this machine's hostname if it binds to every interface.
+func advertiseHost(host string) (string, error) {
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		return os.Hostname()
+	}
+	return host, nil
+}
+
+// stopCluster leaves the cluster, so that the other members see a graceful leave rather than a
+// failure.
+func (a *application) stopCluster() {
+	member := a.cluster.getMember()
+	if member == nil {
+		return
+	}
+	if err := member.Shutdown(); err != nil {
+		a.logger.Error("Leaving the cluster: " + err.Error())
+	}
+}
+
+// newClusterPeer builds a peer from the tags the named member advertises.
+func (a *application) newClusterPeer(name, rpcAddr string) *clusterPeer {
+	p := &clusterPeer{
+		Name:    name,
+		RpcAddr: rpcAddr,
+		Tags:    map[string]string{},
+		Status:  peerAlive,
+		Since:   time.Now(),
+	}
+	if member := a.cluster.getMember(); member != nil {
+		if tags, ok := member.MemberTags(name); ok {
+			p.Tags = tags
+			p.MatchAddr = tags[cluster.TagMatchAddr]
+		}
+	}
+	return p
+}
+
+// Join is called by Serf when another member joins the cluster.
+func (a *application) Join(name, addr string) error {
+	p := a.newClusterPeer(name, addr)
+	a.cluster.setPeer(p)
+	a.logger.Info("Cluster member joined", zap.String("name", name), zap.String("rpc_addr", addr))
+	a.addVoter(*p)
+	a.refreshShards()
+	return nil
+}
+
+// Leave is called by Serf when another member leaves the cluster gracefully.
+func (a *application) Leave(name, addr string) error {
+	a.cluster.removePeer(name)
+	a.logger.Info("Cluster member left", zap.String("name", name), zap.String("rpc_addr", addr))
+	a.removeVoter(name)
+	a.refreshShards()
+	return nil
+}
+
+// Fail is called by Serf when another member stops responding. The member is kept, marked as
+// failed, until it recovers or is reaped, and isn't routed to in the meantime. It also stays a
+// Raft voter, so that Raft can carry on while a minority of members is down, but it is taken off
+// the shard ring, so that its keys are copied to other members.
+func (a *application) Fail(name, addr string) error {
+	if !a.cluster.setPeerStatus(name, peerFailed) {
+		return fmt.Errorf("unknown cluster member %s", name)
+	}
+	a.logger.Warn("Cluster member failed", zap.String("name", name), zap.String("rpc_addr", addr))
+	a.refreshShards()
+	return nil
+}
+
+// Reap is called by Serf when a failed member has been gone long enough to be forgotten.
+func (a *application) Reap(name, addr string) error {
+	a.cluster.removePeer(name)
+	a.logger.Info("Cluster member reaped", zap.String("name", name), zap.String("rpc_addr", addr))
+	a.removeVoter(name)
+	a.refreshShards()
+	return nil
+}
+
+// Update is called by Serf when a member's tags change, such as when it moves its cluster or
+// match API to another address.
+func (a *application) Update(name, addr string) error {
+	p := a.newClusterPeer(name, addr)
+	if prev, ok := a.cluster.getPeer(name); ok {
+		p.Status = prev.Status
+		p.Since = prev.Since
+	}
+	a.cluster.setPeer(p)
+	a.logger.Info("Cluster member updated", zap.String("name", name), zap.String("rpc_addr", addr), zap.String("match_addr", p.MatchAddr))
+	if p.Status == peerAlive {
+		a.addVoter(*p)
+	}
+	a.refreshShards()
+	return nil
+}
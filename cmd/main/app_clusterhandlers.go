@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+)
+
+// handleHttpGetClusterMembers lists this server and the other cluster members it knows about,
+// with the addresses they advertise, along with this server's view of Raft if it's enabled.
+func (a *application) handleHttpGetClusterMembers(w http.ResponseWriter, r *http.Request) {
+
+	type selfData struct {
+		Name     string            `json:"name"`
+		SerfAddr string            `json:"serfAddr"`
+		Tags     map[string]string `json:"tags"`
+	}
+	type responseData struct {
+		Self    selfData      `json:"self"`
+		Members []clusterPeer `json:"members"`
+		Raft    *raftStatus   `json:"raft,omitempty"`
+		Shards  *shardStatus  `json:"shards,omitempty"`
+	}
+	type responseModel struct {
+		Ok   bool         `json:"ok"`
+		Data responseData `json:"data"`
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (GET only)"],"data":{}}`))
+		return
+	}
+	member := a.cluster.getMember()
+	if member == nil {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Cluster membership is not configured (set --serfAddr)"],"data":{}}`))
+		return
+	}
+
+	peers := a.cluster.peerList()
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	data := responseData{
+		Self: selfData{
+			Name:     member.NodeName,
+			SerfAddr: member.Address,
+			Tags:     member.Tags,
+		},
+		Members: peers,
+	}
+	var err error
+	if a.consensus != nil {
+		if data.Raft, err = a.raftStatus(); err != nil {
+			a.logger.Error(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+		}
+	}
+	if a.sharder != nil {
+		st := a.sharder.status()
+		data.Shards = &st
+	}
+	val, err := json.Marshal(responseModel{
+		Ok:   true,
+		Data: data,
+	})
+	if err != nil {
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem returning results"],"data":{}}`))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(val)
+}
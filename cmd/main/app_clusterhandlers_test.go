@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClusterMembersHandler(t *testing.T) {
+	a := newTestApplication(t)
+	get := func() (int, map[string]any) {
+		req := httptest.NewRequest("GET", "/api/admin/v1/cluster/members", nil)
+		w := httptest.NewRecorder()
+		a.handleHttpGetClusterMembers(w, req)
+		var res map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Response isn't JSON: %s", w.Body.String())
+		}
+		return w.Code, res
+	}
+
+	if code, res := get(); code != 400 || res["ok"] != false {
+		t.Errorf("Expected a 400 without cluster membership, got %d: %v", code, res)
+	}
+
+	// The handler only needs what this server advertises, so a member that never joins Serf will do.
+	a.cluster.setMember(&cluster.ClusterMember{
+		NodeName: "node-a",
+		Address:  "127.0.0.1:7946",
+		Tags:     map[string]string{cluster.TagRpcAddr: "127.0.0.1:7070", cluster.TagMatchAddr: "127.0.0.1:8080"},
+	})
+	since := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	for _, name := range []string{"node-c", "node-b"} {
+		a.cluster.setPeer(&clusterPeer{
+			Name:      name,
+			RpcAddr:   name + ":7070",
+			MatchAddr: name + ":8080",
+			Tags:      map[string]string{cluster.TagMatchAddr: name + ":8080"},
+			Status:    peerAlive,
+			Since:     since,
+		})
+	}
+	if err := a.Fail("node-c", "node-c:7070"); err != nil {
+		t.Fatal("Fail: " + err.Error())
+	}
+
+	code, res := get()
+	if code != 200 || res["ok"] != true {
+		t.Fatalf("Expected a 200, got %d: %v", code, res)
+	}
+	data := res["data"].(map[string]any)
+	self := data["self"].(map[string]any)
+	if self["name"] != "node-a" || self["serfAddr"] != "127.0.0.1:7946" || self["tags"].(map[string]any)[cluster.TagMatchAddr] != "127.0.0.1:8080" {
+		t.Errorf("Unexpected self: %v", self)
+	}
+	if _, ok := data["raft"]; ok {
+		t.Error("Expected no raft status without Raft")
+	}
+	if _, ok := data["shards"]; ok {
+		t.Error("Expected no shard status without sharding")
+	}
+
+	members := data["members"].([]any)
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members, got %v", members)
+	}
+	for x, want := range []struct{ name, status string }{{"node-b", peerAlive}, {"node-c", peerFailed}} {
+		m := members[x].(map[string]any)
+		if m["name"] != want.name || m["status"] != want.status {
+			t.Errorf("Expected member %d to be %s (%s), got %v", x, want.name, want.status, m)
+		}
+		if m["rpcAddr"] != want.name+":7070" || m["matchAddr"] != want.name+":8080" {
+			t.Errorf("Unexpected addresses for %s: %v", want.name, m)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, m["since"].(string)); err != nil {
+			t.Errorf("Expected %s's since to be a timestamp, got %v", want.name, m["since"])
+		}
+	}
+	if members[0].(map[string]any)["since"] != since.Format(time.RFC3339Nano) {
+		t.Errorf("Expected node-b to be alive since %s, got %v", since.Format(time.RFC3339Nano), members[0].(map[string]any)["since"])
+	}
+}
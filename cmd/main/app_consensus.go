@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/snapshot"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"net"
+	"sort"
+	"time"
+)
+
+// raftApplyTimeout is how long a change waits to be queued for the Raft log before giving up.
+const raftApplyTimeout = 10 * time.Second
+
+// raftStatus is reported on the cluster membership endpoint.
+type raftStatus struct {
+	State        string                    `json:"state"`
+	Leader       string                    `json:"leader"`
+	LeaderAddr   string                    `json:"leaderAddr"`
+	AppliedIndex uint64                    `json:"appliedIndex"`
+	Servers      []cluster.ConsensusServer `json:"servers"`
+}
+
+// ruleStateMachine applies changes committed through Raft to the rule set.
+type ruleStateMachine struct {
+	app *application
+}
+
+var _ cluster.StateMachine = ruleStateMachine{}
+
+// startConsensus joins the Raft cluster if --raftAddr is set. Raft members are named after their
+// Serf members, and advertise their Raft address as a Serf tag, so that the leader can add and
+// remove voters as servers join and leave.
+func (a *application) startConsensus() error {
+	cfg := a.config.consensus
+	if cfg.raftAddr == "" {
+		return nil
+	}
+	if a.config.cluster.serfAddr == "" {
+		return errors.New("--raftAddr needs --serfAddr, so that cluster members can find each other")
+	}
+	if cfg.raftDir == "" {
+		return errors.New("--raftAddr needs --raftDir")
+	}
+	if a.replica != nil {
+		return errors.New("--raftAddr can't be used with --followPrimary")
+	}
+	nodeName, err := a.nodeName()
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(cfg.raftAddr)
+	if err != nil {
+		return err
+	}
+	if host, err = advertiseHost(host); err != nil {
+		return err
+	}
+	a.consensus, err = cluster.NewConsensusMember(cluster.ConsensusConfig{
+		NodeID:        nodeName,
+		BindAddr:      cfg.raftAddr,
+		AdvertiseAddr: net.JoinHostPort(host, port),
+		DataDir:       cfg.raftDir,
+		Bootstrap:     cfg.bootstrap,
+	}, ruleStateMachine{app: a}, a.logger)
+	if err != nil {
+		return err
+	}
+	a.forwarder = newLeaderForwarder(a)
+	a.logger.Info(fmt.Sprintf("Started Raft as %s on %s", nodeName, a.consensus.Address))
+	return nil
+}
+
+// stopConsensus stops taking part in Raft. A leader first removes itself from the Raft
+// configuration, since it won't hear about its own departure from Serf.
+func (a *application) stopConsensus() {
+	if a.consensus == nil {
+		return
+	}
+	if err := a.consensus.Leave(); err != nil {
+		a.logger.Error("Leaving the Raft cluster: " + err.Error())
+	}
+	if err := a.consensus.Shutdown(); err != nil {
+		a.logger.Error("Raft shutdown: " + err.Error())
+	}
+	a.forwarder.close()
+}
+
+// watchLeadership makes sure that every live cluster member is a voter whenever this server
+// becomes the Raft leader, since members may have joined while another server was leading.
+func (a *application) watchLeadership() {
+	a.reconcileVoters()
+	for {
+		select {
+		case <-a.chShutdown:
+			return
+		case isLeader := <-a.consensus.LeaderCh():
+			if isLeader {
+				a.logger.Info("This server is now the Raft leader")
+				a.reconcileVoters()
+			} else {
+				a.logger.Info("This server is no longer the Raft leader")
+			}
+		}
+	}
+}
+
+// reconcileVoters adds every live cluster member to the Raft configuration. Only the leader acts
+// on it.
+func (a *application) reconcileVoters() {
+	if !a.consensus.IsLeader() {
+		return
+	}
+	for _, p := range a.cluster.peerList() {
+		if p.Status == peerAlive {
+			a.addVoter(p)
+		}
+	}
+}
+
+// addVoter adds a peer that advertises a Raft address to the Raft configuration.
+func (a *application) addVoter(p clusterPeer) {
+	if a.consensus == nil || p.Tags[cluster.TagRaftAddr] == "" {
+		return
+	}
+	if err := a.consensus.Join(p.Name, p.Tags[cluster.TagRaftAddr]); err != nil {
+		a.logger.Error("Could not add Raft voter", zap.String("name", p.Name), zap.String("error", err.Error()))
+	}
+}
+
+// removeVoter takes a peer that has left the cluster out of the Raft configuration.
+func (a *application) removeVoter(name string) {
+	if a.consensus == nil {
+		return
+	}
+	if err := a.consensus.Remove(name); err != nil {
+		a.logger.Error("Could not remove Raft voter", zap.String("name", name), zap.String("error", err.Error()))
+	}
+}
+
+// raftStatus reports this server's view of the Raft cluster.
+func (a *application) raftStatus() (*raftStatus, error) {
+	servers, err := a.consensus.Servers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+	addr, id := a.consensus.Leader()
+	return &raftStatus{
+		State:        a.consensus.State(),
+		Leader:       id,
+		LeaderAddr:   addr,
+		AppliedIndex: a.consensus.AppliedIndex(),
+		Servers:      servers,
+	}, nil
+}
+
+// ApplyEntries applies a batch of committed entries as a single generation, stamping and logging
+// them locally. The entries are already durable in the Raft log, so the generation is published
+// straight away instead of holding up Raft until they're in the WAL; the WAL write is reported
+// through the result, so that the entries are logged again after a restart if it never finished.
+// Entries this server had logged before it was restarted are replayed without being logged again.
+func (sm ruleStateMachine) ApplyEntries(entries []wal.WalEntry, replayed bool) cluster.ApplyResult {
+	a := sm.app
+	fn := func(r *registry.Registry) error {
+		return a.applyEntries(r, entries)
+	}
+	if replayed {
+		gen, err := a.mutate(fn)
+		return cluster.ApplyResult{Generation: gen, Err: err}
+	}
+	g, durable, err := a.mutateAndSubmit(entries, fn)
+	if err != nil {
+		return cluster.ApplyResult{Generation: g.gen, Err: err}
+	}
+	a.publish(g)
+	res := cluster.ApplyResult{Generation: g.gen}
+	if len(entries) > 0 {
+		res.Timestamp = entries[len(entries)-1].Timestamp
+		res.Logged = durable
+	}
+	return res
+}
+
+// Snapshot captures the registry for Raft.
+func (sm ruleStateMachine) Snapshot() snapshot.Snapshot {
+	return sm.app.captureSnapshot()
+}
+
+// Restore replaces the rule set with a Raft snapshot. Keys the snapshot doesn't have are deleted
+// and every key it does have is replaced, so that the change can be logged like any other.
+func (sm ruleStateMachine) Restore(s snapshot.Snapshot, replayed bool) error {
+	a := sm.app
+	entries := make([]wal.WalEntry, 0, len(s.Keys))
+	current := a.currentGeneration().registry.Snapshot()
+	for key := range current {
+		if _, ok := s.Keys[key]; !ok {
+			entries = append(entries, newWalEntry(wal.WAL_DEL, key, "-"))
+		}
+	}
+	keys := make([]string, 0, len(s.Keys))
+	for key := range s.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		payload, err := encodePatterns(s.Keys[key])
+		if err != nil {
+			return err
+		}
+		entries = append(entries, newWalEntry(wal.WAL_REPLACE, key, payload))
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	res := sm.ApplyEntries(entries, replayed)
+	if res.Err != nil {
+		return res.Err
+	}
+	if res.Logged != nil {
+		if err := <-res.Logged; err != nil {
+			// The snapshot has been applied; Raft still has it, even if the WAL doesn't.
+			a.logger.Error("Could not log a restored Raft snapshot: " + err.Error())
+		}
+	}
+	a.logger.Info(fmt.Sprintf("Restored %d keys from a Raft snapshot", len(s.Keys)))
+	return nil
+}
@@ -1,50 +1,240 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
 	"github.com/highgrav/munchkin/internal/wal"
 	"quamina.net/go/quamina"
-	"time"
 )
 
 var ErrNotImplemented = errors.New("Not implemented!")
+var ErrPatternNotFound = errors.New("Pattern not found")
+var ErrStaleEntry = errors.New("Entry is older than the last applied change")
+var ErrNotLogged = errors.New("Change was applied but could not be logged")
+var ErrTimestampsExhausted = errors.New("No timestamps are left after the last applied change")
 
 // TODO -- when writing to WAL files, may need to buffer changes to an in-memory
 //// structure if the server is streaming historical changes to a new cluster
 //// node.
 
+// patternRef is the value each pattern is registered under in Quamina, so that a match can be
+// traced back to both the key and the pattern that matched.
+type patternRef struct {
+	key     string
+	pattern string
+}
+
+func newPatternRef(key, pattern string) patternRef {
+	return patternRef{
+		key:     key,
+		pattern: registry.Canonical(pattern),
+	}
+}
+
+// applyEntry applies a single logged mutation to r, the registry the next matcher generation will
+// be built from. A delete with an empty (or "-") pattern removes every pattern for the key; a
+// delete with a pattern removes just that pattern. Patterns are checked before they're added, so
+// that r only ever holds patterns Quamina will accept. It must only be called on a registry
+// nobody else is using, i.e. from inside mutate() or while loading at startup.
+func (a *application) applyEntry(r *registry.Registry, action uint16, key, pattern string) error {
+	switch action {
+	case wal.WAL_ADD:
+		if r.HasPattern(key, pattern) {
+			return nil
+		}
+		if err := validatePattern(pattern); err != nil {
+			return err
+		}
+		r.Add(key, pattern)
+	case wal.WAL_DEL:
+		if len(pattern) <= 1 {
+			r.DeleteKey(key)
+			return nil
+		}
+		r.DeletePattern(key, pattern)
+	case wal.WAL_REPLACE:
+		patterns, err := decodePatterns(pattern)
+		if err != nil {
+			return err
+		}
+		if err = validatePatterns(patterns); err != nil {
+			return err
+		}
+		r.Replace(key, patterns)
+	default:
+		return fmt.Errorf("unknown WAL action %d", action)
+	}
+	return nil
+}
+
+// encodePatterns encodes a list of patterns as the JSON array carried by WAL_REPLACE entries.
+func encodePatterns(patterns []string) (string, error) {
+	raw := make([]json.RawMessage, 0, len(patterns))
+	for _, p := range patterns {
+		raw = append(raw, json.RawMessage(p))
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodePatterns decodes the JSON array of patterns carried by WAL_REPLACE entries.
+func decodePatterns(payload string) ([]string, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &raw); err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0, len(raw))
+	for _, p := range raw {
+		patterns = append(patterns, string(p))
+	}
+	return patterns, nil
+}
+
+// validatePatterns checks that Quamina will accept every pattern in a list, using a scratch
+// matcher so that the live ones are left alone.
+func validatePatterns(patterns []string) error {
+	q, err := quamina.New()
+	if err != nil {
+		return err
+	}
+	for x, p := range patterns {
+		if err = q.AddPattern(x, p); err != nil {
+			return fmt.Errorf("pattern %d: %w", x, err)
+		}
+	}
+	return nil
+}
+
+// validatePattern checks that Quamina will accept a single pattern.
+func validatePattern(pattern string) error {
+	q, err := quamina.New()
+	if err != nil {
+		return err
+	}
+	return q.AddPattern(0, pattern)
+}
+
+// checkEntrySize rejects a key and pattern that are too large to be written to the WAL. Admin
+// handlers call it before applying a change, so that the matcher never holds a pattern the log
+// couldn't record.
+func checkEntrySize(key, pattern string) error {
+	return wal.CheckEntrySize([]byte(key), []byte(pattern))
+}
+
 // addRule adds a rule to the matcher without logging it
-func (a *application) addRule(id quamina.X, rule string) {
-	m := <-a.pool.Pool
-	err := m.AddPattern(id, rule)
-	a.pool.Pool <- m
+func (a *application) addRule(key, rule string) {
+	_, err := a.mutate(func(r *registry.Registry) error {
+		return a.applyEntry(r, wal.WAL_ADD, key, rule)
+	})
 	if err != nil {
 		a.logger.Error(err.Error())
 	}
 }
 
 // deleteAllRulesFor removes a rule from the matcher without logging it
-func (a *application) deleteAllRulesFor(id quamina.X) {
-	m := <-a.pool.Pool
-	err := m.DeletePatterns(id)
-	a.pool.Pool <- m
+func (a *application) deleteAllRulesFor(key string) {
+	_, err := a.mutate(func(r *registry.Registry) error {
+		return a.applyEntry(r, wal.WAL_DEL, key, "-")
+	})
 	if err != nil {
 		a.logger.Error(err.Error())
 	}
 }
 
-func (a *application) deleteMatchingRulesFor(id quamina.X, pattern string) (int, error) {
-	return -1, ErrNotImplemented
+// deleteMatchingRulesFor removes a single pattern from a key without logging it, returning the
+// generation the change was published in. ErrPatternNotFound is returned if the key doesn't have
+// the pattern.
+func (a *application) deleteMatchingRulesFor(key, pattern string) (uint64, error) {
+	return a.mutate(func(r *registry.Registry) error {
+		if !r.HasPattern(key, pattern) {
+			return ErrPatternNotFound
+		}
+		return a.applyEntry(r, wal.WAL_DEL, key, pattern)
+	})
+}
+
+// checkEntries checks that every entry in a batch has a known action and patterns Quamina will
+// accept, so that a bad entry late in a batch is caught before any of the batch is applied.
+func checkEntries(entries []wal.WalEntry) error {
+	for x, e := range entries {
+		var err error
+		switch e.Action {
+		case wal.WAL_ADD:
+			err = validatePattern(string(e.Pattern))
+		case wal.WAL_DEL:
+		case wal.WAL_REPLACE:
+			var patterns []string
+			if patterns, err = decodePatterns(string(e.Pattern)); err == nil {
+				err = validatePatterns(patterns)
+			}
+		default:
+			err = fmt.Errorf("unknown WAL action %d", e.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", x, err)
+		}
+	}
+	return nil
+}
+
+// applyEntries applies a batch of entries to r, as the admin API would: deleting a single pattern
+// that the key doesn't have fails with ErrPatternNotFound. The whole batch is checked before any
+// of it is applied. A batch can still fail partway through (by deleting a pattern an earlier entry
+// removed, say), so r should be a private copy that is thrown away on error, as it is in mutate().
+func (a *application) applyEntries(r *registry.Registry, entries []wal.WalEntry) error {
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		key, pattern := string(e.Key), string(e.Pattern)
+		if e.Action == wal.WAL_DEL && len(pattern) > 1 && !r.HasPattern(key, pattern) {
+			return ErrPatternNotFound
+		}
+		if err := a.applyEntry(r, e.Action, key, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitEntries applies a batch of entries as a single generation and logs them. When Raft is
+// enabled, the entries are committed through the Raft log instead, which applies them on every
+// member; when the rule set is sharded, they are applied on every member that owns their keys.
+// Either way, the generation returned is this server's.
+func (a *application) commitEntries(entries []wal.WalEntry) (uint64, error) {
+	if a.consensus != nil {
+		res, err := a.consensus.Apply(entries, raftApplyTimeout)
+		return res.Generation, err
+	}
+	if a.sharder != nil {
+		return a.sharder.commit(entries)
+	}
+	return a.mutateAndLog(entries, func(r *registry.Registry) error {
+		return a.applyEntries(r, entries)
+	})
+}
+
+// commitOrForward commits a single entry like commitEntries, except that when Raft is enabled and
+// this server isn't the leader, the entry is forwarded to the leader.
+func (a *application) commitOrForward(e wal.WalEntry) (uint64, error) {
+	if a.forwarder == nil {
+		return a.commitEntries([]wal.WalEntry{e})
+	}
+	return a.forwarder.commitOrForward(e)
 }
 
-func (a *application) hasKey(id quamina.X) (bool, error) {
-	return false, ErrNotImplemented
+// hasKey checks whether any patterns are attached to a key.
+func (a *application) hasKey(key string) bool {
+	return a.currentGeneration().registry.HasKey(key)
 }
 
 func (a *application) match(ch chan quamina.X, data string) {
-	m := <-a.pool.Pool
-	results, err := m.MatchesForEvent([]byte(data))
-	a.pool.Pool <- m
+	results, err := a.currentGeneration().matchesForEvent([]byte(data))
 	if err != nil {
 		a.logger.Error(err.Error())
 		return
@@ -61,24 +251,17 @@ func (a *application) match(ch chan quamina.X, data string) {
 // Usage:
 //
 //	   timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
-//		  doneChan := make(chan bool)
-//		  errChan := make(chan error)
+//		  doneChan := make(chan uint64, 1)
+//		  errChan := make(chan error, 1)
 //		  go a.asyncDeleteAllRulesFor(key, doneChan, errChan)
-func (a *application) asyncDeleteAllRulesFor(key string, doneChan chan bool, errChan chan error) {
-	ts := time.Now().UnixNano()
-	pq := <-a.pool.Pool
-	err := pq.DeletePatterns(key)
-	a.pool.Pool <- pq
+func (a *application) asyncDeleteAllRulesFor(key string, doneChan chan uint64, errChan chan error) {
+	gen, err := a.commitOrForward(newWalEntry(wal.WAL_DEL, key, "-"))
 	if err != nil {
 		errChan <- err
 		return
 	}
-	if a.config.writeWalFiles {
-		go a.walFileMgr.writeWalFileEntry(ts, key, "-", wal.WAL_DEL, a.logger)
-		a.lastUpdatedOn = uint64(ts)
-	}
 
-	doneChan <- true
+	doneChan <- gen
 	return
 }
 
@@ -88,25 +271,90 @@ func (a *application) asyncDeleteAllRulesFor(key string, doneChan chan bool, err
 // Usage:
 //
 //	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
-//	doneChan := make(chan bool)
-//	errChan := make(chan error)
+//	doneChan := make(chan uint64, 1)
+//	errChan := make(chan error, 1)
 //	go a.asyncAddRule(key, string(rule), doneChan, errChan)
+func (a *application) asyncAddRule(key, rule string, doneChan chan uint64, errChan chan error) {
+	gen, err := a.commitOrForward(newWalEntry(wal.WAL_ADD, key, rule))
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	doneChan <- gen
+	return
+}
+
+// asyncDeleteMatchingRulesFor is a goroutine that removes a single pattern from a key in the local
+// database. Like asyncDeleteAllRulesFor, it is not meant for replaying logs.
+// Usage:
+//
+//	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+//	doneChan := make(chan uint64, 1)
+//	errChan := make(chan error, 1)
+//	go a.asyncDeleteMatchingRulesFor(key, string(rule), doneChan, errChan)
+func (a *application) asyncDeleteMatchingRulesFor(key, pattern string, doneChan chan uint64, errChan chan error) {
+	gen, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_DEL, key, pattern)})
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	doneChan <- gen
+	return
+}
+
+// asyncReplaceRulesFor is a goroutine that swaps out every pattern for a key in the local
+// database, and logs the change as a single WAL_REPLACE entry so that replaying the log has the
+// same all-or-nothing effect. Like asyncAddRule, it is not meant for replaying logs.
+// Usage:
 //
-// TODO -- this is where raft logic will go
-func (a *application) asyncAddRule(key, rule string, doneChan chan bool, errChan chan error) {
-	ts := time.Now().UnixNano()
-	pq := <-a.pool.Pool
-	err := pq.AddPattern(key, rule)
-	a.pool.Pool <- pq
+//	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+//	doneChan := make(chan uint64, 1)
+//	errChan := make(chan error, 1)
+//	go a.asyncReplaceRulesFor(key, patterns, doneChan, errChan)
+func (a *application) asyncReplaceRulesFor(key string, patterns []string, doneChan chan uint64, errChan chan error) {
+	payload, err := encodePatterns(patterns)
 	if err != nil {
 		errChan <- err
 		return
 	}
-	if a.config.writeWalFiles {
-		go a.walFileMgr.writeWalFileEntry(ts, key, rule, wal.WAL_ADD, a.logger)
-		a.lastUpdatedOn = uint64(ts)
+	gen, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_REPLACE, key, payload)})
+	if err != nil {
+		errChan <- err
+		return
 	}
 
-	doneChan <- true
+	doneChan <- gen
+	return
+}
+
+// importRecord is a single key/pattern pair, as read by the bulk import endpoint and written by
+// the bulk export endpoint.
+type importRecord struct {
+	Key     string          `json:"key"`
+	Pattern json.RawMessage `json:"pattern"`
+}
+
+// asyncImportRules is a goroutine that adds a batch of rules to the local database, publishing
+// them all in a single generation. The records are expected to have been validated already.
+// Like asyncAddRule, it is not meant for replaying logs.
+// Usage:
+//
+//	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+//	doneChan := make(chan uint64, 1)
+//	errChan := make(chan error, 1)
+//	go a.asyncImportRules(records, doneChan, errChan)
+func (a *application) asyncImportRules(records []importRecord, doneChan chan uint64, errChan chan error) {
+	entries := make([]wal.WalEntry, 0, len(records))
+	for _, rec := range records {
+		entries = append(entries, newWalEntry(wal.WAL_ADD, rec.Key, string(rec.Pattern)))
+	}
+	gen, err := a.commitEntries(entries)
+	if err != nil {
+		errChan <- err
+		return
+	}
+	doneChan <- gen
 	return
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"github.com/highgrav/munchkin/internal/wal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// raftIndexHeader is the gRPC response header the leader reports the Raft log index of a
+// committed LogEntry under.
+const raftIndexHeader = "munchkin-raft-index"
+
+const (
+	// maxForwardWait bounds how long a change is retried while the cluster has no leader, or while
+	// leadership is changing hands, and how long this server then waits to apply it.
+	maxForwardWait        = 10 * time.Second
+	minForwardRetryDelay  = 50 * time.Millisecond
+	maxForwardRetryDelay  = time.Second
+	forwardRequestTimeout = 5 * time.Second
+)
+
+// ErrNoLeader is returned when a change can't be committed because no leader could be reached
+// before maxForwardWait ran out.
+var ErrNoLeader = errors.New("No Raft leader is available")
+
+// ErrNotYetApplied is returned when the leader has committed a forwarded change, but this server
+// hasn't applied it yet.
+var ErrNotYetApplied = errors.New("Change committed by the leader but not yet applied here")
+
+// leaderForwarder sends changes made on a follower to the Raft leader's WAL gRPC service, keeping
+// a connection to each leader it has used.
+type leaderForwarder struct {
+	app   *application
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newLeaderForwarder(app *application) *leaderForwarder {
+	return &leaderForwarder{
+		app:   app,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+// commitOrForward commits a single entry through Raft, forwarding it to the leader if this server
+// isn't the leader. The generation returned is this server's, once it has applied the entry. The
+// leader is looked up afresh on each attempt, so that a change made during an election goes to
+// whichever server wins it. Entries are only retried when they may not have been committed; adds
+// and deletes are idempotent, so one that was committed after all does no harm.
+func (f *leaderForwarder) commitOrForward(e wal.WalEntry) (uint64, error) {
+	deadline := time.Now().Add(maxForwardWait)
+	delay := minForwardRetryDelay
+	for {
+		gen, err := f.tryCommit(e, deadline)
+		if err == nil || !retryableForward(err) {
+			return gen, err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			f.app.logger.Warn("Giving up forwarding a change to the leader: " + err.Error())
+			return gen, ErrNoLeader
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxForwardRetryDelay {
+			delay = maxForwardRetryDelay
+		}
+	}
+}
+
+// tryCommit makes a single attempt to commit an entry, locally if this server is the leader and on
+// the leader otherwise. An entry the leader can't apply is reported with an InvalidArgument status
+// either way, as the leader's WAL gRPC service reports it to followers.
+func (f *leaderForwarder) tryCommit(e wal.WalEntry, deadline time.Time) (uint64, error) {
+	consensus := f.app.consensus
+	if consensus.IsLeader() {
+		res, err := consensus.Apply([]wal.WalEntry{e}, raftApplyTimeout)
+		if res.Err != nil {
+			return res.Generation, status.Error(codes.InvalidArgument, res.Err.Error())
+		}
+		return res.Generation, err
+	}
+	_, leader := consensus.Leader()
+	if leader == "" || leader == consensus.NodeID {
+		return 0, ErrNoLeader
+	}
+	p, ok := f.app.cluster.getPeer(leader)
+	if !ok || p.RpcAddr == "" {
+		return 0, fmt.Errorf("%w: leader %s isn't a known cluster member", ErrNoLeader, leader)
+	}
+	conn, err := f.conn(p.RpcAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardRequestTimeout)
+	defer cancel()
+	var header metadata.MD
+	_, err = api.NewWalClient(conn).LogEntry(ctx, &api.LogEntryRequest{
+		Entry: &api.WalEntry{
+			Key:     e.Key,
+			Pattern: e.Pattern,
+			Action:  uint32(e.Action),
+		},
+	}, grpc.Header(&header))
+	if err != nil {
+		return 0, err
+	}
+	vals := header.Get(raftIndexHeader)
+	if len(vals) == 0 {
+		return 0, fmt.Errorf("leader %s didn't report a Raft index", leader)
+	}
+	index, err := strconv.ParseUint(vals[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("leader %s reported a bad Raft index: %w", leader, err)
+	}
+
+	// Wait until the change is visible here, so that it shows up in this server's matches as soon
+	// as the caller hears it has been made.
+	if !consensus.WaitForApplied(index, time.Until(deadline)) {
+		return 0, ErrNotYetApplied
+	}
+	return f.app.currentGeneration().gen, nil
+}
+
+// retryableForward reports whether a failed attempt might succeed against the current leader.
+func retryableForward(err error) bool {
+	if errors.Is(err, ErrNoLeader) || cluster.IsLeadershipError(err) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.FailedPrecondition, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// conn returns a connection to the WAL gRPC service at addr, dialling it the first time.
+func (f *leaderForwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if conn, ok := f.conns[addr]; ok {
+		return conn, nil
+	}
+	creds, err := f.app.rpcDialOption()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(addr, creds)
+	if err != nil {
+		return nil, err
+	}
+	f.conns[addr] = conn
+	return conn, nil
+}
+
+// close closes every connection to a leader.
+func (f *leaderForwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, conn := range f.conns {
+		conn.Close()
+		delete(f.conns, addr)
+	}
+}
+
+// writeForwardingError answers a change that couldn't be forwarded to the leader, or that the
+// leader rejected, returning false if err isn't a forwarding error.
+func (a *application) writeForwardingError(w http.ResponseWriter, err error) bool {
+	switch {
+	case status.Code(err) == codes.InvalidArgument:
+		a.logger.Warn("The Raft leader rejected a change: " + status.Convert(err).Message())
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Invalid key or pattern"],"data":{}}`))
+	case errors.Is(err, ErrNoLeader):
+		w.WriteHeader(503)
+		w.Write([]byte(`{"ok":false,"errors":["No Raft leader is available; try again shortly"],"data":{}}`))
+	case errors.Is(err, ErrNotYetApplied):
+		w.WriteHeader(202)
+		w.Write([]byte(`{"ok":true,"errors":["Committed by the leader, but not yet applied on this server"],"data":{}}`))
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/cluster"
+	munchkinnet "github.com/highgrav/munchkin/internal/net"
+	"go.uber.org/zap"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startRaftNode starts a test application that commits changes through Raft, serving its WAL gRPC
+// service on a local port, with the TLS settings in rpc, so that followers can forward changes to
+// it.
+func startRaftNode(t *testing.T, id string, raftPort int, bootstrap bool, rpc webServerConfig) (*application, string) {
+	t.Helper()
+	a := newTestApplication(t)
+	a.config.clusterServer = rpc
+	var err error
+	a.consensus, err = cluster.NewConsensusMember(cluster.ConsensusConfig{
+		NodeID:           id,
+		BindAddr:         fmt.Sprintf("127.0.0.1:%d", raftPort),
+		DataDir:          t.TempDir(),
+		Bootstrap:        bootstrap,
+		HeartbeatTimeout: 200 * time.Millisecond,
+		ElectionTimeout:  200 * time.Millisecond,
+	}, ruleStateMachine{app: a}, zap.NewNop())
+	if err != nil {
+		t.Fatal("NewConsensusMember: " + err.Error())
+	}
+	a.forwarder = newLeaderForwarder(a)
+
+	a.walServer, err = newWalServer(a, &walConfig{}, rpc)
+	if err != nil {
+		t.Fatal("newWalServer: " + err.Error())
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.walServer.server.Serve(lis)
+	t.Cleanup(func() {
+		a.walServer.server.Stop()
+		a.forwarder.close()
+		a.consensus.Shutdown()
+	})
+	return a, lis.Addr().String()
+}
+
+func TestFollowerForwardsToLeader(t *testing.T) {
+	ports, _ := munchkinnet.GetFreePorts(2, 6000, 0)
+	if len(ports) < 2 {
+		t.Fatal("No free ports available for the cluster!")
+	}
+	leader, leaderRpc := startRaftNode(t, "leader", ports[0], true, webServerConfig{})
+	follower, _ := startRaftNode(t, "follower", ports[1], false, webServerConfig{})
+	if _, err := leader.consensus.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.consensus.Join(follower.consensus.NodeID, follower.consensus.Address); err != nil {
+		t.Fatal("Join: " + err.Error())
+	}
+	follower.cluster.setPeer(&clusterPeer{Name: "leader", RpcAddr: leaderRpc, Status: peerAlive})
+
+	send := func(method, target, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		if method == "POST" {
+			follower.handleHttpPostAddRule(w, req)
+		} else {
+			follower.handleHttpDeleteByKey(w, req)
+		}
+		return w.Code, w.Body.String()
+	}
+
+	// A change made on the follower is committed by the leader, and visible on both once answered.
+	if code, body := send("POST", "/api/admin/v1/add?key=first-test-key", `{"sys":["filestore"]}`); code != 200 {
+		t.Fatalf("Expected 200 adding a pattern on the follower, got %d: %s", code, body)
+	}
+	if !follower.hasKey("first-test-key") {
+		t.Error("The forwarded change wasn't applied on the follower")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !leader.hasKey("first-test-key") && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !leader.hasKey("first-test-key") {
+		t.Error("The forwarded change wasn't applied on the leader")
+	}
+
+	// Changes the leader rejects are the caller's fault, not the server's.
+	if code, body := send("POST", "/api/admin/v1/add?key=second-test-key", `{"sys":"filestore"}`); code != 400 {
+		t.Errorf("Expected 400 for an invalid pattern, got %d: %s", code, body)
+	}
+	if code, body := send("DELETE", "/api/admin/v1/delete-by-key?key=", ""); code != 400 {
+		t.Errorf("Expected 400 for an empty key, got %d: %s", code, body)
+	}
+
+	if code, body := send("DELETE", "/api/admin/v1/delete-by-key?key=first-test-key", ""); code != 200 {
+		t.Fatalf("Expected 200 deleting a key on the follower, got %d: %s", code, body)
+	}
+	if follower.hasKey("first-test-key") {
+		t.Error("The forwarded delete wasn't applied on the follower")
+	}
+	if g := follower.currentGeneration(); g.gen != 2 {
+		t.Errorf("Expected the follower to be at generation 2, got %d", g.gen)
+	}
+}
+
+func TestFollowerForwardsOverTLS(t *testing.T) {
+	ports, _ := munchkinnet.GetFreePorts(2, 6000, 0)
+	if len(ports) < 2 {
+		t.Fatal("No free ports available for the cluster!")
+	}
+	rpc := writeTestCerts(t)
+	leader, leaderRpc := startRaftNode(t, "leader", ports[0], true, rpc)
+	follower, _ := startRaftNode(t, "follower", ports[1], false, rpc)
+	if _, err := leader.consensus.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.consensus.Join(follower.consensus.NodeID, follower.consensus.Address); err != nil {
+		t.Fatal("Join: " + err.Error())
+	}
+	follower.cluster.setPeer(&clusterPeer{Name: "leader", RpcAddr: leaderRpc, Status: peerAlive})
+
+	req := httptest.NewRequest("POST", "/api/admin/v1/add?key=first-test-key", strings.NewReader(`{"sys":["filestore"]}`))
+	w := httptest.NewRecorder()
+	follower.handleHttpPostAddRule(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 adding a pattern on the follower, got %d: %s", w.Code, w.Body.String())
+	}
+	if !follower.hasKey("first-test-key") {
+		t.Error("The change forwarded over TLS wasn't applied on the follower")
+	}
+}
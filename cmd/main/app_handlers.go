@@ -3,22 +3,108 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"quamina.net/go/quamina"
+	"strconv"
 	"time"
 )
 
-func handleGetHeartbeat(w http.ResponseWriter, r *http.Request) {
+// matchedKeys turns the values returned by Quamina for a match into the list of matched keys.
+// A key with several matching patterns is only listed once.
+func matchedKeys(matches []quamina.X) []string {
+	matchList := make([]string, 0, len(matches))
+	seen := make(map[string]bool, len(matches))
+	for _, v := range matches {
+		ref := v.(patternRef)
+		if len(ref.key) > 0 && !seen[ref.key] {
+			seen[ref.key] = true
+			matchList = append(matchList, ref.key)
+		}
+	}
+	return matchList
+}
+
+// writeNotLoggedError answers a change that was applied but couldn't be written to the WAL,
+// returning false if err isn't ErrNotLogged. The change is live, but may not survive a restart.
+func (a *application) writeNotLoggedError(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, ErrNotLogged) {
+		return false
+	}
+	a.logger.Error(err.Error())
+	w.WriteHeader(500)
+	w.Write([]byte(`{"ok":false,"errors":["Change was applied but could not be written to the WAL"],"data":{}}`))
+	return true
+}
+
+// handleGetHeartbeat answers health checks. Replicas also report how far behind their primary
+// they are.
+func (a *application) handleGetHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if a.replica == nil {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"ok":true,"data":{"ping":"pong"}}`))
+		return
+	}
+
+	type responseData struct {
+		Ping        string            `json:"ping"`
+		Replication replicationStatus `json:"replication"`
+	}
+	type responseModel struct {
+		Ok   bool         `json:"ok"`
+		Data responseData `json:"data"`
+	}
+	res, err := json.Marshal(responseModel{
+		Ok: true,
+		Data: responseData{
+			Ping:        "pong",
+			Replication: a.replica.status(),
+		},
+	})
+	if err != nil {
+		a.logger.Error(err.Error())
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Internal server error"],"data":{}}`))
+		return
+	}
 	w.WriteHeader(200)
-	w.Write([]byte(`{"ok":true,"data":{"ping":"pong"}}`))
+	w.Write(res)
+}
+
+// primaryOnly rejects requests that would change the rule set when the server is a read-only
+// replica, since its rules come from the primary. Reads are passed through.
+func (a *application) primaryOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.replica != nil && r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"ok":false,"errors":["This server is a read-only replica; send changes to the primary"],"data":{}}`))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// leaderOnly rejects requests that would change the rule set when Raft is enabled and the server
+// isn't the leader, for changes that aren't forwarded to the leader. Reads are passed through.
+func (a *application) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.consensus != nil && !a.consensus.IsLeader() && r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(503)
+			w.Write([]byte(`{"ok":false,"errors":["This server is not the Raft leader; send changes to the leader"],"data":{}}`))
+			return
+		}
+		next(w, r)
+	}
 }
 
 func (a *application) handleHttpPostMatch(w http.ResponseWriter, r *http.Request) {
 
 	type responseModel struct {
-		Ok      bool      `json:"ok"`
-		Matches *[]string `json:"matches"`
+		Ok         bool      `json:"ok"`
+		Generation uint64    `json:"generation"`
+		Matches    *[]string `json:"matches"`
 	}
 
 	if r.Method != "POST" {
@@ -37,33 +123,44 @@ func (a *application) handleHttpPostMatch(w http.ResponseWriter, r *http.Request
 	}
 
 	if len(rule) == 0 {
-		a.logger.Warn(err.Error(),
-			zap.String("ip", r.RemoteAddr))
 		w.WriteHeader(400)
 		w.Write([]byte(`{"ok":false,"errors":["Problem reading request body"],"data":{}}`))
 		return
 	}
 
-	pq := <-a.pool.Pool
-	matches, err := pq.MatchesForEvent([]byte(rule))
-	a.pool.Pool <- pq
-	if err != nil {
-		a.logger.Warn(err.Error(),
-			zap.String("ip", r.RemoteAddr))
-		w.WriteHeader(500)
-		w.Write([]byte(`{"ok":false,"errors":["Problem matching pattern"],"data":{}}`))
-		return
+	g := a.currentGeneration()
+	var matchList []string
+	if a.shardedMatch(r) {
+		results, err := a.sharder.match(g, [][]byte{rule})
+		if err != nil {
+			a.logger.Warn(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+			w.WriteHeader(503)
+			w.Write([]byte(`{"ok":false,"errors":["Problem matching across shards"],"data":{}}`))
+			return
+		}
+		if !results[0].Ok {
+			a.logger.Warn(results[0].Error,
+				zap.String("ip", r.RemoteAddr))
+			w.WriteHeader(500)
+			w.Write([]byte(`{"ok":false,"errors":["Problem matching pattern"],"data":{}}`))
+			return
+		}
+		matchList = *results[0].Matches
+	} else {
+		matches, err := g.matchesForEvent(rule)
+		if err != nil {
+			a.logger.Warn(err.Error(),
+				zap.String("ip", r.RemoteAddr))
+			w.WriteHeader(500)
+			w.Write([]byte(`{"ok":false,"errors":["Problem matching pattern"],"data":{}}`))
+			return
+		}
+		matchList = matchedKeys(matches)
 	}
 	resp := responseModel{
-		Ok: true,
-	}
-
-	matchList := make([]string, 0)
-	for _, v := range matches {
-		s := v.(string)
-		if len(s) > 0 {
-			matchList = append(matchList, s)
-		}
+		Ok:         true,
+		Generation: g.gen,
 	}
 	resp.Matches = &matchList
 	val, err := json.Marshal(resp)
@@ -104,32 +201,38 @@ func (a *application) handleHttpPostAddRule(w http.ResponseWriter, r *http.Reque
 	}
 
 	if len(rule) == 0 {
-		a.logger.Warn(err.Error(),
-			zap.String("ip", r.RemoteAddr))
 		w.WriteHeader(400)
 		w.Write([]byte(`{"ok":false,"errors":["Problem reading request body"],"data":{}}`))
 		return
 	}
 
+	if err = checkEntrySize(key, string(rule)); err != nil {
+		w.WriteHeader(413)
+		w.Write([]byte(`{"ok":false,"errors":["Key or pattern too large"],"data":{}}`))
+		return
+	}
+
 	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
-	doneChan := make(chan bool)
-	errChan := make(chan error)
+	defer cancelFunc()
+	doneChan := make(chan uint64, 1)
+	errChan := make(chan error, 1)
 	go a.asyncAddRule(key, string(rule), doneChan, errChan)
 	select {
 	case <-timeoutCtx.Done():
 		w.WriteHeader(202)
 		w.Write([]byte(`{"ok":true,"errors":["Request timed out, submitted for processing"],"data":{}}`))
 		return
-	case <-doneChan:
+	case gen := <-doneChan:
 		w.WriteHeader(200)
-		w.Write([]byte(`{"ok":true,"data":{}`))
-		cancelFunc()
+		w.Write([]byte(`{"ok":true,"data":{"generation":` + strconv.FormatUint(gen, 10) + `}}`))
 		return
 	case err = <-errChan:
+		if a.writeForwardingError(w, err) || a.writeNotLoggedError(w, err) || a.writePartialCommitError(w, err) {
+			return
+		}
 		a.logger.Error(err.Error())
 		w.WriteHeader(500)
 		w.Write([]byte(`{"ok":false,"errors":["Problem adding pattern"],"data":{}}`))
-		cancelFunc()
 		return
 	}
 
@@ -151,26 +254,140 @@ func (a *application) handleHttpDeleteByKey(w http.ResponseWriter, r *http.Reque
 	key := qs.Get("key")
 
 	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+	defer cancelFunc()
 
-	doneChan := make(chan bool)
-	errChan := make(chan error)
+	doneChan := make(chan uint64, 1)
+	errChan := make(chan error, 1)
 	go a.asyncDeleteAllRulesFor(key, doneChan, errChan)
 	select {
 	case <-timeoutCtx.Done():
 		w.WriteHeader(202)
 		w.Write([]byte(`{"ok":true,"errors":["Request timed out, submitted for processing"],"data":{}}`))
 		return
-	case <-doneChan:
+	case gen := <-doneChan:
 		w.WriteHeader(200)
-		w.Write([]byte(`{"ok":true,"data":{}`))
-		cancelFunc()
+		w.Write([]byte(`{"ok":true,"data":{"generation":` + strconv.FormatUint(gen, 10) + `}}`))
 		return
 	case err := <-errChan:
+		if a.writeForwardingError(w, err) || a.writeNotLoggedError(w, err) || a.writePartialCommitError(w, err) {
+			return
+		}
 		a.logger.Error(err.Error(),
 			zap.String("ip", r.RemoteAddr))
 		w.WriteHeader(500)
 		w.Write([]byte(`{"ok":false,"errors":["Problem deleting pattern"],"data":{}}`))
-		cancelFunc()
 		return
 	}
 }
+
+func (a *application) handleHttpDeletePattern(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (DELETE only)"],"data":{}}`))
+		return
+	}
+
+	qs := r.URL.Query()
+	if !qs.Has("key") {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Missing 'key' in query string'"], "data":{}}`))
+		return
+	}
+	key := qs.Get("key")
+
+	rule, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.logger.Warn(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Problem reading request body"],"data":{}}`))
+		return
+	}
+
+	if len(rule) <= 1 {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Missing pattern in request body"],"data":{}}`))
+		return
+	}
+
+	if err = checkEntrySize(key, string(rule)); err != nil {
+		w.WriteHeader(413)
+		w.Write([]byte(`{"ok":false,"errors":["Key or pattern too large"],"data":{}}`))
+		return
+	}
+
+	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+	defer cancelFunc()
+
+	doneChan := make(chan uint64, 1)
+	errChan := make(chan error, 1)
+	go a.asyncDeleteMatchingRulesFor(key, string(rule), doneChan, errChan)
+	select {
+	case <-timeoutCtx.Done():
+		w.WriteHeader(202)
+		w.Write([]byte(`{"ok":true,"errors":["Request timed out, submitted for processing"],"data":{}}`))
+		return
+	case gen := <-doneChan:
+		w.WriteHeader(200)
+		w.Write([]byte(`{"ok":true,"data":{"generation":` + strconv.FormatUint(gen, 10) + `}}`))
+		return
+	case err := <-errChan:
+		if errors.Is(err, ErrPatternNotFound) {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"ok":false,"errors":["Pattern not found for key"],"data":{}}`))
+			return
+		}
+		if a.writeNotLoggedError(w, err) || a.writePartialCommitError(w, err) {
+			return
+		}
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem deleting pattern"],"data":{}}`))
+		return
+	}
+}
+
+// handleHttpPostSnapshot writes a snapshot of the current keys and patterns, returning the
+// snapshot file and the timestamp of the last change it includes.
+func (a *application) handleHttpPostSnapshot(w http.ResponseWriter, r *http.Request) {
+	type responseData struct {
+		File      string `json:"file"`
+		Timestamp uint64 `json:"timestamp"`
+	}
+	type responseModel struct {
+		Ok   bool         `json:"ok"`
+		Data responseData `json:"data"`
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (POST only)"],"data":{}}`))
+		return
+	}
+
+	fileName, ts, err := a.writeSnapshot()
+	if err == ErrSnapshotsDisabled {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Snapshots are not configured (set --snapshotDir)"],"data":{}}`))
+		return
+	}
+	if err != nil {
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem writing snapshot"],"data":{}}`))
+		return
+	}
+
+	val, err := json.Marshal(responseModel{Ok: true, Data: responseData{File: fileName, Timestamp: ts}})
+	if err != nil {
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem returning results"],"data":{}}`))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(val)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postRule adds a pattern to a key through the admin handler, returning the status code.
+func postRule(t *testing.T, a *application, key, body string) int {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/admin/v1/add?key="+key, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	a.handleHttpPostAddRule(w, req)
+	return w.Code
+}
+
+func TestAddRule(t *testing.T) {
+	a := newTestApplication(t)
+	if code := postRule(t, a, "first-test-key", `{"sys":["filestore"]}`); code != 200 {
+		t.Fatalf("Expected 200 adding a pattern, got %d", code)
+	}
+	if keys := matchKeys(t, a.currentGeneration(), `{"sys":"filestore"}`); len(keys) != 1 || keys[0] != "first-test-key" {
+		t.Errorf("Expected the added pattern to match first-test-key, got %v", keys)
+	}
+
+	gen := a.currentGeneration().gen
+	if code := postRule(t, a, "first-test-key", ""); code != 400 {
+		t.Errorf("Expected 400 for an empty body, got %d", code)
+	}
+	if g := a.currentGeneration(); g.gen != gen {
+		t.Errorf("Expected generation %d to still be current after an empty body, got %d", gen, g.gen)
+	}
+}
+
+func TestDeletePattern(t *testing.T) {
+	a := newTestApplication(t)
+	postRule(t, a, "first-test-key", `{"sys":["filestore"]}`)
+	postRule(t, a, "first-test-key", `{"evt":["file-created"]}`)
+
+	deletePattern := func(body string) int {
+		req := httptest.NewRequest("DELETE", "/api/admin/v1/delete-pattern?key=first-test-key", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		a.handleHttpDeletePattern(w, req)
+		return w.Code
+	}
+
+	// The pattern is matched whatever its formatting.
+	if code := deletePattern(`{ "sys": [ "filestore" ] }`); code != 200 {
+		t.Fatalf("Expected 200 deleting a pattern, got %d", code)
+	}
+	if pats := a.currentGeneration().registry.Patterns("first-test-key"); len(pats) != 1 {
+		t.Errorf("Expected 1 pattern left, got %v", pats)
+	}
+	if keys := matchKeys(t, a.currentGeneration(), `{"sys":"filestore"}`); len(keys) != 0 {
+		t.Errorf("Expected the deleted pattern not to match, got %v", keys)
+	}
+	if code := deletePattern(`{"sys":["filestore"]}`); code != 404 {
+		t.Errorf("Expected 404 deleting a pattern the key doesn't have, got %d", code)
+	}
+	if code := deletePattern(""); code != 400 {
+		t.Errorf("Expected 400 for a missing pattern, got %d", code)
+	}
+}
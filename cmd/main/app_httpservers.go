@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 )
 
 func (a *application) newServers() error {
@@ -11,21 +15,73 @@ func (a *application) newServers() error {
 	adminMux := http.NewServeMux()
 	//	clusterMux := http.NewServeMux()
 
-	matchMux.HandleFunc("/api/v1/heartbeat", handleGetHeartbeat)
+	matchMux.HandleFunc("/api/v1/heartbeat", a.handleGetHeartbeat)
 	matchMux.HandleFunc("/api/v1/match", a.handleHttpPostMatch)
+	matchMux.HandleFunc("/api/v1/match/batch", a.handleHttpPostMatchBatch)
 
-	adminMux.HandleFunc("/api/admin/v1/add", a.handleHttpPostAddRule)
-	adminMux.HandleFunc("/api/admin/v1/delete-by-key", a.handleHttpDeleteByKey)
+	adminMux.HandleFunc("/api/admin/v1/add", a.primaryOnly(a.handleHttpPostAddRule))
+	adminMux.HandleFunc("/api/admin/v1/delete-by-key", a.primaryOnly(a.handleHttpDeleteByKey))
+	adminMux.HandleFunc("/api/admin/v1/delete-pattern", a.primaryOnly(a.leaderOnly(a.handleHttpDeletePattern)))
+	adminMux.HandleFunc("/api/admin/v1/keys", a.handleHttpGetKeys)
+	adminMux.HandleFunc("/api/admin/v1/key", a.primaryOnly(a.leaderOnly(a.handleHttpKey)))
+	adminMux.HandleFunc("/api/admin/v1/import", a.primaryOnly(a.leaderOnly(a.handleHttpPostImport)))
+	adminMux.HandleFunc("/api/admin/v1/export", a.handleHttpGetExport)
+	adminMux.HandleFunc("/api/admin/v1/snapshot", a.handleHttpPostSnapshot)
+	adminMux.HandleFunc("/api/admin/v1/cluster/members", a.handleHttpGetClusterMembers)
 
 	a.apiServer = newServer(":"+strconv.Itoa(a.config.matchServer.port), matchMux)
 	a.adminServer = newServer(":"+strconv.Itoa(a.config.adminServer.port), adminMux)
 	return nil
 }
 
+// startServer starts the match, admin and WAL servers. The returned channel is closed when the
+// process is asked to stop (by SIGINT or SIGTERM), at which point the servers should be shut down
+// with stopServers.
 func (a *application) startServer() (chan struct{}, error) {
 	a.chShutdown = make(chan struct{})
 	a.serverWg = new(sync.WaitGroup)
+	a.serverWg.Add(2)
 	go runServerAsync(a.config.matchServer, a.serverWg, a.apiServer, a.logger)
 	go runServerAsync(a.config.adminServer, a.serverWg, a.adminServer, a.logger)
+	if err := a.runWalServerAsync(); err != nil {
+		return a.chShutdown, err
+	}
+	if a.replica != nil {
+		go a.replica.run()
+	}
+	if err := a.startCluster(); err != nil {
+		return a.chShutdown, err
+	}
+
+	chSignal := make(chan os.Signal, 1)
+	signal.Notify(chSignal, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-chSignal
+		a.logger.Info("Received " + sig.String())
+		signal.Stop(chSignal)
+		close(a.chShutdown)
+	}()
 	return a.chShutdown, nil
 }
+
+// stopServers stops accepting new requests and gives in-flight ones until ctx is done to finish.
+// WAL streams are cut off at that point, since followers may hold them open indefinitely.
+func (a *application) stopServers(ctx context.Context) {
+	if err := a.apiServer.Shutdown(ctx); err != nil {
+		a.logger.Error("Match server shutdown: " + err.Error())
+	}
+	if err := a.adminServer.Shutdown(ctx); err != nil {
+		a.logger.Error("Admin server shutdown: " + err.Error())
+	}
+	stopped := make(chan struct{})
+	go func() {
+		a.walServer.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		a.walServer.server.Stop()
+	}
+	a.serverWg.Wait()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultKeysPageSize = 100
+	maxKeysPageSize     = 1000
+)
+
+// handleHttpGetKeys lists the keys in the registry, in sorted order. Results can be filtered with
+// 'prefix' and paged through by passing the 'next' value from one response as 'after' in the next
+// request.
+func (a *application) handleHttpGetKeys(w http.ResponseWriter, r *http.Request) {
+
+	type responseData struct {
+		Keys []string `json:"keys"`
+		Next string   `json:"next,omitempty"`
+	}
+	type responseModel struct {
+		Ok   bool         `json:"ok"`
+		Data responseData `json:"data"`
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (GET only)"],"data":{}}`))
+		return
+	}
+
+	qs := r.URL.Query()
+	limit := defaultKeysPageSize
+	if qs.Has("limit") {
+		l, err := strconv.Atoi(qs.Get("limit"))
+		if err != nil || l < 1 || l > maxKeysPageSize {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"ok":false,"errors":["'limit' must be between 1 and ` + strconv.Itoa(maxKeysPageSize) + `"],"data":{}}`))
+			return
+		}
+		limit = l
+	}
+
+	keys, more := a.currentGeneration().registry.Keys(qs.Get("prefix"), qs.Get("after"), limit)
+	resp := responseModel{
+		Ok: true,
+		Data: responseData{
+			Keys: keys,
+		},
+	}
+	if more {
+		resp.Data.Next = keys[len(keys)-1]
+	}
+	val, err := json.Marshal(resp)
+	if err != nil {
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem returning results"],"data":{}}`))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(val)
+}
+
+// handleHttpKey handles requests for a single key: GET returns the key's patterns, HEAD checks
+// whether the key exists, and PUT replaces the key's patterns.
+func (a *application) handleHttpKey(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.handleHttpGetKey(w, r)
+	case "HEAD":
+		a.handleHttpHeadKey(w, r)
+	case "PUT":
+		a.handleHttpPutKey(w, r)
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Incorrect method (GET, HEAD or PUT only)"],"data":{}}`))
+	}
+}
+
+func (a *application) handleHttpGetKey(w http.ResponseWriter, r *http.Request) {
+
+	type responseData struct {
+		Key      string            `json:"key"`
+		Patterns []json.RawMessage `json:"patterns"`
+	}
+	type responseModel struct {
+		Ok   bool         `json:"ok"`
+		Data responseData `json:"data"`
+	}
+
+	qs := r.URL.Query()
+	if !qs.Has("key") {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Missing 'key' in query string'"], "data":{}}`))
+		return
+	}
+	key := qs.Get("key")
+
+	pats := a.currentGeneration().registry.Patterns(key)
+	if len(pats) == 0 {
+		w.WriteHeader(404)
+		w.Write([]byte(`{"ok":false,"errors":["Key not found"],"data":{}}`))
+		return
+	}
+
+	resp := responseModel{
+		Ok: true,
+		Data: responseData{
+			Key:      key,
+			Patterns: make([]json.RawMessage, 0, len(pats)),
+		},
+	}
+	for _, p := range pats {
+		resp.Data.Patterns = append(resp.Data.Patterns, json.RawMessage(p))
+	}
+	val, err := json.Marshal(resp)
+	if err != nil {
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem returning results"],"data":{}}`))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(val)
+}
+
+func (a *application) handleHttpHeadKey(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if !qs.Has("key") {
+		w.WriteHeader(400)
+		return
+	}
+	if !a.hasKey(qs.Get("key")) {
+		w.WriteHeader(404)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// handleHttpPutKey replaces every pattern for a key with the JSON array of patterns in the
+// request body. An empty array removes the key.
+func (a *application) handleHttpPutKey(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if !qs.Has("key") {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Missing 'key' in query string'"], "data":{}}`))
+		return
+	}
+	key := qs.Get("key")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.logger.Warn(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Problem reading request body"],"data":{}}`))
+		return
+	}
+
+	var raw []json.RawMessage
+	if err = json.Unmarshal(body, &raw); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Request body must be a JSON array of patterns"],"data":{}}`))
+		return
+	}
+	patterns := make([]string, 0, len(raw))
+	for _, p := range raw {
+		patterns = append(patterns, string(p))
+	}
+	if err = validatePatterns(patterns); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Invalid pattern in request body"],"data":{}}`))
+		return
+	}
+
+	// The patterns are logged as a single JSON array, so it's the array that has to fit.
+	payload, err := encodePatterns(patterns)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"ok":false,"errors":["Invalid pattern in request body"],"data":{}}`))
+		return
+	}
+	if err = checkEntrySize(key, payload); err != nil {
+		w.WriteHeader(413)
+		w.Write([]byte(`{"ok":false,"errors":["Key or patterns too large"],"data":{}}`))
+		return
+	}
+
+	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), (30 * time.Second))
+	defer cancelFunc()
+
+	doneChan := make(chan uint64, 1)
+	errChan := make(chan error, 1)
+	go a.asyncReplaceRulesFor(key, patterns, doneChan, errChan)
+	select {
+	case <-timeoutCtx.Done():
+		w.WriteHeader(202)
+		w.Write([]byte(`{"ok":true,"errors":["Request timed out, submitted for processing"],"data":{}}`))
+		return
+	case gen := <-doneChan:
+		w.WriteHeader(200)
+		w.Write([]byte(`{"ok":true,"data":{"generation":` + strconv.FormatUint(gen, 10) + `}}`))
+		return
+	case err = <-errChan:
+		if a.writeNotLoggedError(w, err) || a.writePartialCommitError(w, err) {
+			return
+		}
+		a.logger.Error(err.Error(),
+			zap.String("ip", r.RemoteAddr))
+		w.WriteHeader(500)
+		w.Write([]byte(`{"ok":false,"errors":["Problem replacing patterns"],"data":{}}`))
+		return
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// putKey replaces a key's patterns through the admin handler, failing the test on anything but a 200.
+func putKey(t *testing.T, a *application, key, body string) {
+	t.Helper()
+	req := httptest.NewRequest("PUT", "/api/admin/v1/key?key="+key, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	a.handleHttpKey(w, req)
+	if w.Code != 200 {
+		t.Fatalf("PUT key returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPutKeyReplacesAtomically(t *testing.T) {
+	a := newTestApplication(t)
+	oldSet := `[{"sys":["filestore"]},{"evt":["file-created"]}]`
+	newSet := `[{"sys":["authnz"]},{"evt":["user-login"]}]`
+	putKey(t, a, "first-test-key", oldSet)
+
+	// Every generation must have either the old patterns or the new ones: never both, never neither.
+	var stop, partial int32
+	var wg sync.WaitGroup
+	for x := 0; x < 4; x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				g := a.currentGeneration()
+				oldMatches, err1 := g.matchesForEvent([]byte(`{"sys":"filestore","evt":"file-created"}`))
+				newMatches, err2 := g.matchesForEvent([]byte(`{"sys":"authnz","evt":"user-login"}`))
+				matchedOld, matchedNew := len(matchedKeys(oldMatches)) == 1, len(matchedKeys(newMatches)) == 1
+				if err1 != nil || err2 != nil || matchedOld == matchedNew || len(g.registry.Patterns("first-test-key")) != 2 {
+					atomic.StoreInt32(&partial, 1)
+				}
+			}
+		}()
+	}
+	for x := 0; x < 50; x++ {
+		if x%2 == 0 {
+			putKey(t, a, "first-test-key", newSet)
+		} else {
+			putKey(t, a, "first-test-key", oldSet)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	if atomic.LoadInt32(&partial) != 0 {
+		t.Error("A reader saw a partially replaced key")
+	}
+
+	// Replacing with patterns the key already has mustn't pile them up.
+	putKey(t, a, "first-test-key", `[{"sys":["authnz"]},{ "evt": ["user-login"] }]`)
+	if ct := len(a.currentGeneration().registry.Patterns("first-test-key")); ct != 2 {
+		t.Errorf("Expected 2 patterns after replacing with the same set, got %d", ct)
+	}
+}
+
+func TestPutKeyRejectsInvalidPattern(t *testing.T) {
+	a := newTestApplication(t)
+	putKey(t, a, "first-test-key", `[{"sys":["filestore"]}]`)
+	gen := a.currentGeneration().gen
+
+	req := httptest.NewRequest("PUT", "/api/admin/v1/key?key=first-test-key", strings.NewReader(`[{"sys":["authnz"]},{"sys":"not-a-list"}]`))
+	w := httptest.NewRecorder()
+	a.handleHttpKey(w, req)
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for an invalid pattern, got %d", w.Code)
+	}
+	g := a.currentGeneration()
+	if g.gen != gen {
+		t.Errorf("Expected generation %d to still be current, got %d", gen, g.gen)
+	}
+	if pats := g.registry.Patterns("first-test-key"); len(pats) != 1 || pats[0] != `{"sys":["filestore"]}` {
+		t.Errorf("Unexpected patterns after a rejected replace: %v", pats)
+	}
+}
@@ -1,12 +1,265 @@
 package main
 
-import "quamina.net/go/quamina"
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/wal"
+	"math"
+	"quamina.net/go/quamina"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minDeadPatterns is how many deleted patterns the shared automaton has to hold, as well as
+// outnumbering the live ones, before it is rebuilt.
+const minDeadPatterns = 1024
+
+// matcherGeneration is a versioned snapshot of the registry of patterns, along with a matcher
+// holding at least those patterns. Generations are never changed once they have been published:
+// writers build the next generation privately and swap it in atomically, while readers use
+// whichever generation is current without waiting on writers, and keep seeing it unchanged for as
+// long as they hold it.
+type matcherGeneration struct {
+	gen      uint64
+	matcher  *quamina.Quamina
+	registry *registry.Registry
+	readers  sync.Pool
+}
+
+func newMatcherGeneration(gen uint64, m *quamina.Quamina, r *registry.Registry) *matcherGeneration {
+	g := &matcherGeneration{
+		gen:      gen,
+		matcher:  m,
+		registry: r,
+	}
+	// A Quamina instance must not be used for matching on more than one goroutine at a time,
+	// so each reader borrows its own copy of the generation's matcher.
+	g.readers.New = func() any {
+		return m.Copy()
+	}
+	return g
+}
+
+// matchesForEvent matches an event against this generation. The matcher is shared with other
+// generations, so only matches for patterns in this generation's registry are returned.
+func (g *matcherGeneration) matchesForEvent(event []byte) ([]quamina.X, error) {
+	m := g.readers.Get().(*quamina.Quamina)
+	defer g.readers.Put(m)
+	matches, err := m.MatchesForEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	live := make([]quamina.X, 0, len(matches))
+	for _, x := range matches {
+		if ref := x.(patternRef); g.registry.HasCanonical(ref.key, ref.pattern) {
+			live = append(live, x)
+		}
+	}
+	return live, nil
+}
+
+// patternIndex is the Quamina automaton that successive generations share, and the patterns it
+// holds. Patterns can be added to an automaton while it is being matched against, but not taken
+// away, so a deleted pattern stays in it and each generation filters matches against its own
+// registry; that also keeps patterns added for a later generation out of earlier ones. Each
+// change costs only the patterns it touches, rather than rebuilding every pattern. It is only
+// used by writers, under writeMu.
+type patternIndex struct {
+	matcher *quamina.Quamina
+	refs    map[patternRef]bool // whether each pattern in the automaton is in the latest registry
+	dead    int
+}
+
+// newPatternIndex builds an automaton holding every pattern in a registry.
+func newPatternIndex(r *registry.Registry) (*patternIndex, error) {
+	m, err := quamina.New()
+	if err != nil {
+		return nil, err
+	}
+	ix := &patternIndex{
+		matcher: m,
+		refs:    make(map[patternRef]bool),
+	}
+	for key, patterns := range r.Snapshot() {
+		for _, p := range patterns {
+			ref := newPatternRef(key, p)
+			if err = m.AddPattern(ref, ref.pattern); err != nil {
+				return nil, fmt.Errorf("key %s: %w", key, err)
+			}
+			ix.refs[ref] = true
+		}
+	}
+	return ix, nil
+}
+
+// update brings the automaton up to date with next, a clone of prev that has since been changed,
+// adding the patterns next has that the automaton doesn't and counting those it dropped as dead.
+func (ix *patternIndex) update(prev, next *registry.Registry) error {
+	for _, key := range next.Changed() {
+		live := make(map[patternRef]bool)
+		for _, p := range next.Patterns(key) {
+			live[newPatternRef(key, p)] = true
+		}
+		for _, p := range prev.Patterns(key) {
+			if ref := newPatternRef(key, p); !live[ref] && ix.refs[ref] {
+				ix.refs[ref] = false
+				ix.dead++
+			}
+		}
+		for ref := range live {
+			inLatest, ok := ix.refs[ref]
+			switch {
+			case !ok:
+				if err := ix.matcher.AddPattern(ref, ref.pattern); err != nil {
+					return fmt.Errorf("key %s: %w", key, err)
+				}
+				ix.refs[ref] = true
+			case !inLatest:
+				ix.refs[ref] = true
+				ix.dead--
+			}
+		}
+	}
+	return nil
+}
+
+// nextMatcher returns a matcher for next, a clone of prev that has since been changed. The shared
+// automaton is updated with the changes, unless deleted patterns have come to outnumber the live
+// ones, in which case a fresh one is built; earlier generations keep the automaton they had.
+func (a *application) nextMatcher(prev, next *registry.Registry) (*quamina.Quamina, error) {
+	if err := a.patterns.update(prev, next); err != nil {
+		return nil, err
+	}
+	if ix := a.patterns; ix.dead >= minDeadPatterns && ix.dead > len(ix.refs)-ix.dead {
+		fresh, err := newPatternIndex(next)
+		if err != nil {
+			return nil, err
+		}
+		a.patterns = fresh
+	}
+	return a.patterns.matcher, nil
+}
 
 func (a *application) newMatcher() error {
-	m, err := quamina.New(quamina.WithPatternDeletion(true))
+	r := registry.New()
+	ix, err := newPatternIndex(r)
 	if err != nil {
 		return err
 	}
-	a.matcher = m
+	g := newMatcherGeneration(0, ix.matcher, r)
+	a.generation = &atomic.Value{}
+	a.generation.Store(g)
+	a.latest = g
+	a.patterns = ix
 	return nil
 }
+
+// currentGeneration returns the most recently published matcher generation.
+func (a *application) currentGeneration() *matcherGeneration {
+	return a.generation.Load().(*matcherGeneration)
+}
+
+// publish makes a generation current, unless a later one already is. Generations can finish
+// waiting on the WAL out of order, but a later generation always includes every earlier change.
+func (a *application) publish(g *matcherGeneration) {
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+	if g.gen > a.currentGeneration().gen {
+		a.generation.Store(g)
+	}
+}
+
+// mutate builds the next generation by applying fn to a copy of the latest generation's
+// registry and adding the patterns it changed to the matcher, then publishes it. Writers are serialized;
+// readers are never blocked. If fn fails, the copy is thrown away, nothing is published and the
+// latest generation number is returned with the error.
+func (a *application) mutate(fn func(r *registry.Registry) error) (uint64, error) {
+	return a.mutateAndLog(nil, fn)
+}
+
+// mutateAndLog is mutate for changes that are written to the WAL. The entries are stamped and
+// queued while the write lock is still held, so they reach the log in the same order as the
+// generations they produced, with increasing timestamps. The new generation is only published
+// once the entries are as durable as the fsync policy requires, so a reader never sees a change
+// that could be lost in a crash. The write lock isn't held while waiting: the next writer builds
+// on the new generation, and their entries are synced together.
+//
+// If the entries can't be written, the new generation is published anyway (later generations may
+// already have been built on it) and an error wrapping ErrNotLogged is returned along with it.
+//
+// Entries that already carry timestamps (because another node logged them first) keep them, so
+// long as none of the changes applied so far is later; if one is, ErrStaleEntry is returned and
+// nothing is applied. Several entries can share a timestamp, so a batch may start with the
+// timestamp the last one ended with. Local entries are stamped after the last applied change even
+// if the clock is behind it; if that would run past the largest timestamp, ErrTimestampsExhausted
+// is returned and nothing is applied.
+func (a *application) mutateAndLog(entries []wal.WalEntry, fn func(r *registry.Registry) error) (uint64, error) {
+	g, durable, err := a.mutateAndSubmit(entries, fn)
+	if err != nil {
+		return g.gen, err
+	}
+	if durable != nil {
+		err = <-durable
+	}
+	a.publish(g)
+	if err != nil && len(entries) > 0 {
+		return g.gen, fmt.Errorf("%w: %s", ErrNotLogged, err.Error())
+	}
+	return g.gen, nil
+}
+
+// mutateAndSubmit builds the next generation like mutateAndLog and queues its entries for the WAL,
+// but leaves it to the caller to publish the generation, returning it along with a channel that
+// receives the outcome of the write (which is nil if nothing was written). If fn fails, the latest
+// generation is returned with the error.
+func (a *application) mutateAndSubmit(entries []wal.WalEntry, fn func(r *registry.Registry) error) (*matcherGeneration, <-chan error, error) {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	prev := a.latest
+	stamped := len(entries) > 0 && entries[0].Timestamp != 0
+	if stamped && entries[0].Timestamp < a.lastUpdatedOn {
+		return prev, nil, ErrStaleEntry
+	}
+	if len(entries) > 0 && !stamped && a.lastUpdatedOn > math.MaxUint64-uint64(len(entries)) {
+		return prev, nil, ErrTimestampsExhausted
+	}
+	reg := prev.registry.Clone()
+	if err := fn(reg); err != nil {
+		return prev, nil, err
+	}
+	next, err := a.nextMatcher(prev.registry, reg)
+	if err != nil {
+		return prev, nil, err
+	}
+	if len(entries) > 0 && !stamped {
+		ts := uint64(time.Now().UnixNano())
+		if ts <= a.lastUpdatedOn {
+			ts = a.lastUpdatedOn + 1
+		}
+		for x := range entries {
+			entries[x].Timestamp = ts + uint64(x)
+		}
+	}
+	if len(entries) > 0 {
+		a.lastUpdatedOn = entries[len(entries)-1].Timestamp
+	}
+	var durable <-chan error
+	// A change that isn't logged still has to wait for the changes before it to be durable, as
+	// its generation includes them; an empty write is acknowledged once they are.
+	if a.config.writeWalFiles && (len(entries) > 0 || prev != a.currentGeneration()) {
+		durable = a.walFileMgr.submit(entries)
+	}
+	g := newMatcherGeneration(prev.gen+1, next, reg)
+	a.latest = g
+	return g, durable, nil
+}
+
+// newWalEntry builds an unstamped WAL entry; mutateAndLog fills in the timestamp.
+func newWalEntry(action uint16, key, pattern string) wal.WalEntry {
+	return wal.WalEntry{
+		Key:     []byte(key),
+		Pattern: []byte(pattern),
+		Action:  action,
+	}
+}
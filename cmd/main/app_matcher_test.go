@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"sort"
+	"testing"
+)
+
+// newTestApplication creates an application with an empty matcher and no servers, WAL or
+// cluster, for tests that drive the matcher and handlers directly.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	a := &application{
+		config:  &appConfig{},
+		logger:  zap.NewNop(),
+		cluster: newClusterState(),
+	}
+	if err := a.newMatcher(); err != nil {
+		t.Fatal("newMatcher: " + err.Error())
+	}
+	return a
+}
+
+// matchKeys matches an event against a generation, returning the sorted keys that matched.
+func matchKeys(t *testing.T, g *matcherGeneration, event string) []string {
+	t.Helper()
+	matches, err := g.matchesForEvent([]byte(event))
+	if err != nil {
+		t.Fatal("matchesForEvent: " + err.Error())
+	}
+	keys := matchedKeys(matches)
+	sort.Strings(keys)
+	return keys
+}
+
+func TestGenerationIsolation(t *testing.T) {
+	a := newTestApplication(t)
+	event := `{"sys":"filestore","evt":"file-created"}`
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+
+	held := a.currentGeneration()
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "second-test-key", `{"evt":["file-created"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	if keys := matchKeys(t, held, event); len(keys) != 1 || keys[0] != "first-test-key" {
+		t.Errorf("Held generation saw a later add: %v", keys)
+	}
+	if keys := matchKeys(t, a.currentGeneration(), event); len(keys) != 2 {
+		t.Errorf("Expected the current generation to match both keys, got %v", keys)
+	}
+
+	afterAdd := a.currentGeneration()
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_DEL, "first-test-key", "-")}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	if keys := matchKeys(t, afterAdd, event); len(keys) != 2 {
+		t.Errorf("Held generation saw a later delete: %v", keys)
+	}
+	if !afterAdd.registry.HasKey("first-test-key") {
+		t.Error("Held generation's registry saw a later delete")
+	}
+	if keys := matchKeys(t, a.currentGeneration(), event); len(keys) != 1 || keys[0] != "second-test-key" {
+		t.Errorf("Expected the current generation to match only second-test-key, got %v", keys)
+	}
+}
+
+func TestFailedMutationIsNotPublished(t *testing.T) {
+	a := newTestApplication(t)
+	event := `{"sys":"filestore"}`
+	gen, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)})
+	if err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+
+	_, err = a.mutate(func(r *registry.Registry) error {
+		if err := a.applyEntry(r, wal.WAL_DEL, "first-test-key", "-"); err != nil {
+			return err
+		}
+		return a.applyEntry(r, wal.WAL_ADD, "second-test-key", `{"sys":"not-a-list"}`)
+	})
+	if err == nil {
+		t.Fatal("Expected an invalid pattern to fail the mutation")
+	}
+	g := a.currentGeneration()
+	if g.gen != gen {
+		t.Errorf("Expected generation %d to still be current, got %d", gen, g.gen)
+	}
+	if keys := matchKeys(t, g, event); len(keys) != 1 || keys[0] != "first-test-key" {
+		t.Errorf("Failed mutation changed the matcher: %v", keys)
+	}
+	if !g.registry.HasKey("first-test-key") || g.registry.HasKey("second-test-key") {
+		t.Error("Failed mutation changed the registry")
+	}
+}
+
+func TestDeletedPatternsAreRebuiltAway(t *testing.T) {
+	a := newTestApplication(t)
+	event := `{"sys":"filestore"}`
+	add := func(key string) {
+		t.Helper()
+		if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, key, `{"sys":["filestore"]}`)}); err != nil {
+			t.Fatal("commitEntries: " + err.Error())
+		}
+	}
+	del := func(key string) {
+		t.Helper()
+		if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_DEL, key, `{"sys":["filestore"]}`)}); err != nil {
+			t.Fatal("commitEntries: " + err.Error())
+		}
+	}
+
+	// A deleted pattern stays in the shared automaton, but only generations that have it match it,
+	// and adding it back doesn't add it twice.
+	add("first-test-key")
+	held := a.currentGeneration()
+	del("first-test-key")
+	if keys := matchKeys(t, a.currentGeneration(), event); len(keys) != 0 {
+		t.Errorf("Expected the deleted pattern not to match, got %v", keys)
+	}
+	if keys := matchKeys(t, held, event); len(keys) != 1 {
+		t.Errorf("Expected the held generation to still match the deleted pattern, got %v", keys)
+	}
+	add("first-test-key")
+	if len(a.patterns.refs) != 1 || a.patterns.dead != 0 {
+		t.Errorf("Expected 1 live pattern in the automaton, got %d with %d dead", len(a.patterns.refs), a.patterns.dead)
+	}
+
+	// Once deleted patterns outnumber live ones, the automaton is rebuilt without them.
+	first := a.patterns
+	for x := 0; x < minDeadPatterns; x++ {
+		add(fmt.Sprintf("key-%04d", x))
+	}
+	for x := 0; x < minDeadPatterns; x++ {
+		del(fmt.Sprintf("key-%04d", x))
+	}
+	if a.patterns == first {
+		t.Fatal("Expected the automaton to be rebuilt")
+	}
+	if len(a.patterns.refs) != 1 || a.patterns.dead != 0 {
+		t.Errorf("Expected only the live pattern in the rebuilt automaton, got %d with %d dead", len(a.patterns.refs), a.patterns.dead)
+	}
+	if keys := matchKeys(t, a.currentGeneration(), event); len(keys) != 1 || keys[0] != "first-test-key" {
+		t.Errorf("Expected only first-test-key to match after the rebuild, got %v", keys)
+	}
+	if keys := matchKeys(t, held, event); len(keys) != 1 {
+		t.Errorf("Expected the held generation to keep its automaton, got %v", keys)
+	}
+}
+
+// BenchmarkMutate measures a single add against a rule set that already holds many patterns. Only
+// the patterns a change touches are added to the matcher, so this shouldn't grow with the
+// number of patterns loaded.
+func BenchmarkMutate(b *testing.B) {
+	for _, loaded := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("%d patterns", loaded), func(b *testing.B) {
+			a := &application{config: &appConfig{}, logger: zap.NewNop()}
+			if err := a.newMatcher(); err != nil {
+				b.Fatal("newMatcher: " + err.Error())
+			}
+			_, err := a.mutate(func(r *registry.Registry) error {
+				for x := 0; x < loaded; x++ {
+					r.Add(fmt.Sprintf("loaded-%06d", x), fmt.Sprintf(`{"sys":["filestore-%d"]}`, x))
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal("mutate: " + err.Error())
+			}
+			b.ResetTimer()
+			for x := 0; x < b.N; x++ {
+				key, pattern := fmt.Sprintf("key-%06d", x), fmt.Sprintf(`{"evt":["created-%d"]}`, x)
+				if _, err = a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, key, pattern)}); err != nil {
+					b.Fatal("commitEntries: " + err.Error())
+				}
+			}
+		})
+	}
+}
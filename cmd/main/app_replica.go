@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/wal"
+	"google.golang.org/grpc"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxReplicaBatch is the most entries from the primary that are applied in a single generation.
+	maxReplicaBatch      = 256
+	minReplicaRetryDelay = 500 * time.Millisecond
+	maxReplicaRetryDelay = 30 * time.Second
+)
+
+var ErrReadOnlyReplica = errors.New("This server is a read-only replica")
+
+// replica follows a primary's WAL stream and applies its entries locally. It starts from the
+// newest change already loaded from local snapshots and WAL files, so a replica that keeps its own
+// WAL picks up where it left off; one that doesn't replays the primary's whole history.
+//
+// Several entries can share a timestamp (a restored WAL file stamps every entry with the same
+// one, for instance), so the stream is resumed at the timestamp of the last entry applied rather
+// than the one after it, and the entries with that timestamp that have already been applied are
+// skipped. The primary sends them again in the same order. At startup it isn't known how many of
+// them were applied, so they are all applied again; each one sets a pattern's presence outright,
+// so applying them twice has the same effect as applying them once.
+type replica struct {
+	app            *application
+	primary        string
+	connected      int32  // accessed atomically
+	lastApplied    uint64 // accessed atomically
+	lagNs          int64  // accessed atomically
+	disconnectedAt int64  // accessed atomically
+	appliedAtLast  int    // entries applied with the lastApplied timestamp
+	skip           int    // entries at lastApplied the current stream will send again
+}
+
+// replicationStatus is reported in the heartbeat response.
+type replicationStatus struct {
+	Primary              string `json:"primary"`
+	Connected            bool   `json:"connected"`
+	LastAppliedTimestamp uint64 `json:"lastAppliedTimestamp"`
+	LagMs                int64  `json:"lagMs"`
+	DisconnectedForMs    int64  `json:"disconnectedForMs,omitempty"`
+}
+
+func newReplica(app *application, primary string) *replica {
+	return &replica{
+		app:            app,
+		primary:        primary,
+		lastApplied:    app.lastUpdatedOn,
+		disconnectedAt: time.Now().UnixNano(),
+	}
+}
+
+// status reports how far behind the primary the replica is. The lag is how long before being
+// applied here the most recently applied entry was committed on the primary, which assumes the
+// two clocks agree.
+func (rep *replica) status() replicationStatus {
+	s := replicationStatus{
+		Primary:              rep.primary,
+		Connected:            atomic.LoadInt32(&rep.connected) == 1,
+		LastAppliedTimestamp: atomic.LoadUint64(&rep.lastApplied),
+		LagMs:                atomic.LoadInt64(&rep.lagNs) / int64(time.Millisecond),
+	}
+	if !s.Connected {
+		s.DisconnectedForMs = time.Since(time.Unix(0, atomic.LoadInt64(&rep.disconnectedAt))).Milliseconds()
+	}
+	return s
+}
+
+// run follows the primary until the server shuts down, reconnecting with a growing delay whenever
+// the stream is interrupted.
+func (rep *replica) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-rep.app.chShutdown
+		cancel()
+	}()
+
+	creds, err := rep.app.rpcDialOption()
+	if err != nil {
+		rep.app.logger.Fatal(err.Error())
+	}
+	conn, err := grpc.Dial(rep.primary, creds)
+	if err != nil {
+		rep.app.logger.Fatal(err.Error())
+	}
+	defer conn.Close()
+	client := api.NewWalClient(conn)
+
+	delay := minReplicaRetryDelay
+	for {
+		before := atomic.LoadUint64(&rep.lastApplied)
+		err = rep.follow(ctx, client)
+		atomic.StoreInt32(&rep.connected, 0)
+		atomic.StoreInt64(&rep.disconnectedAt, time.Now().UnixNano())
+		if ctx.Err() != nil {
+			return
+		}
+		if atomic.LoadUint64(&rep.lastApplied) > before {
+			delay = minReplicaRetryDelay
+		}
+		rep.app.logger.Warn(fmt.Sprintf("Lost the stream from primary %s (%s); retrying in %s", rep.primary, err.Error(), delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReplicaRetryDelay {
+			delay = maxReplicaRetryDelay
+		}
+	}
+}
+
+// follow streams entries from the primary, starting at the last one applied, and applies them
+// until the stream ends.
+func (rep *replica) follow(ctx context.Context, client api.WalClient) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	from := atomic.LoadUint64(&rep.lastApplied)
+	rep.skip = rep.appliedAtLast
+	stream, err := client.PublishEntryStream(ctx, &api.PublishEntryRequest{Timestamp: from})
+	if err != nil {
+		return err
+	}
+	// The primary sends its headers as soon as it has subscribed us to its WAL.
+	if _, err = stream.Header(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&rep.connected, 1)
+
+	// Receive on another goroutine, so that whatever has arrived while a batch was being applied
+	// can be applied together.
+	chEntries := make(chan wal.WalEntry, maxReplicaBatch)
+	chErr := make(chan error, 1)
+	go func() {
+		defer close(chEntries)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				chErr <- err
+				return
+			}
+			e := res.GetEntry()
+			if e == nil {
+				continue
+			}
+			select {
+			case chEntries <- wal.WalEntry{
+				Timestamp: e.GetTimestamp(),
+				Key:       e.GetKey(),
+				Pattern:   e.GetPattern(),
+				Action:    uint16(e.GetAction()),
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	rep.app.logger.Info(fmt.Sprintf("Following primary %s from %d", rep.primary, from))
+
+	for e := range chEntries {
+		batch := []wal.WalEntry{e}
+	drain:
+		for len(batch) < maxReplicaBatch {
+			select {
+			case next, ok := <-chEntries:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		rep.apply(batch)
+	}
+	select {
+	case err = <-chErr:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// apply applies a batch of entries from the primary as a single generation, keeping their
+// timestamps. Entries that have already been applied are skipped, as are entries that can't be
+// applied, as they would be when replaying a WAL file.
+func (rep *replica) apply(batch []wal.WalEntry) {
+	last := atomic.LoadUint64(&rep.lastApplied)
+	atLast, skip := rep.appliedAtLast, rep.skip
+	entries := batch[:0]
+	for _, e := range batch {
+		switch {
+		case e.Timestamp < last:
+			continue
+		case e.Timestamp == last && skip > 0:
+			skip--
+			continue
+		case e.Timestamp == last:
+			atLast++
+		default:
+			last, atLast, skip = e.Timestamp, 1, 0
+		}
+		entries = append(entries, e)
+	}
+	rep.skip = skip
+	if len(entries) == 0 {
+		return
+	}
+	_, err := rep.app.mutateAndLog(entries, func(r *registry.Registry) error {
+		for _, e := range entries {
+			if err := rep.app.applyEntry(r, e.Action, string(e.Key), string(e.Pattern)); err != nil {
+				rep.app.logger.Error(fmt.Sprintf("Could not apply entry %d from the primary: %s", e.Timestamp, err.Error()))
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrStaleEntry) {
+		return
+	}
+	if err != nil {
+		// The entries have been applied, but not logged locally.
+		rep.app.logger.Error(err.Error())
+	}
+	rep.appliedAtLast = atLast
+	atomic.StoreUint64(&rep.lastApplied, last)
+	lag := time.Now().UnixNano() - int64(last)
+	if lag < 0 {
+		lag = 0
+	}
+	atomic.StoreInt64(&rep.lagNs, lag)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/wal"
+	"testing"
+)
+
+// restoredEntries returns entries that all share one timestamp, as a restored WAL file does.
+func restoredEntries(ts uint64, from, to int) []wal.WalEntry {
+	entries := make([]wal.WalEntry, 0, to-from)
+	for x := from; x < to; x++ {
+		e := newWalEntry(wal.WAL_ADD, fmt.Sprintf("key-%02d", x), `{"sys":["filestore"]}`)
+		e.Timestamp = ts
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestReplicaKeepsEntriesSharingATimestamp(t *testing.T) {
+	a := newTestApplication(t)
+	rep := newReplica(a, "primary:9090")
+
+	// A batch boundary falls in the middle of entries with the same timestamp.
+	rep.apply(restoredEntries(100, 0, 3))
+	rep.apply(restoredEntries(100, 3, 5))
+	if g := a.currentGeneration(); g.registry.Len() != 5 {
+		t.Errorf("Expected 5 keys after two batches at the same timestamp, got %d", g.registry.Len())
+	}
+
+	// The stream is interrupted and resumed at timestamp 100, so the primary sends the five
+	// entries again, followed by one more at the same timestamp and one after it.
+	rep.skip = rep.appliedAtLast
+	resent := append(restoredEntries(100, 0, 6), restoredEntries(101, 6, 7)...)
+	rep.apply(resent[:4])
+	rep.apply(resent[4:])
+	g := a.currentGeneration()
+	if g.registry.Len() != 7 {
+		t.Errorf("Expected 7 keys after resuming, got %d", g.registry.Len())
+	}
+	if g.gen != 3 {
+		t.Errorf("Expected the resent entries to be skipped without a new generation, got generation %d", g.gen)
+	}
+	if rep.lastApplied != 101 || rep.appliedAtLast != 1 {
+		t.Errorf("Expected 1 entry applied at timestamp 101, got %d at %d", rep.appliedAtLast, rep.lastApplied)
+	}
+
+	// Entries from before the last one applied are never applied again.
+	old := newWalEntry(wal.WAL_DEL, "key-00", "-")
+	old.Timestamp = 100
+	rep.apply([]wal.WalEntry{old})
+	if !a.currentGeneration().registry.HasKey("key-00") {
+		t.Error("An entry from before the last one applied was applied")
+	}
+}
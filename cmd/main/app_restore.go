@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/snapshot"
+	"github.com/highgrav/munchkin/internal/wal"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// runRestore rebuilds the rule set as it stood at --walLoadUntil, from the newest snapshot before
+// then and the WAL entries up to then, and writes it out as a single WAL file or a snapshot. The
+// result can be used as the WAL or snapshot directory of a fresh server. No servers are started.
+func runRestore(cfg appConfig) error {
+	if cfg.walLoad.fileDirectory == "" && cfg.snapshots.fileDirectory == "" {
+		return errors.New("--restoreOut needs --walLoadDir or --snapshotDir to restore from")
+	}
+	if cfg.restore.format != "wal" && cfg.restore.format != "snapshot" {
+		return fmt.Errorf("unknown restore format \"%s\" (expected wal or snapshot)", cfg.restore.format)
+	}
+	s, err := os.Stat(cfg.restore.outDir)
+	if err != nil {
+		return err
+	}
+	if !s.IsDir() {
+		return errors.New(cfg.restore.outDir + " is not a directory!")
+	}
+
+	a := &application{config: &cfg}
+	if err = a.newLogger(); err != nil {
+		return err
+	}
+	if err = a.newMatcher(); err != nil {
+		return err
+	}
+	if cfg.walLoad.loadUntil == 0 {
+		a.logger.Info("No --walLoadUntil given, restoring the latest state")
+	}
+	a.loadWalFiles()
+	if a.lastUpdatedOn == 0 {
+		return errors.New("nothing to restore: no snapshot or WAL entries found up to the requested time")
+	}
+
+	state := snapshot.Snapshot{
+		Timestamp: a.lastUpdatedOn,
+		Keys:      a.currentGeneration().registry.Snapshot(),
+	}
+	var fileName string
+	if cfg.restore.format == "snapshot" {
+		fileName, err = snapshot.Write(cfg.restore.outDir, cfg.snapshots.filePrefix, state)
+		if err != nil {
+			return err
+		}
+	} else {
+		fileName, err = writeRestoredWal(cfg.restore.outDir, cfg.walWrite.filePrefix, state)
+		if err != nil {
+			return err
+		}
+	}
+	a.logger.Info(fmt.Sprintf("Restored %d keys as of %d to %s", len(state.Keys), state.Timestamp, fileName))
+	return nil
+}
+
+// checkLoadUntil checks that a server can be started with --walLoadUntil. Entries after the cutoff
+// are left in the WAL files it loads, so if the server logged to the same directory, the next
+// restart would apply those as well as anything written since. It has to log to a new, empty
+// --walDir instead, which startWithLoadedState seeds with the state at the cutoff, and be restarted
+// from there. A Raft member replays its own log rather than the WAL, and a replica or shard member
+// gets its rules from other servers, so none of them can be rolled back this way.
+func checkLoadUntil(cfg appConfig) error {
+	switch {
+	case cfg.consensus.raftAddr != "":
+		return errors.New("--walLoadUntil can't be used with --raftAddr")
+	case cfg.followPrimary != "":
+		return errors.New("--walLoadUntil can't be used with --followPrimary")
+	case cfg.sharding.replicas > 0:
+		return errors.New("--walLoadUntil can't be used with --shardReplicas")
+	case cfg.walWrite.fileDirectory == "":
+		return errors.New("--walLoadUntil needs a new --walDir to log to (or --restoreOut)")
+	}
+	if cfg.walLoad.fileDirectory != "" {
+		loadDir, err := filepath.Abs(cfg.walLoad.fileDirectory)
+		if err != nil {
+			return err
+		}
+		walDir, err := filepath.Abs(cfg.walWrite.fileDirectory)
+		if err != nil {
+			return err
+		}
+		if loadDir == walDir {
+			return errors.New("--walLoadUntil needs a --walDir other than --walLoadDir")
+		}
+	}
+	files, err := wal.ListWalFiles(cfg.walWrite.fileDirectory, cfg.walWrite.filePrefix)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("--walLoadUntil needs an empty --walDir, but %s already holds WAL files", cfg.walWrite.fileDirectory)
+	}
+	// The next restart would load the newest snapshot, even one taken after the cutoff.
+	if cfg.snapshots.fileDirectory != "" {
+		snaps, err := snapshot.List(cfg.snapshots.fileDirectory, cfg.snapshots.filePrefix)
+		if err != nil {
+			return err
+		}
+		if len(snaps) > 0 {
+			newest := snaps[len(snaps)-1]
+			if ts, err := snapshot.FileTimestamp(newest, cfg.snapshots.filePrefix); err == nil && ts > cfg.walLoad.loadUntil {
+				return fmt.Errorf("--walLoadUntil can't be used while --snapshotDir holds snapshots taken after it, such as %s", newest)
+			}
+		}
+	}
+	return nil
+}
+
+// startWithLoadedState writes the rule set loaded up to --walLoadUntil to --walDir, before the
+// server logs anything there, so that restarting with --walLoadDir pointing at --walDir brings back
+// the same state along with the changes made since.
+func (a *application) startWithLoadedState() error {
+	state := a.captureSnapshot()
+	if state.Timestamp == 0 {
+		a.logger.Info("Nothing loaded up to --walLoadUntil; starting empty")
+		return nil
+	}
+	fileName, err := writeRestoredWal(a.config.walWrite.fileDirectory, a.config.walWrite.filePrefix, state)
+	if err != nil {
+		return err
+	}
+	a.logger.Info(fmt.Sprintf("Wrote %d keys as of %d to %s", len(state.Keys), state.Timestamp, fileName))
+	return nil
+}
+
+// writeRestoredWal writes a rule set to a new WAL file as one WAL_ADD entry per pattern, all
+// stamped with the rule set's timestamp so that a server replaying the file picks up after it.
+func writeRestoredWal(dir, prefix string, state snapshot.Snapshot) (string, error) {
+	fileName, err := wal.CreateWalFileAt(dir, prefix, int64(state.Timestamp))
+	if err != nil {
+		return fileName, err
+	}
+	wf, err := wal.OpenWalFile(fileName)
+	if err != nil {
+		return fileName, err
+	}
+	defer wf.Close()
+
+	keys := make([]string, 0, len(state.Keys))
+	for k := range state.Keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]wal.WalEntry, 0)
+	for _, k := range keys {
+		for _, p := range state.Keys[k] {
+			entries = append(entries, wal.WalEntry{
+				Timestamp: state.Timestamp,
+				Key:       []byte(k),
+				Pattern:   []byte(p),
+				Action:    wal.WAL_ADD,
+			})
+		}
+	}
+	if err = wf.Append(entries); err != nil {
+		return fileName, err
+	}
+	return fileName, wf.Sync()
+}
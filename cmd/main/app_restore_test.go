@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/highgrav/munchkin/internal/snapshot"
+	"github.com/highgrav/munchkin/internal/wal"
+	"testing"
+	"time"
+)
+
+// writeTestWal writes entries to a new WAL file in dir, named for the first entry's timestamp.
+func writeTestWal(t *testing.T, dir string, entries ...wal.WalEntry) {
+	t.Helper()
+	fileName, err := wal.CreateWalFileAt(dir, "mwal-", int64(entries[0].Timestamp))
+	if err != nil {
+		t.Fatal("wal.CreateWalFileAt: " + err.Error())
+	}
+	wf, err := wal.OpenWalFile(fileName)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wf.Close()
+	if err = wf.Append(entries); err != nil {
+		t.Fatal("wal.Append: " + err.Error())
+	}
+}
+
+func stampedEntry(ts uint64, action uint16, key, pattern string) wal.WalEntry {
+	e := newWalEntry(action, key, pattern)
+	e.Timestamp = ts
+	return e
+}
+
+func TestPointInTimeRestore(t *testing.T) {
+	walDir := t.TempDir()
+	writeTestWal(t, walDir,
+		stampedEntry(100, wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`),
+		stampedEntry(200, wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`))
+	writeTestWal(t, walDir,
+		stampedEntry(300, wal.WAL_DEL, "first-test-key", "-"),
+		stampedEntry(400, wal.WAL_ADD, "third-test-key", `{"sys":["infra"]}`))
+
+	restore := func(until uint64) *application {
+		outDir := t.TempDir()
+		cfg := appConfig{}
+		cfg.walLoad.fileDirectory = walDir
+		cfg.walLoad.filePrefix = "mwal-"
+		cfg.walLoad.loadUntil = until
+		cfg.walWrite.filePrefix = "mwal-"
+		cfg.restore.outDir = outDir
+		cfg.restore.format = "wal"
+		if err := runRestore(cfg); err != nil {
+			t.Fatal("runRestore: " + err.Error())
+		}
+		// Start a fresh server from the restored directory.
+		a := newTestApplication(t)
+		a.config.walLoad.fileDirectory = outDir
+		a.config.walLoad.filePrefix = "mwal-"
+		a.loadWalFiles()
+		return a
+	}
+
+	a := restore(250)
+	if r := a.currentGeneration().registry; r.Len() != 2 || !r.HasKey("first-test-key") || !r.HasKey("second-test-key") {
+		t.Errorf("Expected the two keys added by 250, got %v", r.Snapshot())
+	}
+	if a.lastUpdatedOn != 200 {
+		t.Errorf("Expected the restored rule set to be stamped 200, got %d", a.lastUpdatedOn)
+	}
+
+	a = restore(0)
+	if r := a.currentGeneration().registry; r.Len() != 2 || !r.HasKey("second-test-key") || !r.HasKey("third-test-key") {
+		t.Errorf("Expected the latest two keys, got %v", r.Snapshot())
+	}
+}
+
+func TestStartFromLoadUntil(t *testing.T) {
+	base := uint64(time.Now().Add(-time.Hour).UnixNano())
+	loadDir := t.TempDir()
+	writeTestWal(t, loadDir,
+		stampedEntry(base+100, wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`),
+		stampedEntry(base+200, wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`))
+	writeTestWal(t, loadDir,
+		stampedEntry(base+300, wal.WAL_DEL, "first-test-key", "-"),
+		stampedEntry(base+400, wal.WAL_ADD, "third-test-key", `{"sys":["infra"]}`))
+	config := func(walDir string) appConfig {
+		cfg := appConfig{}
+		cfg.walLoad.fileDirectory = loadDir
+		cfg.walLoad.filePrefix = "mwal-"
+		cfg.walLoad.loadUntil = base + 250
+		cfg.walWrite.fileDirectory = walDir
+		cfg.walWrite.filePrefix = "mwal-"
+		cfg.walWrite.fsyncPolicy = "always"
+		cfg.snapshots.filePrefix = "msnap-"
+		return cfg
+	}
+
+	usedDir := t.TempDir()
+	writeTestWal(t, usedDir, stampedEntry(base+500, wal.WAL_ADD, "fourth-test-key", `{"sys":["infra"]}`))
+	laterSnaps := t.TempDir()
+	if _, err := snapshot.Write(laterSnaps, "msnap-", snapshot.Snapshot{Timestamp: base + 300, Keys: map[string][]string{}}); err != nil {
+		t.Fatal("snapshot.Write: " + err.Error())
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(cfg *appConfig)
+	}{
+		{"no walDir", func(cfg *appConfig) { cfg.walWrite.fileDirectory = "" }},
+		{"walDir is walLoadDir", func(cfg *appConfig) { cfg.walWrite.fileDirectory = loadDir + "/" }},
+		{"walDir holds WAL files", func(cfg *appConfig) { cfg.walWrite.fileDirectory = usedDir }},
+		{"snapshot after the cutoff", func(cfg *appConfig) { cfg.snapshots.fileDirectory = laterSnaps }},
+		{"raft", func(cfg *appConfig) { cfg.consensus.raftAddr = "127.0.0.1:7000" }},
+		{"replica", func(cfg *appConfig) { cfg.followPrimary = "127.0.0.1:7070" }},
+		{"sharding", func(cfg *appConfig) { cfg.sharding.replicas = 2 }},
+	} {
+		cfg := config(t.TempDir())
+		tc.change(&cfg)
+		if err := checkLoadUntil(cfg); err == nil {
+			t.Errorf("%s: expected --walLoadUntil to be refused", tc.name)
+		}
+	}
+
+	// Start from the state at the cutoff, logging to a new directory, and make a change.
+	walDir := t.TempDir()
+	a := newTestApplication(t)
+	*a.config = config(walDir)
+	if err := checkLoadUntil(*a.config); err != nil {
+		t.Fatal("checkLoadUntil: " + err.Error())
+	}
+	a.loadWalFiles()
+	if err := a.startWithLoadedState(); err != nil {
+		t.Fatal("startWithLoadedState: " + err.Error())
+	}
+	a.newWalLogger()
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "fourth-test-key", `{"sys":["infra"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	a.walFileMgr.closeWalFile()
+
+	// Restarting from the new directory brings back the state at the cutoff and the change, and
+	// nothing logged after the cutoff.
+	a = newTestApplication(t)
+	a.config.walLoad.fileDirectory = walDir
+	a.config.walLoad.filePrefix = "mwal-"
+	a.loadWalFiles()
+	r := a.currentGeneration().registry
+	if r.Len() != 3 || !r.HasKey("first-test-key") || !r.HasKey("second-test-key") || !r.HasKey("fourth-test-key") {
+		t.Errorf("Expected the keys added by the cutoff and the new key, got %v", r.Snapshot())
+	}
+}
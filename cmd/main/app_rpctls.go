@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"os"
+)
+
+// rpcServerCredentials returns the TLS credentials the cluster gRPC server uses when --rpcTLS is
+// set. If --rpcCAFile is set too, clients must present a certificate it signed.
+func rpcServerCredentials(cfg webServerConfig) (credentials.TransportCredentials, error) {
+	if cfg.certFilePath == "" || cfg.keyFilePath == "" {
+		return nil, errors.New("--rpcTLS needs --rpcCertFile and --rpcKeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.certFilePath, cfg.keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.caFilePath != "" {
+		if tlsCfg.ClientCAs, err = loadCertPool(cfg.caFilePath); err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// rpcDialOption returns the transport credentials for dialling another server's cluster gRPC
+// API. Every server in a cluster shares the --rpcTLS settings: with TLS, the other server's
+// certificate is checked against --rpcCAFile (or the system roots), and this server presents its
+// own certificate so that servers requiring one accept it.
+func (a *application) rpcDialOption() (grpc.DialOption, error) {
+	cfg := a.config.clusterServer
+	if !cfg.useTLS {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	tlsCfg := &tls.Config{}
+	if cfg.caFilePath != "" {
+		pool, err := loadCertPool(cfg.caFilePath)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.certFilePath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.certFilePath, cfg.keyFilePath)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)), nil
+}
+
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + fileName)
+	}
+	return pool, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/wal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeTestCerts writes a CA and a certificate it signed for 127.0.0.1 to a temporary directory,
+// returning a cluster API config that uses them.
+func writeTestCerts(t *testing.T) webServerConfig {
+	t.Helper()
+	dir := t.TempDir()
+	writePem := func(name, kind string, der []byte) string {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	caKey := newKey()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "munchkin test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newKey()
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "munchkin"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webServerConfig{
+		useTLS:       true,
+		caFilePath:   writePem("ca.pem", "CERTIFICATE", caDer),
+		certFilePath: writePem("cert.pem", "CERTIFICATE", leafDer),
+		keyFilePath:  writePem("key.pem", "EC PRIVATE KEY", keyDer),
+	}
+}
+
+func TestRpcTLS(t *testing.T) {
+	srv := writeTestCerts(t)
+	a, client := startWalServerWith(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	entry := &api.LogEntryRequest{Entry: &api.WalEntry{
+		Key:     []byte("first-test-key"),
+		Pattern: []byte(`{"sys":["filestore"]}`),
+		Action:  uint32(wal.WAL_ADD),
+	}}
+	if _, err := client.LogEntry(ctx, entry); err != nil {
+		t.Fatal("LogEntry over TLS: " + err.Error())
+	}
+
+	addr := "127.0.0.1:" + strconv.Itoa(a.config.clusterServer.port)
+	call := func(opt grpc.DialOption) error {
+		conn, err := grpc.Dial(addr, opt)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = api.NewWalClient(conn).LogEntry(ctx, entry)
+		return err
+	}
+	if err := call(grpc.WithTransportCredentials(insecure.NewCredentials())); err == nil {
+		t.Error("Expected a plaintext client to be refused")
+	}
+	// With --rpcCAFile set, a client has to present a certificate the CA signed.
+	noCert := newTestApplication(t)
+	noCert.config.clusterServer = webServerConfig{useTLS: true, caFilePath: srv.caFilePath}
+	opt, err := noCert.rpcDialOption()
+	if err != nil {
+		t.Fatal("rpcDialOption: " + err.Error())
+	}
+	if err = call(opt); err == nil {
+		t.Error("Expected a client without a certificate to be refused")
+	}
+
+	if _, err = rpcServerCredentials(webServerConfig{useTLS: true}); err == nil {
+		t.Error("Expected --rpcTLS without a certificate to be refused")
+	}
+}
+
+func TestReplicaOverTLS(t *testing.T) {
+	srv := writeTestCerts(t)
+	primary, _ := startWalServerWith(t, srv)
+	if _, err := primary.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+
+	a := newTestApplication(t)
+	a.config.clusterServer = srv
+	a.chShutdown = make(chan struct{})
+	rep := newReplica(a, "127.0.0.1:"+strconv.Itoa(primary.config.clusterServer.port))
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		rep.run()
+	}()
+	defer func() {
+		close(a.chShutdown)
+		<-stopped
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for !a.hasKey("first-test-key") {
+		if time.Now().After(deadline) {
+			t.Fatal("The replica didn't receive the primary's entry over TLS")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
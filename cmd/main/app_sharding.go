@@ -0,0 +1,937 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shardSettleDelay is how long membership has to stay unchanged before keys are moved, so that
+	// a burst of changes (such as a cluster starting up) only moves keys once.
+	shardSettleDelay = 2 * time.Second
+	// shardRetryDelay is how long to wait before trying again when keys couldn't be moved, or
+	// changes couldn't be sent to another owner.
+	shardRetryDelay = 10 * time.Second
+	// shardRequestTimeout bounds a single match or transfer request to another server.
+	shardRequestTimeout = 30 * time.Second
+	// maxShardTransfer is the most entries sent to another server in a single stream.
+	maxShardTransfer = 1024
+	// localMatchParam is set on match requests sent to other shards, so that they only match
+	// against the keys they hold rather than fanning out again.
+	localMatchParam = "local"
+)
+
+// ErrShardUnavailable is returned when no copy of some of the keys could be reached.
+var ErrShardUnavailable = errors.New("No copy of some shards could be reached")
+
+// ErrPartialCommit is returned when a change has been applied, but some of the other owners of its
+// keys couldn't be reached. The change is queued and sent to them again until they take it.
+var ErrPartialCommit = errors.New("Change was applied, but not yet on every owner of its keys")
+
+// shardStatus is reported on the cluster membership endpoint.
+type shardStatus struct {
+	Replicas      int            `json:"replicas"`
+	Members       []string       `json:"members"`
+	Balanced      bool           `json:"balanced"`
+	LastRebalance time.Time      `json:"lastRebalance"`
+	LastError     string         `json:"lastError,omitempty"`
+	Queued        int            `json:"queued,omitempty"`
+	QueuedFor     map[string]int `json:"queuedFor,omitempty"`
+}
+
+// sharder spreads the rule set across the members of the cluster. Each key is owned by replicas
+// members, picked by consistent hashing over the live members that take part in sharding. Changes
+// are applied on every owner of the keys they touch, matches are gathered from enough members to
+// reach a copy of every key, and keys are moved between members as they join and leave.
+type sharder struct {
+	app      *application
+	self     string
+	replicas int
+	scheme   string
+	// adminScheme is used to read other members' keys from their admin API after a restart.
+	adminScheme string
+	client      *http.Client
+	changed     chan struct{}
+
+	mu            sync.RWMutex
+	ring          *cluster.HashRing
+	balanced      *cluster.HashRing // the ring keys were last moved to match, if any
+	lastRebalance time.Time
+	lastErr       error
+
+	// moveMu stops a rebalance and the hand-off at shutdown from moving keys at the same time.
+	moveMu sync.Mutex
+
+	// queued holds changes that couldn't be sent to another member, in the order they were made.
+	// Queues are only kept in memory, so they're lost if this server restarts. stale holds the
+	// keys each member's queue touched when the queue was dropped because the member left the
+	// ring, so that the member is sent them whole if it comes back.
+	queueMu   sync.Mutex
+	queued    map[string][]wal.WalEntry
+	stale     map[string]map[string]bool
+	resending bool
+
+	connMu sync.Mutex
+	conns  map[string]*grpc.ClientConn
+}
+
+// startSharding sets up sharding if --shardReplicas is set. Until the server has joined the
+// cluster, it owns every key.
+func (a *application) startSharding() error {
+	replicas := a.config.sharding.replicas
+	if replicas <= 0 {
+		return nil
+	}
+	if a.config.cluster.serfAddr == "" {
+		return errors.New("--shardReplicas needs --serfAddr, so that cluster members can find each other")
+	}
+	if a.config.consensus.raftAddr != "" {
+		return errors.New("--shardReplicas can't be used with --raftAddr, which keeps every key on every server")
+	}
+	if a.replica != nil {
+		return errors.New("--shardReplicas can't be used with --followPrimary")
+	}
+	self, err := a.nodeName()
+	if err != nil {
+		return err
+	}
+	scheme, adminScheme := "http", "http"
+	if a.config.matchServer.useTLS {
+		scheme = "https"
+	}
+	if a.config.adminServer.useTLS {
+		adminScheme = "https"
+	}
+	a.sharder = &sharder{
+		app:         a,
+		self:        self,
+		replicas:    replicas,
+		scheme:      scheme,
+		adminScheme: adminScheme,
+		client:      &http.Client{Timeout: shardRequestTimeout},
+		changed:     make(chan struct{}, 1),
+		ring:        cluster.NewHashRing([]string{self}, cluster.DefaultVnodes, replicas),
+		queued:      make(map[string][]wal.WalEntry),
+		stale:       make(map[string]map[string]bool),
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+	a.logger.Info(fmt.Sprintf("Sharding keys across the cluster, with %d copies of each", replicas))
+	return nil
+}
+
+// stopSharding hands this server's keys over to the members that will own them once it has left,
+// so that keys it holds the only copy of aren't lost. It has to be called before the server leaves
+// the cluster, while the other members can still be reached.
+func (a *application) stopSharding() {
+	if a.sharder == nil {
+		return
+	}
+	s := a.sharder
+	ring := s.currentRing()
+	rest := make([]string, 0, len(ring.Members()))
+	for _, m := range ring.Members() {
+		if m != s.self {
+			rest = append(rest, m)
+		}
+	}
+	if len(rest) > 0 {
+		a.logger.Info("Handing keys over to the rest of the cluster...")
+		if err := s.moveKeys(cluster.NewHashRing(rest, cluster.DefaultVnodes, s.replicas), ring); err != nil {
+			a.logger.Error("Handing keys over: " + err.Error())
+		}
+	}
+	s.close()
+}
+
+// refreshShards rebuilds the shard ring after a membership change, if sharding is enabled.
+func (a *application) refreshShards() {
+	if a.sharder != nil {
+		a.sharder.refresh()
+	}
+}
+
+// shardedMatch reports whether a match request should be gathered from every shard, rather than
+// answered from the keys this server holds.
+func (a *application) shardedMatch(r *http.Request) bool {
+	return a.sharder != nil && r.URL.Query().Get(localMatchParam) != "true"
+}
+
+func (s *sharder) currentRing() *cluster.HashRing {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring
+}
+
+// status reports the current ring and how the last rebalance went.
+func (s *sharder) status() shardStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := shardStatus{
+		Replicas:      s.ring.Replicas(),
+		Members:       s.ring.Members(),
+		Balanced:      s.balanced == s.ring,
+		LastRebalance: s.lastRebalance,
+	}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	s.queueMu.Lock()
+	for member, entries := range s.queued {
+		if st.QueuedFor == nil {
+			st.QueuedFor = make(map[string]int, len(s.queued))
+		}
+		st.QueuedFor[member] = len(entries)
+		st.Queued += len(entries)
+	}
+	s.queueMu.Unlock()
+	return st
+}
+
+// refresh rebuilds the ring from this server and the live members that advertise the shard tag,
+// and schedules a rebalance if its membership has changed.
+func (s *sharder) refresh() {
+	members := []string{s.self}
+	for _, p := range s.app.cluster.routablePeers() {
+		if p.Tags[cluster.TagShard] != "" {
+			members = append(members, p.Name)
+		}
+	}
+	ring := cluster.NewHashRing(members, cluster.DefaultVnodes, s.replicas)
+	s.mu.Lock()
+	changed := fmt.Sprint(ring.Members()) != fmt.Sprint(s.ring.Members())
+	if changed {
+		s.ring = ring
+	}
+	s.mu.Unlock()
+	if changed {
+		s.app.logger.Info("Shard ring changed", zap.Strings("members", ring.Members()))
+		s.schedule()
+	}
+}
+
+// schedule asks for a rebalance, unless one is already waiting to run.
+func (s *sharder) schedule() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run rebalances whenever the ring changes, until the server shuts down. A rebalance that fails is
+// tried again after shardRetryDelay.
+func (s *sharder) run() {
+	for {
+		select {
+		case <-s.app.chShutdown:
+			return
+		case <-s.changed:
+		}
+		settle := time.NewTimer(shardSettleDelay)
+		for settled := false; !settled; {
+			select {
+			case <-s.app.chShutdown:
+				settle.Stop()
+				return
+			case <-s.changed:
+				if !settle.Stop() {
+					<-settle.C
+				}
+				settle.Reset(shardSettleDelay)
+			case <-settle.C:
+				settled = true
+			}
+		}
+		if err := s.rebalance(); err != nil {
+			s.app.logger.Error("Rebalancing shards: " + err.Error())
+			time.AfterFunc(shardRetryDelay, s.schedule)
+		}
+	}
+}
+
+// rebalance moves keys to match the current ring.
+func (s *sharder) rebalance() error {
+	s.mu.RLock()
+	ring, prev := s.ring, s.balanced
+	s.mu.RUnlock()
+	err := s.moveKeys(ring, prev)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRebalance = time.Now()
+	s.lastErr = err
+	if err == nil {
+		s.balanced = ring
+	}
+	return err
+}
+
+// moveKeys copies each key this server holds to the owners that may not have it yet, then drops
+// the keys this server no longer owns. A member that owned a key along with this server under prev
+// has been sent every change to it since, so it is left alone, unless its queued changes to the
+// key were dropped; it is then sent the key, or told to delete it if this server no longer holds
+// it. Keys are only dropped once every owner has been sent them. If prev is nil (as when the server has just started), this server's
+// keys may be out of date, so they are brought in line with the other owners' instead.
+func (s *sharder) moveKeys(ring, prev *cluster.HashRing) error {
+	s.moveMu.Lock()
+	defer s.moveMu.Unlock()
+	if prev == nil {
+		return s.pullKeys(ring)
+	}
+
+	inRing := make(map[string]bool)
+	for _, m := range ring.Members() {
+		inRing[m] = true
+	}
+	stale := make(map[string]map[string]bool)
+	s.queueMu.Lock()
+	for member, keys := range s.stale {
+		stale[member] = make(map[string]bool, len(keys))
+		for key := range keys {
+			stale[member][key] = true
+		}
+	}
+	s.queueMu.Unlock()
+
+	transfers := make(map[string][]wal.WalEntry)
+	var drop []string
+	held := s.app.currentGeneration().registry.Snapshot()
+	for key, patterns := range held {
+		inSync := prev.Owns(s.self, key)
+		var entries []wal.WalEntry
+		for _, o := range ring.Owners(key) {
+			if o == s.self || (inSync && prev.Owns(o, key) && !stale[o][key]) {
+				continue
+			}
+			if entries == nil {
+				var err error
+				if entries, err = transferEntries(key, patterns); err != nil {
+					return err
+				}
+			}
+			transfers[o] = append(transfers[o], entries...)
+		}
+		if !ring.Owns(s.self, key) {
+			drop = append(drop, key)
+		}
+	}
+
+	for member, keys := range stale {
+		for key := range keys {
+			if _, ok := held[key]; !ok && ring.Owns(member, key) {
+				transfers[member] = append(transfers[member], newWalEntry(wal.WAL_DEL, key, "-"))
+			}
+		}
+	}
+
+	failed := make(map[string]bool)
+	var firstErr error
+	for _, member := range sortedMembers(transfers) {
+		if err := s.send(member, transfers[member]); err != nil {
+			failed[member] = true
+			if firstErr == nil {
+				firstErr = fmt.Errorf("sending keys to %s: %w", member, err)
+			}
+		}
+	}
+	s.queueMu.Lock()
+	for member, keys := range stale {
+		if failed[member] || !inRing[member] {
+			continue
+		}
+		for key := range keys {
+			delete(s.stale[member], key)
+		}
+		if len(s.stale[member]) == 0 {
+			delete(s.stale, member)
+		}
+	}
+	s.queueMu.Unlock()
+
+	dels := make([]wal.WalEntry, 0, len(drop))
+	for _, key := range drop {
+		sent := true
+		for _, o := range ring.Owners(key) {
+			sent = sent && !failed[o]
+		}
+		if sent {
+			dels = append(dels, newWalEntry(wal.WAL_DEL, key, "-"))
+		}
+	}
+	if len(dels) > 0 {
+		_, err := s.app.mutateAndLog(dels, func(r *registry.Registry) error {
+			return s.app.applyEntries(r, dels)
+		})
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("dropping keys: %w", err)
+		}
+	}
+	if len(transfers) > 0 || len(dels) > 0 {
+		s.app.logger.Info("Moved shard keys",
+			zap.Int("members", len(transfers)),
+			zap.Int("failed", len(failed)),
+			zap.Int("dropped", len(dels)))
+	}
+	return firstErr
+}
+
+// transferEntries builds the entries that copy a key to another member. Keys are sent whole,
+// replacing whatever the other member has.
+func transferEntries(key string, patterns []string) ([]wal.WalEntry, error) {
+	payload, err := encodePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return []wal.WalEntry{newWalEntry(wal.WAL_REPLACE, key, payload)}, nil
+}
+
+// pullKeys brings the keys this server holds in line with the other owners' copies, for when it
+// has just started and may have missed changes while it was down. Sending its keys out instead
+// would bring back keys that were deleted meanwhile. For each key with other owners, the copy of
+// the first owner that answers with the key is taken, and the key is dropped if every owner that
+// answers doesn't have it, or if this server no longer owns it. Keys whose other owners can't be
+// reached are kept as they are, and an error is returned so that the keys are pulled again.
+// Keys this server is the only owner of are kept as they are.
+func (s *sharder) pullKeys(ring *cluster.HashRing) error {
+	var firstErr error
+	held := make(map[string]map[string][]string)
+	for _, m := range ring.Members() {
+		if m == s.self {
+			continue
+		}
+		keys, err := s.fetchKeys(m)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("fetching keys from %s: %w", m, err)
+			}
+			continue
+		}
+		held[m] = keys
+	}
+
+	local := s.app.currentGeneration().registry.Snapshot()
+	candidates := make(map[string]bool, len(local))
+	for key := range local {
+		candidates[key] = true
+	}
+	for _, keys := range held {
+		for key := range keys {
+			if ring.Owns(s.self, key) {
+				candidates[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(candidates))
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var changes []wal.WalEntry
+	adopted, dropped := 0, 0
+	for _, key := range keys {
+		others, answered, found := false, false, false
+		var patterns []string
+		for _, o := range ring.Owners(key) {
+			if o == s.self {
+				continue
+			}
+			others = true
+			if ownerKeys, ok := held[o]; ok {
+				answered = true
+				if !found {
+					patterns, found = ownerKeys[key]
+				}
+			}
+		}
+		if !others || !answered {
+			continue
+		}
+		current, ok := local[key]
+		switch {
+		case !found || !ring.Owns(s.self, key):
+			if ok {
+				changes = append(changes, newWalEntry(wal.WAL_DEL, key, "-"))
+				dropped++
+			}
+		case !ok || !samePatterns(current, patterns):
+			entries, err := transferEntries(key, patterns)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, entries...)
+			adopted++
+		}
+	}
+	if len(changes) > 0 {
+		_, err := s.app.mutateAndLog(changes, func(r *registry.Registry) error {
+			return s.app.applyEntries(r, changes)
+		})
+		if err != nil {
+			return fmt.Errorf("taking keys from the other owners: %w", err)
+		}
+		s.app.logger.Info("Pulled shard keys from the other owners",
+			zap.Int("members", len(held)),
+			zap.Int("taken", adopted),
+			zap.Int("dropped", dropped))
+	}
+	return firstErr
+}
+
+// fetchKeys reads every key another member holds from its admin API's export endpoint.
+func (s *sharder) fetchKeys(member string) (map[string][]string, error) {
+	p, ok := s.app.cluster.getPeer(member)
+	if !ok || p.Tags[cluster.TagAdminAddr] == "" {
+		return nil, fmt.Errorf("%s isn't a known cluster member", member)
+	}
+	resp, err := s.client.Get(s.adminScheme + "://" + p.Tags[cluster.TagAdminAddr] + "/api/admin/v1/export")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(member + " answered " + strconv.Itoa(resp.StatusCode))
+	}
+	keys := make(map[string][]string)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rec importRecord
+		if err = dec.Decode(&rec); err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys[rec.Key] = append(keys[rec.Key], string(rec.Pattern))
+	}
+}
+
+// samePatterns reports whether two copies of a key hold the same patterns, in any order and
+// ignoring whitespace.
+func samePatterns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	compact := func(patterns []string) []string {
+		out := make([]string, len(patterns))
+		for x, p := range patterns {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, []byte(p)); err != nil {
+				out[x] = p
+			} else {
+				out[x] = buf.String()
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	ca, cb := compact(a), compact(b)
+	for x := range ca {
+		if ca[x] != cb[x] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedMembers(m map[string][]wal.WalEntry) []string {
+	members := make([]string, 0, len(m))
+	for k := range m {
+		members = append(members, k)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// commit applies entries on every member that owns their keys: here through mutateAndLog, and
+// elsewhere through the WAL gRPC service. Changes for this server are applied first, so that a
+// change it rejects isn't sent anywhere; one it applies but can't log is still sent on. Changes
+// that can't be sent to another member are queued for it, and ErrPartialCommit is returned. The
+// generation returned is this server's.
+func (s *sharder) commit(entries []wal.WalEntry) (uint64, error) {
+	ring := s.currentRing()
+	var local []wal.WalEntry
+	remote := make(map[string][]wal.WalEntry)
+	for _, e := range entries {
+		for _, o := range ring.Owners(string(e.Key)) {
+			if o == s.self {
+				local = append(local, e)
+			} else {
+				remote[o] = append(remote[o], e)
+			}
+		}
+	}
+	gen := s.app.currentGeneration().gen
+	var localErr error
+	if len(local) > 0 {
+		gen, localErr = s.app.mutateAndLog(local, func(r *registry.Registry) error {
+			return s.app.applyEntries(r, local)
+		})
+		if localErr != nil && !errors.Is(localErr, ErrNotLogged) {
+			return gen, localErr
+		}
+	}
+	var behind []string
+	for _, member := range sortedMembers(remote) {
+		sent, err := s.sendOrQueue(member, remote[member])
+		if err != nil {
+			return gen, fmt.Errorf("applying changes on %s: %w", member, err)
+		}
+		if !sent {
+			behind = append(behind, member)
+		}
+	}
+	if localErr != nil {
+		return gen, localErr
+	}
+	if len(behind) > 0 {
+		return gen, fmt.Errorf("%w (queued for %s)", ErrPartialCommit, strings.Join(behind, ", "))
+	}
+	return gen, nil
+}
+
+// sendOrQueue sends entries to another member, reporting whether it took them. If earlier entries
+// for the member are still queued, or it can't be reached, the entries are queued behind them
+// instead, so that the member applies changes in the order they were made. Entries the member
+// rejects as invalid aren't queued; the error is returned instead.
+func (s *sharder) sendOrQueue(member string, entries []wal.WalEntry) (bool, error) {
+	s.queueMu.Lock()
+	if len(s.queued[member]) > 0 {
+		s.queue(member, entries)
+		s.queueMu.Unlock()
+		return false, nil
+	}
+	s.queueMu.Unlock()
+	err := s.send(member, entries)
+	if err == nil {
+		return true, nil
+	}
+	if status.Code(err) == codes.InvalidArgument {
+		return false, err
+	}
+	s.app.logger.Warn("Queueing changes for another shard: "+err.Error(), zap.String("member", member))
+	s.queueMu.Lock()
+	s.queue(member, entries)
+	s.queueMu.Unlock()
+	return false, nil
+}
+
+// queue adds entries to a member's queue, and arranges for the queues to be sent again unless
+// that's already arranged. The caller must hold queueMu.
+func (s *sharder) queue(member string, entries []wal.WalEntry) {
+	s.queued[member] = append(s.queued[member], entries...)
+	if !s.resending {
+		s.resending = true
+		time.AfterFunc(shardRetryDelay, s.resend)
+	}
+}
+
+// resend sends each member its queued entries, and tries again after shardRetryDelay for those
+// that still can't be reached. Queues for members that have left the ring are dropped, since
+// their keys now belong to members that were sent them when the keys moved; if the member comes
+// back, the keys its queue touched are sent to it whole. Entries are only
+// taken off a queue once they've been sent, so changes made meanwhile queue up behind them.
+func (s *sharder) resend() {
+	select {
+	case <-s.app.chShutdown:
+		return
+	default:
+	}
+	inRing := make(map[string]bool)
+	for _, m := range s.currentRing().Members() {
+		inRing[m] = true
+	}
+	s.queueMu.Lock()
+	pending := make(map[string][]wal.WalEntry, len(s.queued))
+	for member, entries := range s.queued {
+		if !inRing[member] {
+			s.app.logger.Warn(fmt.Sprintf("Dropping %d queued changes for a member that left the shard ring", len(entries)), zap.String("member", member))
+			if s.stale[member] == nil {
+				s.stale[member] = make(map[string]bool)
+			}
+			for _, e := range entries {
+				s.stale[member][string(e.Key)] = true
+			}
+			delete(s.queued, member)
+			continue
+		}
+		pending[member] = entries
+	}
+	s.queueMu.Unlock()
+
+	for _, member := range sortedMembers(pending) {
+		// A member that rejects entries will never take them, so they aren't kept.
+		if err := s.send(member, pending[member]); err != nil && status.Code(err) != codes.InvalidArgument {
+			s.app.logger.Warn("Resending queued changes: "+err.Error(), zap.String("member", member))
+			continue
+		}
+		s.queueMu.Lock()
+		if rest := s.queued[member][len(pending[member]):]; len(rest) > 0 {
+			s.queued[member] = rest
+		} else {
+			delete(s.queued, member)
+		}
+		s.queueMu.Unlock()
+	}
+
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	s.resending = len(s.queued) > 0
+	if s.resending {
+		time.AfterFunc(shardRetryDelay, s.resend)
+	}
+}
+
+// writePartialCommitError answers a change that was applied, but not yet on every owner of its
+// keys, returning false if err isn't ErrPartialCommit. The change will reach the other owners once
+// they can be reached again.
+func (a *application) writePartialCommitError(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, ErrPartialCommit) {
+		return false
+	}
+	a.logger.Warn(err.Error())
+	w.WriteHeader(202)
+	w.Write([]byte(`{"ok":true,"errors":["Applied, but not yet on every copy of the key; the rest will follow"],"data":{}}`))
+	return true
+}
+
+// send applies entries on another member through its WAL gRPC service, waiting for each of them
+// to be acknowledged. Entries are sent in streams of up to maxShardTransfer.
+func (s *sharder) send(member string, entries []wal.WalEntry) error {
+	p, ok := s.app.cluster.getPeer(member)
+	if !ok || p.RpcAddr == "" {
+		return fmt.Errorf("%s isn't a known cluster member", member)
+	}
+	conn, err := s.conn(p.RpcAddr)
+	if err != nil {
+		return err
+	}
+	client := api.NewWalClient(conn)
+	for start := 0; start < len(entries); start += maxShardTransfer {
+		end := start + maxShardTransfer
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if err = sendStream(client, entries[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendStream(client api.WalClient, entries []wal.WalEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shardRequestTimeout)
+	defer cancel()
+	stream, err := client.LogEntryStream(ctx)
+	if err != nil {
+		return err
+	}
+	// Acknowledgements are read while entries are still being sent, so that neither side stalls
+	// waiting for the other to read.
+	acked := make(chan error, 1)
+	go func() {
+		for x := 0; x < len(entries); x++ {
+			if _, err := stream.Recv(); err != nil {
+				acked <- err
+				return
+			}
+		}
+		acked <- nil
+	}()
+	for _, e := range entries {
+		err = stream.Send(&api.LogEntryRequest{
+			Entry: &api.WalEntry{
+				Key:     e.Key,
+				Pattern: e.Pattern,
+				Action:  uint32(e.Action),
+			},
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	// io.EOF means the other end gave up on the stream, and Recv has the reason why.
+	if err != nil && err != io.EOF {
+		cancel()
+		<-acked
+		return err
+	}
+	return <-acked
+}
+
+// conn returns a connection to the WAL gRPC service at addr, dialling it the first time.
+func (s *sharder) conn(addr string) (*grpc.ClientConn, error) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if conn, ok := s.conns[addr]; ok {
+		return conn, nil
+	}
+	creds, err := s.app.rpcDialOption()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(addr, creds)
+	if err != nil {
+		return nil, err
+	}
+	s.conns[addr] = conn
+	return conn, nil
+}
+
+// close closes every connection to another member.
+func (s *sharder) close() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	for addr, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, addr)
+	}
+}
+
+// shardReply is what a member answered to a scattered match.
+type shardReply struct {
+	member  string
+	results []batchMatchResult
+	err     error
+}
+
+// match matches events against the keys held here, and against those held by enough other members
+// to reach a copy of every key, merging the keys that come back. Only keys a member owns under the
+// current ring are taken from it: a member can still hold keys it no longer owns (until it drops
+// them after a rebalance), and those may be out of date. A member that can't be reached is
+// replaced by other owners of its keys; if some keys have no owner left to ask,
+// ErrShardUnavailable is returned. Events that can't be matched here aren't sent anywhere else.
+func (s *sharder) match(g *matcherGeneration, events [][]byte) ([]batchMatchResult, error) {
+	ring := s.currentRing()
+	results := make([]batchMatchResult, len(events))
+	seen := make([]map[string]bool, len(events))
+	valid := make([]int, 0, len(events))
+	for idx, evt := range events {
+		results[idx] = matchEvent(g, idx, evt)
+		if !results[idx].Ok {
+			continue
+		}
+		seen[idx] = make(map[string]bool)
+		owned := make([]string, 0, len(*results[idx].Matches))
+		for _, k := range *results[idx].Matches {
+			if ring.Owns(s.self, k) {
+				seen[idx][k] = true
+				owned = append(owned, k)
+			}
+		}
+		results[idx].Matches = &owned
+		valid = append(valid, idx)
+	}
+	if len(valid) == 0 || len(ring.Members()) == 1 {
+		return results, nil
+	}
+
+	// Other members are sent the events as a JSON array, which (unlike NDJSON) doesn't care how
+	// each event is laid out.
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for x, idx := range valid {
+		if x > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(events[idx])
+	}
+	body.WriteByte(']')
+
+	asked := map[string]bool{s.self: true}
+	done := []string{s.self}
+	exclude := make(map[string]bool)
+	for {
+		cover, ok := ring.Cover(done, exclude)
+		if !ok {
+			return results, ErrShardUnavailable
+		}
+		pending := make([]string, 0, len(cover))
+		for _, m := range cover {
+			if !asked[m] {
+				asked[m] = true
+				pending = append(pending, m)
+			}
+		}
+		if len(pending) == 0 {
+			return results, nil
+		}
+		replies := make(chan shardReply, len(pending))
+		for _, m := range pending {
+			go func(member string) {
+				res, err := s.remoteMatch(member, body.Bytes())
+				replies <- shardReply{member: member, results: res, err: err}
+			}(m)
+		}
+		for range pending {
+			rep := <-replies
+			if rep.err != nil {
+				s.app.logger.Warn("Matching on another shard: "+rep.err.Error(), zap.String("member", rep.member))
+				exclude[rep.member] = true
+				continue
+			}
+			done = append(done, rep.member)
+			for _, res := range rep.results {
+				if res.Index < 0 || res.Index >= len(valid) || !res.Ok || res.Matches == nil {
+					continue
+				}
+				idx := valid[res.Index]
+				for _, k := range *res.Matches {
+					if !seen[idx][k] && ring.Owns(rep.member, k) {
+						seen[idx][k] = true
+						*results[idx].Matches = append(*results[idx].Matches, k)
+					}
+				}
+			}
+		}
+	}
+}
+
+// remoteMatch sends a JSON array of events to another member's batch match endpoint, asking it to
+// only match against the keys it holds.
+func (s *sharder) remoteMatch(member string, body []byte) ([]batchMatchResult, error) {
+	p, ok := s.app.cluster.getPeer(member)
+	if !ok || p.MatchAddr == "" {
+		return nil, fmt.Errorf("%s isn't a known cluster member", member)
+	}
+	url := s.scheme + "://" + p.MatchAddr + "/api/v1/match/batch?" + localMatchParam + "=true"
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(member + " answered " + strconv.Itoa(resp.StatusCode))
+	}
+	var results []batchMatchResult
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var res batchMatchResult
+		if err = dec.Decode(&res); err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+}
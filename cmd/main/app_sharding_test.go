@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"github.com/highgrav/munchkin/internal/wal"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestSharder shards a test application's keys over a fixed ring of members.
+func newTestSharder(a *application, self string, members []string, replicas int) *sharder {
+	a.sharder = &sharder{
+		app:         a,
+		self:        self,
+		replicas:    replicas,
+		scheme:      "http",
+		adminScheme: "http",
+		client:      http.DefaultClient,
+		changed:     make(chan struct{}, 1),
+		ring:        cluster.NewHashRing(members, cluster.DefaultVnodes, replicas),
+		queued:      make(map[string][]wal.WalEntry),
+		stale:       make(map[string]map[string]bool),
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+	return a.sharder
+}
+
+// ownedKey returns the first key after skip keys that the ring gives to member.
+func ownedKey(ring *cluster.HashRing, member string, skip int) string {
+	for x := 0; ; x++ {
+		key := fmt.Sprintf("key-%d", x)
+		if ring.Owns(member, key) {
+			if skip == 0 {
+				return key
+			}
+			skip--
+		}
+	}
+}
+
+// serveWal serves an application's WAL gRPC service on a local port, with its cluster API TLS
+// settings, returning its address.
+func serveWal(t *testing.T, a *application) string {
+	t.Helper()
+	var err error
+	a.walServer, err = newWalServer(a, &walConfig{}, a.config.clusterServer)
+	if err != nil {
+		t.Fatal("newWalServer: " + err.Error())
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.walServer.server.Serve(lis)
+	t.Cleanup(a.walServer.server.Stop)
+	return lis.Addr().String()
+}
+
+func TestShardedMatchOnlyTakesOwnedKeys(t *testing.T) {
+	a := newTestApplication(t)
+	s := newTestSharder(a, "m1", []string{"m1", "m2"}, 1)
+	b := newTestApplication(t)
+	srv := httptest.NewServer(http.HandlerFunc(b.handleHttpPostMatchBatch))
+	defer srv.Close()
+	a.cluster.setPeer(&clusterPeer{Name: "m2", MatchAddr: strings.TrimPrefix(srv.URL, "http://"), Status: peerAlive})
+
+	// Each member still holds a key that now belongs to the other, which may be out of date.
+	ring := s.currentRing()
+	own1, stale1 := ownedKey(ring, "m1", 0), ownedKey(ring, "m2", 1)
+	own2, stale2 := ownedKey(ring, "m2", 0), ownedKey(ring, "m1", 1)
+	for _, k := range []string{own1, stale1} {
+		a.addRule(k, `{"sys":["filestore"]}`)
+	}
+	for _, k := range []string{own2, stale2} {
+		b.addRule(k, `{"sys":["filestore"]}`)
+	}
+
+	results, err := s.match(a.currentGeneration(), [][]byte{[]byte(`{"sys":"filestore"}`)})
+	if err != nil {
+		t.Fatal("match: " + err.Error())
+	}
+	matches := strings.Join(*results[0].Matches, ",")
+	if matches != own1+","+own2 {
+		t.Errorf("Expected matches %s,%s, got %s", own1, own2, matches)
+	}
+}
+
+func TestShardedCommitQueuesChangesForUnreachableOwners(t *testing.T) {
+	a := newTestApplication(t)
+	s := newTestSharder(a, "m1", []string{"m1", "m2"}, 2)
+	b := newTestApplication(t)
+
+	// m2 can't be reached yet, so the change is applied here and queued for it.
+	req := httptest.NewRequest("POST", "/api/admin/v1/add?key=first-test-key", strings.NewReader(`{"sys":["filestore"]}`))
+	w := httptest.NewRecorder()
+	a.handleHttpPostAddRule(w, req)
+	if w.Code != 202 {
+		t.Errorf("Expected 202 for a change not yet on every owner, got %d: %s", w.Code, w.Body.String())
+	}
+	if !a.hasKey("first-test-key") {
+		t.Error("The change wasn't applied here")
+	}
+	// Later changes for m2 queue up behind it, even once it can be reached.
+	a.cluster.setPeer(&clusterPeer{Name: "m2", RpcAddr: serveWal(t, b), Status: peerAlive})
+	_, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_DEL, "first-test-key", "-")})
+	if !errors.Is(err, ErrPartialCommit) {
+		t.Errorf("Expected ErrPartialCommit, got %v", err)
+	}
+	if q := s.status().Queued; q != 2 {
+		t.Errorf("Expected 2 queued changes, got %d", q)
+	}
+
+	s.resend()
+	if q := s.status().Queued; q != 0 {
+		t.Errorf("Expected the queue to be empty after resending, got %d", q)
+	}
+	if g := b.currentGeneration(); g.gen != 2 || b.hasKey("first-test-key") {
+		t.Errorf("Expected m2 to apply the add and then the delete, got generation %d", g.gen)
+	}
+
+	if _, err = a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	if !b.hasKey("second-test-key") {
+		t.Error("The change wasn't sent to m2")
+	}
+}
+
+func TestShardedCommitOverTLS(t *testing.T) {
+	rpc := writeTestCerts(t)
+	a := newTestApplication(t)
+	a.config.clusterServer = rpc
+	s := newTestSharder(a, "m1", []string{"m1", "m2"}, 2)
+	defer s.close()
+	b := newTestApplication(t)
+	b.config.clusterServer = rpc
+	a.cluster.setPeer(&clusterPeer{Name: "m2", RpcAddr: serveWal(t, b), Status: peerAlive})
+
+	if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)}); err != nil {
+		t.Fatal("commitEntries: " + err.Error())
+	}
+	if !b.hasKey("first-test-key") {
+		t.Error("The change wasn't sent to the other owner over TLS")
+	}
+}
+
+func TestShardedRestartTakesTheOtherOwnersKeys(t *testing.T) {
+	a := newTestApplication(t)
+	b := newTestApplication(t)
+	// While m1 was down, m2 deleted one key, changed another and added a third.
+	a.addRule("first-test-key", `{"sys":["filestore"]}`)
+	a.addRule("second-test-key", `{"sys":["filestore"]}`)
+	b.addRule("second-test-key", `{"sys":["authnz"]}`)
+	b.addRule("third-test-key", `{"sys":["filestore"]}`)
+	srv := httptest.NewServer(http.HandlerFunc(b.handleHttpGetExport))
+	defer srv.Close()
+	adminAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	s := newTestSharder(a, "m1", []string{"m1", "m2"}, 2)
+	a.cluster.setPeer(&clusterPeer{Name: "m2", Tags: map[string]string{cluster.TagAdminAddr: adminAddr}, Status: peerAlive})
+	if err := s.rebalance(); err != nil {
+		t.Fatal("rebalance: " + err.Error())
+	}
+	snap := a.currentGeneration().registry.Snapshot()
+	if _, ok := snap["first-test-key"]; ok {
+		t.Error("A key deleted while m1 was down came back")
+	}
+	if p := snap["second-test-key"]; len(p) != 1 || p[0] != `{"sys":["authnz"]}` {
+		t.Errorf("Expected m2's copy of a changed key, got %v", p)
+	}
+	if !a.hasKey("third-test-key") {
+		t.Error("A key added while m1 was down wasn't taken")
+	}
+	if b.hasKey("first-test-key") {
+		t.Error("A deleted key was sent back to m2")
+	}
+	if !s.status().Balanced {
+		t.Error("Expected the ring to be balanced")
+	}
+
+	// Keys aren't touched while none of their other owners can be reached, and are pulled again.
+	c := newTestApplication(t)
+	c.addRule("first-test-key", `{"sys":["filestore"]}`)
+	s = newTestSharder(c, "m1", []string{"m1", "m2"}, 2)
+	srv.Close()
+	c.cluster.setPeer(&clusterPeer{Name: "m2", Tags: map[string]string{cluster.TagAdminAddr: adminAddr}, Status: peerAlive})
+	if err := s.rebalance(); err == nil {
+		t.Error("Expected an error while m2 can't be reached")
+	}
+	if !c.hasKey("first-test-key") || s.status().Balanced {
+		t.Error("Expected the key to be kept until m2 can be reached")
+	}
+}
+
+func TestShardedMemberGetsKeysWhoseQueueWasDropped(t *testing.T) {
+	a := newTestApplication(t)
+	s := newTestSharder(a, "m1", []string{"m1", "m2"}, 2)
+	defer s.close()
+	both := s.currentRing()
+	s.balanced = both
+	b := newTestApplication(t)
+	b.addRule("second-test-key", `{"sys":["filestore"]}`)
+
+	// m2 can't be reached, so these changes are queued for it.
+	for _, e := range []wal.WalEntry{
+		newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`),
+		newWalEntry(wal.WAL_DEL, "second-test-key", "-"),
+	} {
+		if _, err := a.commitEntries([]wal.WalEntry{e}); !errors.Is(err, ErrPartialCommit) {
+			t.Fatalf("Expected ErrPartialCommit, got %v", err)
+		}
+	}
+	if q := s.status().QueuedFor["m2"]; q != 2 {
+		t.Errorf("Expected 2 changes queued for m2, got %d", q)
+	}
+
+	// m2 leaves the ring, so its queue is dropped, and comes back before a rebalance has run.
+	s.ring = cluster.NewHashRing([]string{"m1"}, cluster.DefaultVnodes, 2)
+	s.resend()
+	if q := s.status().Queued; q != 0 {
+		t.Errorf("Expected the queue to be dropped, got %d", q)
+	}
+	s.ring = both
+	a.cluster.setPeer(&clusterPeer{Name: "m2", RpcAddr: serveWal(t, b), Status: peerAlive})
+	if err := s.rebalance(); err != nil {
+		t.Fatal("rebalance: " + err.Error())
+	}
+	if !b.hasKey("first-test-key") || b.hasKey("second-test-key") {
+		t.Error("m2 wasn't sent the keys its dropped queue touched")
+	}
+	if len(s.stale) != 0 {
+		t.Errorf("Expected nothing left to send m2, got %v", s.stale)
+	}
+}
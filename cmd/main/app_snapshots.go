@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/snapshot"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSnapshotsDisabled is returned when a snapshot is requested but no snapshot directory is set.
+var ErrSnapshotsDisabled = errors.New("Snapshots are not configured")
+
+// loadSnapshot applies the newest valid snapshot to a registry and returns its timestamp, so that
+// WAL replay can skip everything the snapshot already covers. It returns 0 if there's no snapshot
+// to load.
+func (a *application) loadSnapshot(r *registry.Registry) (uint64, error) {
+	cfg := a.config.snapshots
+	if cfg.fileDirectory == "" {
+		return 0, nil
+	}
+	s, fileName, err := snapshot.LoadNewest(cfg.fileDirectory, cfg.filePrefix, a.config.walLoad.loadUntil, func(fileName string, err error) {
+		a.logger.Warn("Skipping unreadable snapshot",
+			zap.String("file", fileName),
+			zap.String("error", err.Error()))
+	})
+	if err == snapshot.ErrNoSnapshot {
+		a.logger.Info("No snapshot to load")
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	ct := 0
+	for key, patterns := range s.Keys {
+		for _, p := range patterns {
+			if err = a.applyEntry(r, wal.WAL_ADD, key, p); err != nil {
+				return 0, fmt.Errorf("%s: key %s: %w", fileName, key, err)
+			}
+			ct++
+		}
+	}
+	a.lastUpdatedOn = s.Timestamp
+	atomic.StoreUint64(&a.lastSnapshotTs, s.Timestamp)
+	a.logger.Info(fmt.Sprintf("Loaded %d patterns for %d keys from snapshot %s", ct, len(s.Keys), fileName))
+	return s.Timestamp, nil
+}
+
+// captureSnapshot copies the latest registry along with the timestamp of the last change applied
+// to it. Changes are applied under the write lock, so the two always agree.
+func (a *application) captureSnapshot() snapshot.Snapshot {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	return snapshot.Snapshot{
+		Timestamp: a.lastUpdatedOn,
+		Keys:      a.latest.registry.Snapshot(),
+	}
+}
+
+// writeSnapshot saves the current registry as a snapshot, prunes old snapshots, and lets the WAL
+// manager know which files the snapshot now covers. It returns the snapshot file and timestamp.
+func (a *application) writeSnapshot() (string, uint64, error) {
+	cfg := a.config.snapshots
+	if cfg.fileDirectory == "" {
+		return "", 0, ErrSnapshotsDisabled
+	}
+	a.snapshotMu.Lock()
+	defer a.snapshotMu.Unlock()
+
+	s := a.captureSnapshot()
+	fileName, err := snapshot.Write(cfg.fileDirectory, cfg.filePrefix, s)
+	if err != nil {
+		return fileName, s.Timestamp, err
+	}
+	atomic.StoreUint64(&a.lastSnapshotTs, s.Timestamp)
+	a.logger.Info("Wrote snapshot",
+		zap.String("file", fileName),
+		zap.Uint64("timestamp", s.Timestamp),
+		zap.Int("keys", len(s.Keys)))
+
+	if cfg.keep > 0 {
+		deleted, err := snapshot.Prune(cfg.fileDirectory, cfg.filePrefix, cfg.keep)
+		for _, f := range deleted {
+			a.logger.Info("Deleted old snapshot",
+				zap.String("file", f))
+		}
+		if err != nil {
+			a.logger.Error(err.Error())
+		}
+	}
+	if a.walFileMgr != nil {
+		a.walFileMgr.setSnapshotTimestamp(s.Timestamp)
+	}
+	return fileName, s.Timestamp, nil
+}
+
+// startSnapshots writes a snapshot on a schedule, if one is configured. Nothing is written if
+// there have been no changes since the last snapshot.
+func (a *application) startSnapshots() {
+	cfg := a.config.snapshots
+	if cfg.fileDirectory == "" || cfg.everySeconds < 1 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(cfg.everySeconds) * time.Second)
+		defer t.Stop()
+		for range t.C {
+			a.writeMu.Lock()
+			changed := a.lastUpdatedOn != atomic.LoadUint64(&a.lastSnapshotTs)
+			a.writeMu.Unlock()
+			if !changed {
+				continue
+			}
+			if _, _, err := a.writeSnapshot(); err != nil {
+				a.logger.Error(err.Error())
+			}
+		}
+	}()
+}
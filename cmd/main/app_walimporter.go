@@ -2,16 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
 	"github.com/highgrav/munchkin/internal/wal"
 	"go.uber.org/zap"
 	"os"
 	"path/filepath"
-	"quamina.net/go/quamina"
 	"sort"
 	"strings"
 )
 
-func (app *application) importWalFiles(quan *quamina.Quamina, dir, prefix string, logger *zap.Logger) (totalEntries int64, totalErrors int64, err error) {
+func (app *application) importWalFiles(r *registry.Registry, dir, prefix string, logger *zap.Logger) (totalEntries int64, totalErrors int64, err error) {
 	s, err := os.Stat(dir)
 	if err != nil {
 		return -1, -1, err
@@ -35,6 +36,10 @@ func (app *application) importWalFiles(quan *quamina.Quamina, dir, prefix string
 		return 0, 0, nil
 	}
 
+	var skipped int64
+	// Files are named for the local clock when they were created, but entries can carry
+	// timestamps from another server's clock, so whether an entry is already covered (by a
+	// snapshot) is decided entry by entry rather than by file name.
 	for _, fname := range files {
 		walf, err := wal.OpenWalFile(filepath.Join(dir, fname))
 		if err != nil {
@@ -49,33 +54,32 @@ func (app *application) importWalFiles(quan *quamina.Quamina, dir, prefix string
 				totalErrors++
 				continue
 			}
-			if walEntry.Timestamp >= app.lastUpdatedOn && len(walEntry.Key) > 0 && len(walEntry.Pattern) > 0 && walEntry.Action == wal.WAL_ADD {
-				err = quan.AddPattern(string(walEntry.Key), string(walEntry.Pattern))
-				if err != nil {
-					logger.Error("quan.AddPattern: " + err.Error())
-					totalErrors++
-					continue
-				}
-				app.lastUpdatedOn = walEntry.Timestamp
-				totalEntries++
+			if walEntry.Timestamp < app.lastUpdatedOn || len(walEntry.Key) == 0 {
 				continue
-			} else if walEntry.Timestamp >= app.lastUpdatedOn && len(walEntry.Key) > 0 && len(walEntry.Pattern) <= 1 && walEntry.Action == wal.WAL_DEL {
-				err = quan.DeletePatterns(string(walEntry.Key))
-
-				if err != nil {
-					logger.Error("quan.DeletePatterns: " + err.Error())
-					totalErrors++
-					continue
-				}
-				app.lastUpdatedOn = walEntry.Timestamp
-				totalEntries++
+			}
+			// Entries aren't guaranteed to be in order across files, so keep reading past any
+			// that are after the cutoff.
+			if until := app.config.walLoad.loadUntil; until > 0 && walEntry.Timestamp > until {
+				skipped++
 				continue
-			} else {
-				// TODO -- Once we can delete matching patterns from a key we'll handle this with a Pattern length > 1 check
 			}
+			if walEntry.Action == wal.WAL_ADD && len(walEntry.Pattern) == 0 {
+				continue
+			}
+			err = app.applyEntry(r, walEntry.Action, string(walEntry.Key), string(walEntry.Pattern))
+			if err != nil {
+				logger.Error("app.applyEntry: " + err.Error())
+				totalErrors++
+				continue
+			}
+			app.lastUpdatedOn = walEntry.Timestamp
+			totalEntries++
 		}
 		walf.Close()
 	}
+	if skipped > 0 {
+		logger.Info(fmt.Sprintf("Skipped %d entries after %d", skipped, app.config.walLoad.loadUntil))
+	}
 
 	return totalEntries, totalErrors, nil
 }
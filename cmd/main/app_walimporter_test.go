@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/wal"
+	"testing"
+)
+
+func TestImportReplaysPatternDeletes(t *testing.T) {
+	walDir := t.TempDir()
+	writeTestWal(t, walDir,
+		stampedEntry(100, wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`),
+		stampedEntry(200, wal.WAL_ADD, "first-test-key", `{"evt":["file-created"]}`),
+		stampedEntry(300, wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`))
+	writeTestWal(t, walDir,
+		stampedEntry(400, wal.WAL_DEL, "first-test-key", `{ "sys": [ "filestore" ] }`),
+		stampedEntry(500, wal.WAL_DEL, "second-test-key", `{"sys":["authnz"]}`))
+
+	a := newTestApplication(t)
+	a.config.walLoad.fileDirectory = walDir
+	a.config.walLoad.filePrefix = "mwal-"
+	a.loadWalFiles()
+
+	g := a.currentGeneration()
+	if pats := g.registry.Patterns("first-test-key"); len(pats) != 1 {
+		t.Errorf("Expected 1 pattern left on first-test-key, got %v", pats)
+	}
+	if g.registry.HasKey("second-test-key") {
+		t.Error("Expected deleting second-test-key's only pattern to remove the key")
+	}
+	if keys := matchKeys(t, g, `{"sys":"filestore","evt":"file-created"}`); len(keys) != 1 || keys[0] != "first-test-key" {
+		t.Errorf("Expected only the remaining pattern to match, got %v", keys)
+	}
+	if a.lastUpdatedOn != 500 {
+		t.Errorf("Expected lastUpdatedOn 500, got %d", a.lastUpdatedOn)
+	}
+}
+
+func TestImportSkipsEntriesNotFiles(t *testing.T) {
+	// The files are named for a local clock well behind the one the entries were stamped by.
+	walDir := t.TempDir()
+	for x, entries := range [][]wal.WalEntry{
+		{stampedEntry(900, wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`),
+			stampedEntry(1100, wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`)},
+		{stampedEntry(1200, wal.WAL_ADD, "third-test-key", `{"sys":["infra"]}`)},
+	} {
+		fileName, err := wal.CreateWalFileAt(walDir, "mwal-", int64(500+x*100))
+		if err != nil {
+			t.Fatal("wal.CreateWalFileAt: " + err.Error())
+		}
+		wf, err := wal.OpenWalFile(fileName)
+		if err != nil {
+			t.Fatal("wal.OpenWalFile: " + err.Error())
+		}
+		if err = wf.Append(entries); err != nil {
+			t.Fatal("wal.Append: " + err.Error())
+		}
+		wf.Close()
+	}
+
+	// As if a snapshot covered everything up to 1000.
+	a := newTestApplication(t)
+	a.lastUpdatedOn = 1000
+	r := registry.New()
+	loaded, failed, err := a.importWalFiles(r, walDir, "mwal-", a.logger)
+	if err != nil {
+		t.Fatal("importWalFiles: " + err.Error())
+	}
+	if loaded != 2 || failed != 0 {
+		t.Errorf("Expected 2 entries loaded and none failed, got %d and %d", loaded, failed)
+	}
+	if r.HasKey("first-test-key") || !r.HasKey("second-test-key") || !r.HasKey("third-test-key") {
+		t.Errorf("Expected only the entries after 1000 to be loaded, got %v", r.Snapshot())
+	}
+}
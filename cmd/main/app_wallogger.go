@@ -1,16 +1,30 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
+)
 
+// loadWalFiles loads the newest snapshot and replays the WAL into a single generation, so the
+// matcher is only built once however many entries there are.
 func (a *application) loadWalFiles() {
-	if a.config.walLoad.fileDirectory != "" {
-		totalLoaded, totalErrored, err := a.importWalFiles(a.matcher, a.config.walLoad.fileDirectory, a.config.walLoad.filePrefix, a.logger)
+	_, err := a.mutate(func(r *registry.Registry) error {
+		if _, err := a.loadSnapshot(r); err != nil {
+			return err
+		}
+		if a.config.walLoad.fileDirectory == "" {
+			a.logger.Info("No WAL load parameters specified")
+			return nil
+		}
+		totalLoaded, totalErrored, err := a.importWalFiles(r, a.config.walLoad.fileDirectory, a.config.walLoad.filePrefix, a.logger)
 		if err != nil {
-			a.logger.Fatal(err.Error())
+			return err
 		}
 		a.logger.Info(fmt.Sprintf("Loaded %d entries, %d failed\n", totalLoaded, totalErrored))
-	} else {
-		a.logger.Info("No WAL load parameters specified")
+		return nil
+	})
+	if err != nil {
+		a.logger.Fatal(err.Error())
 	}
 }
 
@@ -20,7 +34,7 @@ func (a *application) newWalLogger() {
 		return
 	}
 	a.config.writeWalFiles = true
-	wfm, err := newWalFileManager(a, a.config.walWrite.fileDirectory, a.config.walWrite.filePrefix, a.config.walWrite.maxEntriesPerFile)
+	wfm, err := newWalFileManager(a, a.config.walWrite)
 	if err != nil {
 		a.logger.Fatal(err.Error())
 	}
@@ -1,79 +1,362 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/highgrav/munchkin/internal/wal"
-	"go.uber.org/zap"
 	"sync"
 	"time"
 )
 
+// fsyncPolicy controls when WAL writes are synced to disk, and so when a write is acknowledged.
+type fsyncPolicy int
+
+const (
+	// fsyncAlways syncs after every batch of writes, and acknowledges a write once it is synced.
+	fsyncAlways fsyncPolicy = iota
+	// fsyncInterval syncs on a timer, and acknowledges a write at the first sync after it.
+	fsyncInterval
+	// fsyncOS leaves syncing to the operating system, and acknowledges a write once it has been
+	// handed to the OS.
+	fsyncOS
+)
+
+const (
+	// maxWalBatch is the most write requests that will be grouped into a single write.
+	maxWalBatch = 256
+	// walRecordOverhead is the most space a WAL record takes beyond its key and pattern.
+	walRecordOverhead = 28
+)
+
+var ErrWalClosed = errors.New("WAL writer is closed")
+
+func parseFsyncPolicy(s string) (fsyncPolicy, error) {
+	switch s {
+	case "always":
+		return fsyncAlways, nil
+	case "interval":
+		return fsyncInterval, nil
+	case "os":
+		return fsyncOS, nil
+	}
+	return fsyncAlways, fmt.Errorf("unknown fsync policy \"%s\" (expected always, interval or os)", s)
+}
+
+// walWriteRequest is a group of entries to be written together, along with the channel that
+// is told once they are durable.
+type walWriteRequest struct {
+	entries []wal.WalEntry
+	done    chan error
+}
+
+// walFileManager owns the WAL file being written to. Entries are handed to a single writer
+// goroutine over a channel, so they are written in the order they were submitted; whatever has
+// queued up while a write was in progress is written and synced together.
 type walFileManager struct {
 	app               *application
 	dir               string
 	currFilePath      string
 	filePrefix        string
 	file              *wal.WalFile
+	fileOpenedAt      time.Time
 	maxEntries        int
 	maxDuration       time.Duration
-	mu                sync.Mutex
+	maxBytes          int64
+	policy            fsyncPolicy
+	syncEvery         time.Duration
+	retention         walRetentionPolicy
+	snapshotTs        uint64 // accessed atomically
+	requests          chan *walWriteRequest
+	pending           []*walWriteRequest
+	rotated           chan struct{}
+	stopped           chan struct{}
+	quit              chan struct{}
+	mu                sync.RWMutex
+	pathMu            sync.RWMutex
+	subMu             sync.Mutex
+	subscribers       map[*walSubscription]struct{}
+	published         walPosition
+	isClosed          bool
 	totalLogEntries   uint64
 	currentLogEntries int64
 }
 
-func newWalFileManager(app *application, dir, prefix string, maxEntriesPerFile int) (*walFileManager, error) {
-	wfm := &walFileManager{
-		app:        app,
-		dir:        dir,
-		filePrefix: prefix,
-		maxEntries: maxEntriesPerFile,
-	}
-	cfp, err := wal.CreateWalFile(wfm.dir, wfm.filePrefix)
+func newWalFileManager(app *application, cfg walFileConfig) (*walFileManager, error) {
+	policy, err := parseFsyncPolicy(cfg.fsyncPolicy)
 	if err != nil {
 		return nil, err
 	}
-	wfm.currFilePath = cfp
-	wf, err := wal.OpenWalFile(wfm.currFilePath)
-	if err != nil {
+	if policy == fsyncInterval && cfg.fsyncIntervalMs < 1 {
+		return nil, errors.New("the WAL fsync interval must be at least 1ms")
+	}
+	wfm := &walFileManager{
+		app:         app,
+		dir:         cfg.fileDirectory,
+		filePrefix:  cfg.filePrefix,
+		maxEntries:  cfg.maxEntriesPerFile,
+		maxDuration: time.Duration(cfg.maxDurationPerFileInSeconds) * time.Second,
+		maxBytes:    cfg.maxBytesPerFile,
+		policy:      policy,
+		syncEvery:   time.Duration(cfg.fsyncIntervalMs) * time.Millisecond,
+		retention: walRetentionPolicy{
+			maxFiles:         cfg.retainFiles,
+			maxAge:           time.Duration(cfg.retainSeconds) * time.Second,
+			untilSnapshotted: cfg.retainUntilSnapshot,
+		},
+		requests:    make(chan *walWriteRequest, maxWalBatch),
+		rotated:     make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+		quit:        make(chan struct{}),
+		subscribers: make(map[*walSubscription]struct{}),
+	}
+	if err = wfm.openNewFile(); err != nil {
 		return nil, err
 	}
-	wfm.file = wf
+	wfm.published = walPosition{file: wfm.currFilePath, offset: wfm.file.Size()}
+	go wfm.run()
+	if wfm.retention.enabled() {
+		go wfm.runRetention()
+	}
 	app.logger.Info(fmt.Sprintf("Writing WAL files to %s\n", wfm.dir))
 	return wfm, nil
 }
 
-func (wfm *walFileManager) rotateWalFile() error {
-	wfm.mu.Lock()
-	defer wfm.mu.Unlock()
-	wfm.file.Close()
+func (wfm *walFileManager) openNewFile() error {
 	cfp, err := wal.CreateWalFile(wfm.dir, wfm.filePrefix)
 	if err != nil {
 		return err
 	}
-	wfm.currFilePath = cfp
-	wf, err := wal.OpenWalFile(wfm.currFilePath)
+	wf, err := wal.OpenWalFile(cfp)
 	if err != nil {
 		return err
 	}
+	wfm.pathMu.Lock()
+	wfm.currFilePath = cfp
+	wfm.pathMu.Unlock()
 	wfm.file = wf
+	wfm.fileOpenedAt = time.Now()
+	wfm.currentLogEntries = 0
 	return nil
 }
 
-func (wfm *walFileManager) writeWalFileEntry(timestamp int64, key, pattern string, action uint16, logger *zap.Logger) {
-	if wfm.currentLogEntries >= int64(wfm.maxEntries) {
-		err := wfm.rotateWalFile()
+// rotateWalFile closes the current file, which syncs it, and starts a new one. It is only called
+// from the writer goroutine.
+func (wfm *walFileManager) rotateWalFile() error {
+	wfm.file.Close()
+	if err := wfm.openNewFile(); err != nil {
+		return err
+	}
+	// Let the retention goroutine know there's a newly closed file to consider.
+	select {
+	case wfm.rotated <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// needsRotation reports whether the current file is full, or would be over its size limit once
+// the given number of bytes is written to it. Empty files are never rotated.
+func (wfm *walFileManager) needsRotation(pendingBytes int64) bool {
+	if wfm.currentLogEntries == 0 {
+		return false
+	}
+	if wfm.maxEntries > 0 && wfm.currentLogEntries >= int64(wfm.maxEntries) {
+		return true
+	}
+	if wfm.maxBytes > 0 && wfm.file.Size()+pendingBytes > wfm.maxBytes {
+		return true
+	}
+	return wfm.maxDuration > 0 && time.Since(wfm.fileOpenedAt) >= wfm.maxDuration
+}
+
+// currentFile returns the path of the file being written to.
+func (wfm *walFileManager) currentFile() string {
+	wfm.pathMu.RLock()
+	defer wfm.pathMu.RUnlock()
+	return wfm.currFilePath
+}
+
+// submit queues entries to be written, in order and without anything interleaved. The returned
+// channel receives nil once the entries are as durable as the fsync policy requires, or the error
+// that stopped them from being written.
+func (wfm *walFileManager) submit(entries []wal.WalEntry) <-chan error {
+	req := &walWriteRequest{
+		entries: entries,
+		done:    make(chan error, 1),
+	}
+	wfm.mu.RLock()
+	defer wfm.mu.RUnlock()
+	if wfm.isClosed {
+		req.done <- ErrWalClosed
+		return req.done
+	}
+	wfm.requests <- req
+	return req.done
+}
+
+// writeWalFileEntry writes a single entry and waits until it is durable.
+func (wfm *walFileManager) writeWalFileEntry(timestamp int64, key, pattern string, action uint16) error {
+	return <-wfm.submit([]wal.WalEntry{{
+		Timestamp: uint64(timestamp),
+		Key:       []byte(key),
+		Pattern:   []byte(pattern),
+		Action:    action,
+	}})
+}
+
+// run is the writer goroutine. It exits once the request channel is closed and drained.
+func (wfm *walFileManager) run() {
+	defer close(wfm.stopped)
+	var tick, rotateTick <-chan time.Time
+	if wfm.policy == fsyncInterval {
+		t := time.NewTicker(wfm.syncEvery)
+		defer t.Stop()
+		tick = t.C
+	}
+	if wfm.maxDuration > 0 {
+		// Check often enough that a file is rotated within a few percent of its maximum age,
+		// even if nothing is being written to it.
+		t := time.NewTicker(wfm.maxDuration / 20)
+		defer t.Stop()
+		rotateTick = t.C
+	}
+	for {
+		select {
+		case req, ok := <-wfm.requests:
+			if !ok {
+				wfm.syncPending()
+				return
+			}
+			batch := []*walWriteRequest{req}
+			// Pick up anything else that is already waiting, so that it shares this write.
+		drain:
+			for len(batch) < maxWalBatch {
+				select {
+				case r, ok := <-wfm.requests:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, r)
+				default:
+					break drain
+				}
+			}
+			wfm.writeBatch(batch)
+		case <-tick:
+			wfm.syncPending()
+		case <-rotateTick:
+			if wfm.needsRotation(0) {
+				// Anything waiting on a sync is covered by closing the file.
+				wfm.syncPending()
+				if err := wfm.rotateWalFile(); err != nil {
+					wfm.app.logger.Fatal(err.Error())
+				}
+			}
+		}
+	}
+}
+
+// writeBatch writes a batch of requests, rotating files as they fill up, acknowledges the
+// requests according to the fsync policy, and publishes the entries to subscribers.
+func (wfm *walFileManager) writeBatch(batch []*walWriteRequest) {
+	var buf []wal.WalEntry
+	var bufBytes int64
+	var published []walPublishedEntry
+	written := 0
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		if err := wfm.file.Append(buf); err != nil {
+			return err
+		}
+		file := wfm.currentFile()
+		for _, e := range buf {
+			published = append(published, walPublishedEntry{file: file, entry: e})
+		}
+		wfm.totalLogEntries += uint64(len(buf))
+		buf = buf[:0]
+		bufBytes = 0
+		return nil
+	}
+	for _, req := range batch {
+		var err error
+		for _, e := range req.entries {
+			// Framing and fixed fields take up to walRecordOverhead bytes per record.
+			entryBytes := int64(len(e.Key)+len(e.Pattern)) + walRecordOverhead
+			if wfm.needsRotation(bufBytes + entryBytes) {
+				if err = flush(); err != nil {
+					break
+				}
+				if err = wfm.rotateWalFile(); err != nil {
+					wfm.app.logger.Fatal(err.Error())
+				}
+			}
+			buf = append(buf, e)
+			bufBytes += entryBytes
+			wfm.currentLogEntries++
+		}
+		if err == nil {
+			err = flush()
+		}
 		if err != nil {
-			logger.Fatal(err.Error())
+			wfm.app.logger.Error(err.Error())
+			buf = buf[:0]
+			bufBytes = 0
+			// The request's entries may be partly written; anything queued behind it is still
+			// written, since it was applied after it.
+			req.done <- err
+			continue
 		}
+		batch[written] = req
+		written++
 	}
-	err := wfm.file.Write(timestamp, []byte(key), []byte(pattern), action)
+	batch = batch[:written]
+
+	switch wfm.policy {
+	case fsyncAlways:
+		wfm.pending = append(wfm.pending, batch...)
+		wfm.syncPending()
+	case fsyncInterval:
+		wfm.pending = append(wfm.pending, batch...)
+	default:
+		for _, req := range batch {
+			req.done <- nil
+		}
+	}
+	if len(published) > 0 {
+		wfm.publish(published)
+	}
+}
+
+// syncPending syncs the current file and acknowledges every request waiting on it.
+func (wfm *walFileManager) syncPending() {
+	if len(wfm.pending) == 0 {
+		return
+	}
+	err := wfm.file.Sync()
 	if err != nil {
-		logger.Error(err.Error())
+		wfm.app.logger.Error(err.Error())
+	}
+	for _, req := range wfm.pending {
+		req.done <- err
 	}
-	wfm.totalLogEntries++
-	wfm.currentLogEntries++
+	wfm.pending = wfm.pending[:0]
 }
 
+// closeWalFile stops accepting writes, waits for everything already submitted to be written and
+// synced, and closes the current file.
 func (wfm *walFileManager) closeWalFile() {
+	wfm.mu.Lock()
+	if wfm.isClosed {
+		wfm.mu.Unlock()
+		return
+	}
+	wfm.isClosed = true
+	close(wfm.requests)
+	close(wfm.quit)
+	wfm.mu.Unlock()
+	<-wfm.stopped
+	wfm.closeSubscribers()
 	wfm.file.Close()
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/wal"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newHeldWalManager returns a WAL manager with no writer goroutine, so that a test can acknowledge
+// (or fail) each write request itself.
+func newHeldWalManager(a *application) *walFileManager {
+	wfm := &walFileManager{
+		app:      a,
+		requests: make(chan *walWriteRequest, maxWalBatch),
+	}
+	a.config.writeWalFiles = true
+	a.walFileMgr = wfm
+	return wfm
+}
+
+// nextRequest waits for the next write request to reach the WAL manager.
+func nextRequest(t *testing.T, wfm *walFileManager) *walWriteRequest {
+	t.Helper()
+	select {
+	case req := <-wfm.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a WAL write")
+		return nil
+	}
+}
+
+func TestGenerationPublishedOnceDurable(t *testing.T) {
+	a := newTestApplication(t)
+	wfm := newHeldWalManager(a)
+
+	type result struct {
+		gen uint64
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		gen, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)})
+		results <- result{gen, err}
+	}()
+	req := nextRequest(t, wfm)
+	// The change has been built and queued, but mustn't be visible until the write is durable.
+	if g := a.currentGeneration(); g.gen != 0 || g.registry.HasKey("first-test-key") {
+		t.Errorf("Generation %d was published before its WAL write was durable", g.gen)
+	}
+	req.done <- nil
+	res := <-results
+	if res.err != nil || res.gen != 1 {
+		t.Fatalf("Expected generation 1 and no error, got %d, %v", res.gen, res.err)
+	}
+	if g := a.currentGeneration(); g.gen != 1 || !g.registry.HasKey("first-test-key") {
+		t.Errorf("Expected generation 1 with first-test-key to be published, got %d", g.gen)
+	}
+
+	// A write that fails is still published, but reported as not logged.
+	go func() {
+		gen, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "second-test-key", `{"sys":["authnz"]}`)})
+		results <- result{gen, err}
+	}()
+	req = nextRequest(t, wfm)
+	req.done <- errors.New("disk full")
+	res = <-results
+	if !errors.Is(res.err, ErrNotLogged) || res.gen != 2 {
+		t.Errorf("Expected generation 2 and ErrNotLogged, got %d, %v", res.gen, res.err)
+	}
+	if g := a.currentGeneration(); g.gen != 2 || !g.registry.HasKey("second-test-key") {
+		t.Errorf("Expected generation 2 with second-test-key to be published, got %d", g.gen)
+	}
+}
+
+func TestUnloggedChangeWaitsForEarlierWrites(t *testing.T) {
+	a := newTestApplication(t)
+	wfm := newHeldWalManager(a)
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)})
+		done <- err
+	}()
+	logged := nextRequest(t, wfm)
+	go func() {
+		a.addRule("second-test-key", `{"sys":["authnz"]}`)
+		done <- nil
+	}()
+	// The unlogged change includes the logged one, so it waits behind it with an empty write.
+	barrier := nextRequest(t, wfm)
+	if len(barrier.entries) != 0 {
+		t.Errorf("Expected an empty write, got %d entries", len(barrier.entries))
+	}
+	if g := a.currentGeneration(); g.gen != 0 {
+		t.Errorf("Generation %d was published before the write it includes was durable", g.gen)
+	}
+	logged.done <- nil
+	barrier.done <- nil
+	for x := 0; x < 2; x++ {
+		if err := <-done; err != nil {
+			t.Error(err.Error())
+		}
+	}
+	if g := a.currentGeneration(); g.gen != 2 || g.registry.Len() != 2 {
+		t.Errorf("Expected generation 2 with both keys, got %d with %d keys", g.gen, g.registry.Len())
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	a := newTestApplication(t)
+	dir := t.TempDir()
+	wfm, err := newWalFileManager(a, walFileConfig{
+		fileDirectory: dir,
+		filePrefix:    "mwal-",
+		fsyncPolicy:   "always",
+	})
+	if err != nil {
+		t.Fatal("newWalFileManager: " + err.Error())
+	}
+	a.config.writeWalFiles = true
+	a.walFileMgr = wfm
+
+	const writers = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for x := 0; x < writers; x++ {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%02d", x)
+			if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, key, `{"sys":["filestore"]}`)}); err != nil {
+				errs <- err
+			}
+		}(x)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err.Error())
+	}
+	if g := a.currentGeneration(); g.gen != writers || g.registry.Len() != writers {
+		t.Errorf("Expected generation %d with %d keys, got %d with %d", writers, writers, g.gen, g.registry.Len())
+	}
+	path := wfm.currentFile()
+	wfm.closeWalFile()
+
+	wf, err := wal.OpenWalFileReadOnly(path)
+	if err != nil {
+		t.Fatal("wal.OpenWalFileReadOnly: " + err.Error())
+	}
+	defer wf.Close()
+	var ct int
+	var last uint64
+	for wf.HasNext() {
+		e, err := wf.Next()
+		if err != nil {
+			t.Fatal("wal.Next: " + err.Error())
+		}
+		if e.Timestamp <= last {
+			t.Errorf("Entry %d has timestamp %d, not after %d", ct, e.Timestamp, last)
+		}
+		last = e.Timestamp
+		ct++
+	}
+	if ct != writers {
+		t.Errorf("Expected %d logged entries, got %d", writers, ct)
+	}
+}
+
+func TestNeedsRotation(t *testing.T) {
+	fileName, err := wal.CreateWalFile(t.TempDir(), "mwal-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	wf, err := wal.OpenWalFile(fileName)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wf.Close()
+	if err = wf.Append([]wal.WalEntry{stampedEntry(100, wal.WAL_ADD, "first-test-key", `{"sys":["filestore"]}`)}); err != nil {
+		t.Fatal("wal.Append: " + err.Error())
+	}
+	size := wf.Size()
+
+	tests := []struct {
+		name        string
+		entries     int64
+		maxEntries  int
+		maxBytes    int64
+		maxDuration time.Duration
+		openedFor   time.Duration
+		pending     int64
+		rotate      bool
+	}{
+		{"no limits", 1, 0, 0, 0, time.Hour, 100, false},
+		{"an empty file is never rotated", 0, 1, 1, time.Second, time.Hour, 100, false},
+		{"below the entry limit", 1, 2, 0, 0, 0, 0, false},
+		{"at the entry limit", 2, 2, 0, 0, 0, 0, true},
+		{"write fits within the size limit", 1, 0, size + 100, 0, 0, 100, false},
+		{"write would pass the size limit", 1, 0, size + 100, 0, 0, 101, true},
+		{"file already past the size limit", 1, 0, size - 1, 0, 0, 0, true},
+		{"open for less than the duration", 1, 0, 0, time.Minute, time.Second, 0, false},
+		{"open for the duration", 1, 0, 0, time.Minute, time.Minute, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wfm := &walFileManager{
+				file:              wf,
+				fileOpenedAt:      time.Now().Add(-tt.openedFor),
+				maxEntries:        tt.maxEntries,
+				maxBytes:          tt.maxBytes,
+				maxDuration:       tt.maxDuration,
+				currentLogEntries: tt.entries,
+			}
+			if got := wfm.needsRotation(tt.pending); got != tt.rotate {
+				t.Errorf("Expected needsRotation(%d) to be %v, got %v", tt.pending, tt.rotate, got)
+			}
+		})
+	}
+}
+
+func TestWalRotation(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   walFileConfig
+		pause time.Duration
+		files int
+	}{
+		{"entry count", walFileConfig{maxEntriesPerFile: 2}, 0, 2},
+		// The header alone is over the limit, and an empty file is never rotated, so each file
+		// takes a single entry.
+		{"size", walFileConfig{maxBytesPerFile: 40}, 0, 3},
+		{"duration", walFileConfig{maxDurationPerFileInSeconds: 1}, 1100 * time.Millisecond, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApplication(t)
+			dir := t.TempDir()
+			tt.cfg.fileDirectory = dir
+			tt.cfg.filePrefix = "mwal-"
+			tt.cfg.fsyncPolicy = "always"
+			wfm, err := newWalFileManager(a, tt.cfg)
+			if err != nil {
+				t.Fatal("newWalFileManager: " + err.Error())
+			}
+			for x := 0; x < 3; x++ {
+				if x > 0 {
+					time.Sleep(tt.pause)
+				}
+				if err = wfm.writeWalFileEntry(int64(100+x), fmt.Sprintf("key-%02d", x), `{"sys":["filestore"]}`, wal.WAL_ADD); err != nil {
+					t.Fatal("writeWalFileEntry: " + err.Error())
+				}
+			}
+			wfm.closeWalFile()
+
+			files, err := wal.ListWalFiles(dir, "mwal-")
+			if err != nil {
+				t.Fatal("wal.ListWalFiles: " + err.Error())
+			}
+			if len(files) != tt.files {
+				t.Errorf("Expected %d files, got %d", tt.files, len(files))
+			}
+			// Nothing is lost or repeated across the files.
+			var ct int
+			for _, f := range files {
+				wf, err := wal.OpenWalFileReadOnly(f)
+				if err != nil {
+					t.Fatal("wal.OpenWalFileReadOnly: " + err.Error())
+				}
+				for wf.HasNext() {
+					e, err := wf.Next()
+					if err != nil {
+						t.Fatal("wal.Next: " + err.Error())
+					}
+					if e.Timestamp != uint64(100+ct) {
+						t.Errorf("Expected entry %d at %d, got %d", ct, 100+ct, e.Timestamp)
+					}
+					ct++
+				}
+				wf.Close()
+			}
+			if ct != 3 {
+				t.Errorf("Expected 3 entries across the files, got %d", ct)
+			}
+		})
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	a := newTestApplication(t)
+	wfm, err := newWalFileManager(a, walFileConfig{
+		fileDirectory: t.TempDir(),
+		filePrefix:    "mwal-",
+		fsyncPolicy:   "os",
+	})
+	if err != nil {
+		t.Fatal("newWalFileManager: " + err.Error())
+	}
+	defer wfm.closeWalFile()
+	a.config.writeWalFiles = true
+	a.walFileMgr = wfm
+
+	slow, _, err := wfm.subscribe()
+	if err != nil {
+		t.Fatal("subscribe: " + err.Error())
+	}
+	keeping, _, err := wfm.subscribe()
+	if err != nil {
+		t.Fatal("subscribe: " + err.Error())
+	}
+	received := make(chan int)
+	go func() {
+		ct := 0
+		for range keeping.entries {
+			ct++
+		}
+		received <- ct
+	}()
+
+	// Write more than the slow subscriber can buffer; the writer mustn't wait on it.
+	const batches, perBatch = 50, 100
+	written := make(chan error, 1)
+	go func() {
+		for x := 0; x < batches; x++ {
+			entries := make([]wal.WalEntry, perBatch)
+			for y := range entries {
+				entries[y] = newWalEntry(wal.WAL_ADD, fmt.Sprintf("key-%02d-%03d", x, y), `{"sys":["filestore"]}`)
+			}
+			if _, err := a.commitEntries(entries); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	select {
+	case err = <-written:
+		if err != nil {
+			t.Fatal("commitEntries: " + err.Error())
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("The writer was held up by a subscriber that wasn't reading")
+	}
+
+	ct := 0
+	for range slow.entries {
+		ct++
+	}
+	if ct != walSubscriberBuffer {
+		t.Errorf("Expected the slow subscriber to get %d entries before being dropped, got %d", walSubscriberBuffer, ct)
+	}
+	if !errors.Is(slow.err, ErrSubscriberTooSlow) {
+		t.Errorf("Expected ErrSubscriberTooSlow, got %v", slow.err)
+	}
+	wfm.unsubscribe(keeping)
+	if ct = <-received; ct != batches*perBatch {
+		t.Errorf("Expected the subscriber that kept up to get all %d entries, got %d", batches*perBatch, ct)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// retentionCheckEvery is how often the retention policy is enforced, besides after each rotation.
+const retentionCheckEvery = time.Minute
+
+// walRetentionPolicy decides which closed WAL files can be deleted. If untilSnapshotted is set,
+// files are kept until a snapshot covers every entry in them, and the file count and age limits
+// are ignored, since deleting an uncovered file would lose data; otherwise a file is deleted once
+// it falls outside either limit.
+type walRetentionPolicy struct {
+	maxFiles         int
+	maxAge           time.Duration
+	untilSnapshotted bool
+}
+
+func (p walRetentionPolicy) enabled() bool {
+	return p.untilSnapshotted || p.maxFiles > 0 || p.maxAge > 0
+}
+
+// expired returns the files that the policy allows to be deleted. files must be sorted oldest
+// first and must not include the file being written to. Every entry in a file was logged before
+// the next file was created, so the name of the next file (or the current one, for the last) is
+// used as the time the file was closed.
+func (p walRetentionPolicy) expired(files []string, currFile, prefix string, now time.Time, snapshotTs uint64) []string {
+	closedAt := make([]int64, len(files))
+	for x := range files {
+		next := currFile
+		if x+1 < len(files) {
+			next = files[x+1]
+		}
+		ts, err := wal.FileTimestamp(next, prefix)
+		if err != nil {
+			// Without a timestamp there's no telling what the file holds, so keep it.
+			closedAt[x] = now.UnixNano()
+			continue
+		}
+		closedAt[x] = ts
+	}
+
+	expired := make([]string, 0)
+	for x, f := range files {
+		switch {
+		case p.untilSnapshotted:
+			if snapshotTs > 0 && uint64(closedAt[x]) <= snapshotTs {
+				expired = append(expired, f)
+			}
+		// The current file counts towards the limit, so it is always one of the files kept.
+		case p.maxFiles > 0 && len(files)-x >= p.maxFiles:
+			expired = append(expired, f)
+		case p.maxAge > 0 && now.Sub(time.Unix(0, closedAt[x])) > p.maxAge:
+			expired = append(expired, f)
+		}
+	}
+	return expired
+}
+
+// setSnapshotTimestamp records that a snapshot covers every entry up to and including ts, so that
+// files it covers can be deleted under the untilSnapshotted policy.
+func (wfm *walFileManager) setSnapshotTimestamp(ts uint64) {
+	for {
+		curr := atomic.LoadUint64(&wfm.snapshotTs)
+		if ts <= curr || atomic.CompareAndSwapUint64(&wfm.snapshotTs, curr, ts) {
+			break
+		}
+	}
+	select {
+	case wfm.rotated <- struct{}{}:
+	default:
+	}
+}
+
+// runRetention enforces the retention policy in the background until the manager is closed.
+func (wfm *walFileManager) runRetention() {
+	t := time.NewTicker(retentionCheckEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-wfm.quit:
+			return
+		case <-t.C:
+		case <-wfm.rotated:
+		}
+		if err := wfm.enforceRetention(); err != nil {
+			wfm.app.logger.Error(err.Error())
+		}
+	}
+}
+
+// enforceRetention deletes the closed WAL files that the retention policy no longer keeps.
+func (wfm *walFileManager) enforceRetention() error {
+	files, err := wal.ListWalFiles(wfm.dir, wfm.filePrefix)
+	if err != nil {
+		return err
+	}
+	currFile := wfm.currentFile()
+	currTs, err := wal.FileTimestamp(currFile, wfm.filePrefix)
+	if err != nil {
+		return err
+	}
+	closed := make([]string, 0, len(files))
+	for _, f := range files {
+		// Anything from the current file on is still being written, or was put there by
+		// something else.
+		ts, err := wal.FileTimestamp(f, wfm.filePrefix)
+		if err != nil {
+			continue
+		}
+		if ts >= currTs {
+			break
+		}
+		closed = append(closed, f)
+	}
+	expired := wfm.retention.expired(closed, currFile, wfm.filePrefix, time.Now(), atomic.LoadUint64(&wfm.snapshotTs))
+	for _, f := range expired {
+		if err = os.Remove(f); err != nil {
+			return fmt.Errorf("deleting expired WAL file %s: %w", f, err)
+		}
+		wfm.app.logger.Info("Deleted expired WAL file",
+			zap.String("file", f))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/highgrav/munchkin/internal/wal"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	name := func(secs int64) string {
+		return "mwal-" + strconv.FormatInt(secs*int64(time.Second), 10) + ".wal"
+	}
+	// Each file is closed when the next one is created, and the current one was created at 5000s.
+	files := []string{name(1000), name(2000), name(3000), name(4000)}
+	curr := name(5000)
+	now := time.Unix(6000, 0)
+
+	tests := []struct {
+		name       string
+		policy     walRetentionPolicy
+		snapshotTs uint64
+		expired    []string
+	}{
+		{"no limits", walRetentionPolicy{}, 0, []string{}},
+		{"maxFiles counts the current file", walRetentionPolicy{maxFiles: 3}, 0, files[:2]},
+		{"maxFiles of 1 keeps only the current file", walRetentionPolicy{maxFiles: 1}, 0, files},
+		{"maxFiles above the file count", walRetentionPolicy{maxFiles: 10}, 0, []string{}},
+		{"maxAge from when the file was closed", walRetentionPolicy{maxAge: 3500 * time.Second}, 0, files[:1]},
+		{"maxAge keeps files closed within it", walRetentionPolicy{maxAge: 5000 * time.Second}, 0, []string{}},
+		{"either limit expires a file", walRetentionPolicy{maxFiles: 4, maxAge: 2500 * time.Second}, 0, files[:2]},
+		{"untilSnapshotted without a snapshot", walRetentionPolicy{untilSnapshotted: true}, 0, []string{}},
+		{"untilSnapshotted up to the snapshot", walRetentionPolicy{untilSnapshotted: true}, uint64(3000 * time.Second), files[:2]},
+		{"untilSnapshotted overrides the limits", walRetentionPolicy{maxFiles: 1, maxAge: time.Second, untilSnapshotted: true}, uint64(2500 * time.Second), files[:1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.expired(files, curr, "mwal-", now, tt.snapshotTs)
+			if !reflect.DeepEqual(got, tt.expired) {
+				t.Errorf("Expected %v to expire, got %v", tt.expired, got)
+			}
+		})
+	}
+}
+
+func TestRetentionKeepsCurrentFile(t *testing.T) {
+	for _, policy := range []walRetentionPolicy{
+		{maxFiles: 1},
+		{maxAge: time.Nanosecond},
+		{untilSnapshotted: true},
+	} {
+		dir := t.TempDir()
+		// Two files left over from an earlier run, long since closed.
+		for _, age := range []time.Duration{2 * time.Hour, time.Hour} {
+			if _, err := wal.CreateWalFileAt(dir, "mwal-", time.Now().Add(-age).UnixNano()); err != nil {
+				t.Fatal("wal.CreateWalFileAt: " + err.Error())
+			}
+		}
+		a := newTestApplication(t)
+		wfm, err := newWalFileManager(a, walFileConfig{fileDirectory: dir, filePrefix: "mwal-", fsyncPolicy: "always"})
+		if err != nil {
+			t.Fatal("newWalFileManager: " + err.Error())
+		}
+		wfm.retention = policy
+		wfm.setSnapshotTimestamp(uint64(time.Now().Add(time.Hour).UnixNano()))
+		if err = wfm.enforceRetention(); err != nil {
+			t.Fatal("enforceRetention: " + err.Error())
+		}
+		left, err := wal.ListWalFiles(dir, "mwal-")
+		if err != nil {
+			t.Fatal("wal.ListWalFiles: " + err.Error())
+		}
+		if len(left) != 1 || left[0] != wfm.currentFile() {
+			t.Errorf("%+v: expected only the current file %s to be left, got %v", policy, filepath.Base(wfm.currentFile()), left)
+		}
+		if _, err = os.Stat(wfm.currentFile()); err != nil {
+			t.Errorf("%+v: the current file is gone: %s", policy, err.Error())
+		}
+		wfm.closeWalFile()
+	}
+}
@@ -1,11 +1,35 @@
 package main
 
+import (
+	"net"
+	"strconv"
+)
+
 func (a *application) newWalServer() error {
-	cfg := &walConfig{}
-	walsvr, err := newWalServer(cfg)
+	cfg := &walConfig{
+		walDir:    a.config.walWrite.fileDirectory,
+		walPrefix: a.config.walWrite.filePrefix,
+	}
+	walsvr, err := newWalServer(a, cfg, a.config.clusterServer)
 	if err != nil {
 		return err
 	}
 	a.walServer = walsvr
 	return nil
 }
+
+// runWalServerAsync serves the WAL gRPC API on the cluster port until the server is stopped.
+func (a *application) runWalServerAsync() error {
+	lis, err := net.Listen("tcp", a.config.clusterServer.bindTo+":"+strconv.Itoa(a.config.clusterServer.port))
+	if err != nil {
+		return err
+	}
+	a.serverWg.Add(1)
+	go func() {
+		defer a.serverWg.Done()
+		if err := a.walServer.server.Serve(lis); err != nil {
+			a.logger.Fatal(err.Error())
+		}
+	}()
+	return nil
+}
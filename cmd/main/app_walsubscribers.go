@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"github.com/highgrav/munchkin/internal/wal"
+)
+
+// walSubscriberBuffer is how many entries a subscriber can fall behind by before it is dropped.
+const walSubscriberBuffer = 4096
+
+var ErrSubscriberTooSlow = errors.New("WAL subscriber fell too far behind")
+
+// walPosition is a point in the WAL: every entry before offset in file has been published.
+type walPosition struct {
+	file   string
+	offset int64
+}
+
+// walPublishedEntry is an entry that has been written to the WAL, along with the file it is in.
+type walPublishedEntry struct {
+	file  string
+	entry wal.WalEntry
+}
+
+// walSubscription receives every entry written to the WAL after it was created. Its channel is
+// closed if the subscriber falls behind or the WAL is closed, after which err says why.
+type walSubscription struct {
+	entries chan walPublishedEntry
+	err     error
+}
+
+// subscribe registers a new subscription, and returns it along with the position in the WAL it
+// starts from. Entries before that position can be read from the files; every entry after it
+// will be sent to the subscription, so the two meet with nothing missed or repeated.
+func (wfm *walFileManager) subscribe() (*walSubscription, walPosition, error) {
+	wfm.subMu.Lock()
+	defer wfm.subMu.Unlock()
+	if wfm.subscribers == nil {
+		return nil, walPosition{}, ErrWalClosed
+	}
+	sub := &walSubscription{
+		entries: make(chan walPublishedEntry, walSubscriberBuffer),
+	}
+	wfm.subscribers[sub] = struct{}{}
+	return sub, wfm.published, nil
+}
+
+// unsubscribe removes a subscription. It is safe to call more than once.
+func (wfm *walFileManager) unsubscribe(sub *walSubscription) {
+	wfm.subMu.Lock()
+	defer wfm.subMu.Unlock()
+	if _, ok := wfm.subscribers[sub]; ok {
+		delete(wfm.subscribers, sub)
+		close(sub.entries)
+	}
+}
+
+// publish sends newly written entries to every subscriber and moves the published position up to
+// the end of the current file. Subscribers that can't keep up are dropped rather than holding up
+// the writer. It is only called from the writer goroutine.
+func (wfm *walFileManager) publish(entries []walPublishedEntry) {
+	wfm.subMu.Lock()
+	defer wfm.subMu.Unlock()
+	for sub := range wfm.subscribers {
+		for _, e := range entries {
+			select {
+			case sub.entries <- e:
+				continue
+			default:
+			}
+			sub.err = ErrSubscriberTooSlow
+			delete(wfm.subscribers, sub)
+			close(sub.entries)
+			break
+		}
+	}
+	wfm.published = walPosition{
+		file:   wfm.currentFile(),
+		offset: wfm.file.Size(),
+	}
+}
+
+// closeSubscribers ends every subscription once the WAL has been closed.
+func (wfm *walFileManager) closeSubscribers() {
+	wfm.subMu.Lock()
+	defer wfm.subMu.Unlock()
+	for sub := range wfm.subscribers {
+		sub.err = ErrWalClosed
+		close(sub.entries)
+	}
+	wfm.subscribers = nil
+}
@@ -1,27 +1,36 @@
 package main
 
 import (
-	"github.com/highgrav/munchkin/internal/util"
+	"github.com/highgrav/munchkin/internal/cluster"
 	"go.uber.org/zap"
 	"log"
 	"net/http"
-	"quamina.net/go/quamina"
 	"sync"
+	"sync/atomic"
 )
 
 type application struct {
-	config        *appConfig
-	matcher       *quamina.Quamina
-	lastUpdatedOn uint64
-	pool          *util.ObjectPool[quamina.Quamina]
-	apiServer     *http.Server
-	adminServer   *http.Server
-	walServer     *walServer
-	chShutdown    chan struct{}
-	serverWg      *sync.WaitGroup
-	logger        *zap.Logger
-	walFileMgr    *walFileManager
-	cluster       *ClusterState
+	config         *appConfig
+	generation     *atomic.Value
+	latest         *matcherGeneration // guarded by writeMu
+	patterns       *patternIndex      // guarded by writeMu
+	writeMu        sync.Mutex
+	publishMu      sync.Mutex
+	lastUpdatedOn  uint64
+	snapshotMu     sync.Mutex
+	lastSnapshotTs uint64 // accessed atomically
+	apiServer      *http.Server
+	adminServer    *http.Server
+	walServer      *walServer
+	chShutdown     chan struct{}
+	serverWg       *sync.WaitGroup
+	logger         *zap.Logger
+	walFileMgr     *walFileManager
+	cluster        *ClusterState
+	consensus      *cluster.ConsensusMember
+	forwarder      *leaderForwarder
+	sharder        *sharder
+	replica        *replica
 }
 
 func newApplication(cfg appConfig) *application {
@@ -38,18 +47,39 @@ func newApplication(cfg appConfig) *application {
 	if err != nil {
 		a.logger.Fatal(err.Error())
 	}
+	// The cluster API reports membership as soon as it starts, before the cluster is joined.
+	a.cluster = newClusterState()
 
-	a.logger.Info("Creating worker pools...")
-	err = a.newPool()
-	if err != nil {
-		a.logger.Fatal(err.Error())
+	if a.config.consensus.raftAddr != "" {
+		// Raft replays its own snapshots and log, which already cover everything in the WAL.
+		a.logger.Info("Raft is enabled; skipping WAL and snapshot loading")
+	} else {
+		a.logger.Info("Checking for importable WAL logs...")
+		a.loadWalFiles()
+		if a.config.walLoad.loadUntil > 0 {
+			if err = a.startWithLoadedState(); err != nil {
+				a.logger.Fatal(err.Error())
+			}
+		}
 	}
 
-	a.logger.Info("Checking for importable WAL logs...")
-	a.loadWalFiles()
+	if a.config.followPrimary != "" {
+		a.replica = newReplica(a, a.config.followPrimary)
+	}
 
 	a.logger.Info("Starting WAL logger...")
 	a.newWalLogger()
+	a.startSnapshots()
+
+	err = a.startConsensus()
+	if err != nil {
+		a.logger.Fatal(err.Error())
+	}
+
+	err = a.startSharding()
+	if err != nil {
+		a.logger.Fatal(err.Error())
+	}
 
 	a.logger.Info("Creating servers...")
 	err = a.newServers()
@@ -1,9 +1,113 @@
 package main
 
 import (
-	"github.com/highgrav/munchkin/internal/wal"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"sync"
+	"time"
 )
 
+// Peer statuses, as shown on the membership endpoint.
+const (
+	peerAlive  = "alive"
+	peerFailed = "failed"
+)
+
+// clusterPeer is another server in the cluster, as last advertised over Serf.
+type clusterPeer struct {
+	Name      string            `json:"name"`
+	RpcAddr   string            `json:"rpcAddr"`
+	MatchAddr string            `json:"matchAddr"`
+	Tags      map[string]string `json:"tags"`
+	Status    string            `json:"status"`
+	Since     time.Time         `json:"since"`
+}
+
+// ClusterState tracks this server's Serf membership and the peers it has heard about.
 type ClusterState struct {
-	replMemLog []wal.WalEntry
+	member *cluster.ClusterMember
+	mu     sync.RWMutex
+	peers  map[string]*clusterPeer
+}
+
+func newClusterState() *ClusterState {
+	return &ClusterState{
+		peers: make(map[string]*clusterPeer),
+	}
+}
+
+func (cs *ClusterState) setMember(m *cluster.ClusterMember) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.member = m
+}
+
+// getMember returns this server's Serf member, which is nil until it has finished joining.
+func (cs *ClusterState) getMember() *cluster.ClusterMember {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.member
+}
+
+// setPeer records a peer, replacing whatever was known about it before.
+func (cs *ClusterState) setPeer(p *clusterPeer) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.peers[p.Name] = p
+}
+
+// setPeerStatus changes a known peer's status, returning false if the peer isn't known.
+func (cs *ClusterState) setPeerStatus(name, status string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	p, ok := cs.peers[name]
+	if !ok {
+		return false
+	}
+	if p.Status != status {
+		p.Status = status
+		p.Since = time.Now()
+	}
+	return true
+}
+
+// getPeer returns a copy of what is known about a peer.
+func (cs *ClusterState) getPeer(name string) (clusterPeer, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	p, ok := cs.peers[name]
+	if !ok {
+		return clusterPeer{}, false
+	}
+	return *p, true
+}
+
+func (cs *ClusterState) removePeer(name string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.peers, name)
+}
+
+// peerList returns a copy of every known peer.
+func (cs *ClusterState) peerList() []clusterPeer {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	peers := make([]clusterPeer, 0, len(cs.peers))
+	for _, p := range cs.peers {
+		peers = append(peers, *p)
+	}
+	return peers
+}
+
+// routablePeers returns a copy of every peer that requests can be sent to. Failed peers are left
+// out until they rejoin.
+func (cs *ClusterState) routablePeers() []clusterPeer {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	peers := make([]clusterPeer, 0, len(cs.peers))
+	for _, p := range cs.peers {
+		if p.Status == peerAlive {
+			peers = append(peers, *p)
+		}
+	}
+	return peers
 }
@@ -1,13 +1,35 @@
 package main
 
 type appConfig struct {
-	poolSize      int
 	adminServer   webServerConfig
 	matchServer   webServerConfig
 	clusterServer webServerConfig
 	walWrite      walFileConfig
 	walLoad       walFileConfig
+	snapshots     snapshotConfig
+	restore       restoreConfig
 	writeWalFiles bool
+	followPrimary string
+	cluster       clusterConfig
+	consensus     consensusConfig
+	sharding      shardingConfig
+}
+
+type clusterConfig struct {
+	nodeName  string
+	serfAddr  string
+	joinPeers []string
+	tags      map[string]string
+}
+
+type consensusConfig struct {
+	raftAddr  string
+	raftDir   string
+	bootstrap bool
+}
+
+type shardingConfig struct {
+	replicas int
 }
 
 type webServerConfig struct {
@@ -16,6 +38,7 @@ type webServerConfig struct {
 	useTLS              bool
 	certFilePath        string
 	keyFilePath         string
+	caFilePath          string
 	credentialsFilePath string
 	credentialsFilePwd  string
 }
@@ -25,4 +48,23 @@ type walFileConfig struct {
 	filePrefix                  string
 	maxEntriesPerFile           int
 	maxDurationPerFileInSeconds int
+	maxBytesPerFile             int64
+	fsyncPolicy                 string
+	fsyncIntervalMs             int
+	retainFiles                 int
+	retainSeconds               int
+	retainUntilSnapshot         bool
+	loadUntil                   uint64
+}
+
+type snapshotConfig struct {
+	fileDirectory string
+	filePrefix    string
+	everySeconds  int
+	keep          int
+}
+
+type restoreConfig struct {
+	outDir string
+	format string
 }
@@ -5,36 +5,87 @@ import (
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"log"
+	"time"
 )
 
+// shutdownTimeout is how long in-flight requests are given to finish when the server is stopped.
+const shutdownTimeout = 30 * time.Second
+
 var app *application
 
 func main() {
 	var err error = nil
 	cfg := appConfig{}
-	flag.IntVar(&cfg.poolSize, "poolSz", 8, "Number of concurrent workers")
+	flag.Int("poolSz", 8, "Number of concurrent workers")
+	_ = flag.CommandLine.MarkDeprecated("poolSz", "matchers are now copied per request and no longer pooled")
 
 	// WAL import
 	flag.StringVar(&cfg.walLoad.fileDirectory, "walLoadDir", "", "Directory to load WAL files from (if any)")
 	flag.StringVar(&cfg.walLoad.filePrefix, "walLoadPrefix", "mwal-", "Prefix for WAL files to be loaded (if any)")
+	flag.Uint64Var(&cfg.walLoad.loadUntil, "walLoadUntil", 0, "Only load WAL entries and snapshots up to this timestamp, in nanoseconds since the epoch (0 for no limit); the server then logs to --walDir, which must be new and empty, and should be restarted with it as --walLoadDir")
+
+	// Point-in-time restore
+	flag.StringVar(&cfg.restore.outDir, "restoreOut", "", "Restore the rule set as of --walLoadUntil into this directory and exit, instead of starting the server")
+	flag.StringVar(&cfg.restore.format, "restoreFormat", "wal", "Format of the restored rule set: 'wal' or 'snapshot'")
 
 	// WAL files
 	flag.StringVar(&cfg.walWrite.fileDirectory, "walDir", "", "Directory to save WAL files to")
 	flag.StringVar(&cfg.walWrite.filePrefix, "walPrefix", "mwal-", "Prefix for WAL files to be saved")
 	flag.IntVar(&cfg.walWrite.maxEntriesPerFile, "walMaxEntries", 10000, "Maximum number of entries to store in any single WAL file")
+	flag.IntVar(&cfg.walWrite.maxDurationPerFileInSeconds, "walMaxFileSeconds", 0, "Maximum number of seconds to write to any single WAL file (0 for no limit)")
+	flag.Int64Var(&cfg.walWrite.maxBytesPerFile, "walMaxFileBytes", 0, "Maximum size in bytes of any single WAL file (0 for no limit)")
+	flag.IntVar(&cfg.walWrite.retainFiles, "walRetainFiles", 0, "Number of WAL files to keep, including the current one (0 to keep all)")
+	flag.IntVar(&cfg.walWrite.retainSeconds, "walRetainSeconds", 0, "Number of seconds to keep WAL files after they are closed (0 to keep them indefinitely)")
+	flag.BoolVar(&cfg.walWrite.retainUntilSnapshot, "walRetainUntilSnapshot", false, "Keep WAL files only until a snapshot covers them (overrides --walRetainFiles and --walRetainSeconds)")
+	flag.StringVar(&cfg.walWrite.fsyncPolicy, "walFsync", "always", "When to sync WAL writes to disk: 'always' (before acknowledging each write), 'interval' (every --walFsyncIntervalMs) or 'os' (leave it to the OS)")
+	flag.IntVar(&cfg.walWrite.fsyncIntervalMs, "walFsyncIntervalMs", 100, "Milliseconds between WAL syncs when --walFsync=interval")
+
+	// Snapshots
+	flag.StringVar(&cfg.snapshots.fileDirectory, "snapshotDir", "", "Directory to save snapshots to, and to load the newest snapshot from at startup")
+	flag.StringVar(&cfg.snapshots.filePrefix, "snapshotPrefix", "msnap-", "Prefix for snapshot files")
+	flag.IntVar(&cfg.snapshots.everySeconds, "snapshotEverySeconds", 0, "Seconds between scheduled snapshots (0 to only take snapshots on request)")
+	flag.IntVar(&cfg.snapshots.keep, "snapshotKeep", 3, "Number of snapshots to keep (0 to keep all)")
+
+	// Replication
+	flag.StringVar(&cfg.followPrimary, "followPrimary", "", "Run as a read-only replica of the server whose cluster API is at this host:port")
+
+	// Cluster membership
+	flag.StringVar(&cfg.cluster.serfAddr, "serfAddr", "", "Address (host:port) to bind Serf cluster membership to (membership is off if empty)")
+	flag.StringVar(&cfg.cluster.nodeName, "nodeName", "", "Name of this server in the cluster (defaults to host:matchApiPort)")
+	flag.StringSliceVar(&cfg.cluster.joinPeers, "joinPeers", []string{}, "Serf addresses (host:port) of existing cluster members to join through")
+	flag.StringToStringVar(&cfg.cluster.tags, "tags", map[string]string{}, "Extra tags (key=value) to advertise to the cluster")
+
+	// Consensus
+	flag.StringVar(&cfg.consensus.raftAddr, "raftAddr", "", "Address (host:port) to bind the Raft transport to; commits changes through Raft if set (needs --serfAddr and --raftDir)")
+	flag.StringVar(&cfg.consensus.raftDir, "raftDir", "", "Directory to keep the Raft log and snapshots in")
+	flag.BoolVar(&cfg.consensus.bootstrap, "raftBootstrap", false, "Start a new Raft cluster with this server as its first member (ignored if --raftDir already holds Raft state)")
+
+	// Sharding
+	flag.IntVar(&cfg.sharding.replicas, "shardReplicas", 0, "Shard the rule set across cluster members, keeping this many copies of each key (sharding is off if 0; needs --serfAddr)")
 
 	// Web server configuration
 	flag.IntVar(&cfg.matchServer.port, "matchApiPort", 8080, "Port to run matching API on")
 	flag.IntVar(&cfg.adminServer.port, "adminApiPort", 9090, "Port to run admin API on")
-	flag.IntVar(&cfg.clusterServer.port, "raftApiPort", 7070, "Port to run cluster API on")
+	flag.IntVar(&cfg.clusterServer.port, "raftApiPort", 7070, "Port to run cluster API (including the WAL gRPC service) on")
+	flag.BoolVar(&cfg.clusterServer.useTLS, "rpcTLS", false, "Serve the cluster API over TLS, and use TLS to reach other servers' cluster APIs")
+	flag.StringVar(&cfg.clusterServer.certFilePath, "rpcCertFile", "", "Certificate the cluster API serves with, and presents to other servers, when --rpcTLS is set")
+	flag.StringVar(&cfg.clusterServer.keyFilePath, "rpcKeyFile", "", "Private key for --rpcCertFile")
+	flag.StringVar(&cfg.clusterServer.caFilePath, "rpcCAFile", "", "CA to verify other servers' certificates with when --rpcTLS is set (defaults to the system roots); if set, clients of the cluster API must present a certificate it signed")
 
-	viper.SetDefault("PoolSize", 10)
 	viper.SetDefault("MatchApiPort", 8080)
-	err = viper.BindPFlag("PoolSize", flag.Lookup("poolSz"))
 
 	flag.Parse()
-	if err != nil {
-		log.Fatal("Could not bind command flag 'MatchPoolSize'")
+
+	if cfg.walLoad.loadUntil > 0 && cfg.restore.outDir == "" {
+		if err = checkLoadUntil(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.restore.outDir != "" {
+		if err = runRestore(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	app = newApplication(cfg)
@@ -47,8 +98,13 @@ func main() {
 
 	_ = <-chShutdown
 	app.logger.Info("Shutting down server...")
-	err = app.apiServer.Shutdown(context.Background())
-	if err != nil {
-		log.Fatal(err)
+	app.stopSharding()
+	app.stopCluster()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	app.stopServers(ctx)
+	cancel()
+	app.stopConsensus()
+	if app.walFileMgr != nil {
+		app.walFileMgr.closeWalFile()
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"go.uber.org/zap"
 	"net/http"
 	"sync"
@@ -18,11 +19,17 @@ func newServer(addr string, mux *http.ServeMux) *http.Server {
 	return s
 }
 
+// runServerAsync serves until the server is shut down. The caller must have added the server to
+// wg.
 func runServerAsync(cfg webServerConfig, wg *sync.WaitGroup, server *http.Server, logger *zap.Logger) {
-	wg.Add(1)
+	defer wg.Done()
+	var err error
 	if cfg.useTLS {
-		logger.Fatal(server.ListenAndServeTLS(cfg.certFilePath, cfg.keyFilePath).Error())
+		err = server.ListenAndServeTLS(cfg.certFilePath, cfg.keyFilePath)
 	} else {
-		logger.Fatal(server.ListenAndServe().Error())
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal(err.Error())
 	}
 }
@@ -2,13 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/cluster"
+	"github.com/highgrav/munchkin/internal/registry"
 	"github.com/highgrav/munchkin/internal/wal"
 	"google.golang.org/grpc"
-	"sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"math"
+	"strconv"
 	"time"
 )
 
+// maxTimestampSkew is how far ahead of this server's clock the timestamp on a logged entry may be.
+// Later local changes are stamped after the last applied one, so a timestamp far in the future
+// would stamp everything after it there too.
+const maxTimestampSkew = time.Minute
+
 type walConfig struct {
 	walDir    string
 	walPrefix string
@@ -24,7 +37,6 @@ type walServer struct {
 	api.UnimplementedWalServer
 	app        *application
 	Config     *walConfig
-	mu         sync.Mutex
 	dirName    string
 	filePrefix string
 	server     *grpc.Server
@@ -32,109 +44,154 @@ type walServer struct {
 
 var _ api.WalServer = (*walServer)(nil)
 
-func newWalServer(config *walConfig) (*walServer, error) {
-	svr := grpc.NewServer()
+func newWalServer(app *application, config *walConfig, srvCfg webServerConfig) (*walServer, error) {
+	opts := make([]grpc.ServerOption, 0)
+	if srvCfg.useTLS {
+		creds, err := rpcServerCredentials(srvCfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	svr := grpc.NewServer(opts...)
 	ws := &walServer{
-		Config: config,
-		server: svr,
+		app:        app,
+		Config:     config,
+		dirName:    config.walDir,
+		filePrefix: config.walPrefix,
+		server:     svr,
 	}
 	api.RegisterWalServer(svr, ws)
 	return ws, nil
 }
 
-// PublishEntryStreamFromTime takes a timestamp and returns all WalEntries with a timestamp equal to or greater than
-// the requested timestamp.
-// TODO -- there's a race condition with file rotation and possible file writes.
-// // I need to think through how to implement handling buffering writes in a clean CSP manner.
-func (ws *walServer) PublishEntryStreamFromTime(req *api.PublishEntryRequest, server api.Wal_PublishEntryStreamServer) error {
-	var doneWithFiles bool = false
-	startFiles, err := wal.FindFilesOnOrAfter(ws.dirName, ws.filePrefix, req.GetTimestamp())
+// PublishEntryStream sends every WalEntry with a timestamp equal to or greater than the requested
+// timestamp, starting with those already in the WAL files and then following new entries as they
+// are written, until the client goes away or the server shuts down. Subscribing to new entries
+// first gives the point in the files where the live entries pick up, so nothing is sent twice or
+// missed in between. A client that falls too far behind is cut off, and can pick up again from
+// the timestamp of the last entry it received. Several entries can share a timestamp, so it has
+// to skip the ones with that timestamp it already has, which are sent again in the same order.
+func (ws *walServer) PublishEntryStream(req *api.PublishEntryRequest, server api.Wal_PublishEntryStreamServer) error {
+	if ws.dirName == "" || ws.app.walFileMgr == nil {
+		return status.Error(codes.FailedPrecondition, "WAL files are not being written")
+	}
+	sub, pos, err := ws.app.walFileMgr.subscribe()
 	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer ws.app.walFileMgr.unsubscribe(sub)
+	// Let the client know it is subscribed, even if there is nothing to send it yet.
+	if err = server.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	from := req.GetTimestamp()
+	if err = ws.sendFileEntries(server, from, pos); err != nil {
 		return err
 	}
-	if len(startFiles) < 1 {
-		return nil
+	for {
+		select {
+		case pe, ok := <-sub.entries:
+			if !ok {
+				return status.Error(codes.Unavailable, sub.err.Error())
+			}
+			if pe.entry.Timestamp < from {
+				continue
+			}
+			if err = sendEntry(server, pe.file, pe.entry); err != nil {
+				return err
+			}
+		case <-server.Context().Done():
+			return status.FromContextError(server.Context().Err()).Err()
+		case <-ws.app.chShutdown:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+// sendFileEntries sends the entries in the WAL files with a timestamp equal to or greater than
+// from, up to the given position.
+func (ws *walServer) sendFileEntries(server api.Wal_PublishEntryStreamServer, from uint64, upTo walPosition) error {
+	files, err := wal.FindFilesOnOrAfter(ws.dirName, ws.filePrefix, from)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
 	}
-	for _, f := range startFiles {
-		if doneWithFiles {
+	for _, f := range files {
+		if f > upTo.file {
 			break
 		}
-		file, err := wal.OpenWalFile(f)
+		file, err := wal.OpenWalFileReadOnly(f)
 		if err != nil {
-			return err
+			return status.Error(codes.Internal, err.Error())
 		}
-		for !doneWithFiles && file.HasNext() {
+		for file.HasNext() && (f != upTo.file || file.Offset() < upTo.offset) {
 			evt, err := file.Next()
-			if evt.Timestamp > req.GetTimestamp() {
-				file.Close()
-				doneWithFiles = true
+			if errors.Is(err, wal.ErrCorruptRecord) {
+				ws.app.logger.Warn(f + ": " + err.Error())
+				continue
 			}
 			if err != nil {
-				return err
+				file.Close()
+				return status.Error(codes.Internal, err.Error())
 			}
-			res := &api.PublishEntryResponse{
-				FileName: file.FileName,
-				Entry: &api.WalEntry{
-					Timestamp: evt.Timestamp,
-					Key:       evt.Key,
-					Pattern:   evt.Pattern,
-					Action:    uint32(evt.Action),
-				},
+			if evt.Timestamp < from {
+				continue
 			}
-			server.Send(res)
-		}
-		file.Close()
-	}
-	if len(ws.app.cluster.replMemLog) > 0 {
-		for _, evt := range ws.app.cluster.replMemLog {
-			res := &api.PublishEntryResponse{
-				FileName: "",
-				Entry: &api.WalEntry{
-					Timestamp: evt.Timestamp,
-					Key:       evt.Key,
-					Pattern:   evt.Pattern,
-					Action:    uint32(evt.Action),
-				},
+			if err = sendEntry(server, f, evt); err != nil {
+				file.Close()
+				return err
 			}
-			server.Send(res)
 		}
+		file.Close()
 	}
 	return nil
 }
 
+func sendEntry(server api.Wal_PublishEntryStreamServer, fileName string, evt wal.WalEntry) error {
+	return server.Send(&api.PublishEntryResponse{
+		FileName: fileName,
+		Entry: &api.WalEntry{
+			Timestamp: evt.Timestamp,
+			Key:       evt.Key,
+			Pattern:   evt.Pattern,
+			Action:    uint32(evt.Action),
+		},
+	})
+}
+
 // LogEntry takes a WalEntry and processes it locally, updating the matcher and writing it to the
-// local logfiles.
+// local logfiles. The response carries the timestamp the entry was committed under, once it is as
+// durable as the fsync policy requires. Entries sent with a timestamp of 0 are stamped locally;
+// entries with a timestamp keep it, and are skipped (with a response timestamp of 0) if later
+// entries have already been applied. A timestamp more than maxTimestampSkew ahead of this server's
+// clock is rejected as invalid. When Raft is enabled, entries are instead committed through
+// the Raft log on the leader and stamped as they are applied, so any timestamp sent is ignored.
 func (ws *walServer) LogEntry(ctx context.Context, req *api.LogEntryRequest) (*api.LogEntryResponse, error) {
-	// Don't apply if you've applied later entries already
-	if req.Entry.GetTimestamp() < app.lastUpdatedOn {
-		return &api.LogEntryResponse{
-			Timestamp: 0,
-		}, nil
+	res, index, err := ws.logEntry(ctx, req)
+	if err != nil {
+		return nil, err
 	}
-	ws.mu.Lock()
-	defer ws.mu.Unlock()
-	// TODO -- using the object pool may introduce a potential race condition
-	ts := time.Now().UnixNano()
-	if req.GetEntry().GetAction() == uint32(wal.WAL_ADD) {
-		ws.app.addRule(req.GetEntry().GetKey(), string(req.GetEntry().GetPattern()))
-	} else if req.GetEntry().GetAction() == uint32(wal.WAL_DEL) {
-		ws.app.deleteAllRulesFor(req.GetEntry().GetKey())
+	// Let followers that forwarded the entry know which Raft log index to wait for.
+	if index > 0 {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(raftIndexHeader, strconv.FormatUint(index, 10)))
 	}
-
-	go ws.asyncLogEntryToFile(req)
-
-	return &api.LogEntryResponse{
-		Timestamp: uint64(ts),
-	}, nil
+	return res, nil
 }
 
+// LogEntryStream processes each entry on the stream in turn, as LogEntry does, and acknowledges
+// each one with its committed timestamp before reading the next. The stream is ended with an
+// error at the first entry that can't be applied, so every acknowledged entry has been committed.
 func (ws *walServer) LogEntryStream(server api.Wal_LogEntryStreamServer) error {
 	for {
 		streamReq, err := server.Recv()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		res, err := ws.LogEntry(server.Context(), streamReq)
+		res, _, err := ws.logEntry(server.Context(), streamReq)
 		if err != nil {
 			return err
 		}
@@ -142,9 +199,97 @@ func (ws *walServer) LogEntryStream(server api.Wal_LogEntryStreamServer) error {
 			return err
 		}
 	}
-	return nil
 }
 
-func (ws *walServer) asyncLogEntryToFile(evt *api.LogEntryRequest) {
-	// TODO
+// logEntry applies and logs a single entry, returning the response along with the Raft log index
+// it was committed at, if it went through Raft.
+func (ws *walServer) logEntry(ctx context.Context, req *api.LogEntryRequest) (*api.LogEntryResponse, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, status.FromContextError(err).Err()
+	}
+	ts, index, err := ws.applyEntry(req.GetEntry())
+	if err != nil {
+		return nil, 0, err
+	}
+	return &api.LogEntryResponse{
+		Timestamp: ts,
+	}, index, nil
+}
+
+// applyEntry applies an entry to the matchers and logs it, returning its committed timestamp (or
+// 0 if it was stale) and, when Raft is enabled, the Raft log index it was committed at. Errors are
+// returned as gRPC statuses.
+func (ws *walServer) applyEntry(e *api.WalEntry) (uint64, uint64, error) {
+	if ws.app.replica != nil {
+		return 0, 0, status.Error(codes.FailedPrecondition, ErrReadOnlyReplica.Error())
+	}
+	if e == nil {
+		return 0, 0, status.Error(codes.InvalidArgument, "missing entry")
+	}
+	if e.GetAction() > math.MaxUint16 {
+		return 0, 0, status.Errorf(codes.InvalidArgument, "unknown WAL action %d", e.GetAction())
+	}
+	action := uint16(e.GetAction())
+	key, pattern := string(e.GetKey()), string(e.GetPattern())
+	if key == "" {
+		return 0, 0, status.Error(codes.InvalidArgument, "missing key")
+	}
+	switch action {
+	case wal.WAL_ADD, wal.WAL_REPLACE:
+	case wal.WAL_DEL:
+		if len(pattern) <= 1 {
+			pattern = "-"
+		}
+	default:
+		return 0, 0, status.Errorf(codes.InvalidArgument, "unknown WAL action %d", action)
+	}
+	if err := checkEntrySize(key, pattern); err != nil {
+		return 0, 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	entries := []wal.WalEntry{newWalEntry(action, key, pattern)}
+	if ws.app.consensus != nil {
+		return ws.commitEntries(entries)
+	}
+	if ts := e.GetTimestamp(); ts > uint64(time.Now().Add(maxTimestampSkew).UnixNano()) {
+		return 0, 0, status.Errorf(codes.InvalidArgument, "timestamp %d is more than %s ahead of this server's clock", ts, maxTimestampSkew)
+	}
+	entries[0].Timestamp = e.GetTimestamp()
+	var applyErr error
+	_, err := ws.app.mutateAndLog(entries, func(r *registry.Registry) error {
+		applyErr = ws.app.applyEntry(r, action, key, pattern)
+		return applyErr
+	})
+	if errors.Is(err, ErrStaleEntry) {
+		return 0, 0, nil
+	}
+	if errors.Is(err, ErrTimestampsExhausted) {
+		return 0, 0, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if applyErr != nil {
+		return 0, 0, status.Error(codes.InvalidArgument, applyErr.Error())
+	}
+	if err != nil {
+		// The change has been applied but couldn't be logged.
+		ws.app.logger.Error("Could not log entry: " + err.Error())
+		return 0, 0, status.Error(codes.Internal, err.Error())
+	}
+	return entries[0].Timestamp, 0, nil
+}
+
+// commitEntries commits entries through Raft, returning the timestamp they were logged under on
+// this server and the Raft log index they were committed at. Errors are returned as gRPC statuses.
+func (ws *walServer) commitEntries(entries []wal.WalEntry) (uint64, uint64, error) {
+	res, err := ws.app.consensus.Apply(entries, raftApplyTimeout)
+	if res.Err != nil {
+		return 0, 0, status.Error(codes.InvalidArgument, res.Err.Error())
+	}
+	if errors.Is(err, cluster.ErrNotLeader) {
+		_, leader := ws.app.consensus.Leader()
+		return 0, 0, status.Errorf(codes.FailedPrecondition, "not the Raft leader (the leader is %q)", leader)
+	}
+	if err != nil {
+		return 0, 0, status.Error(codes.Unavailable, err.Error())
+	}
+	return res.Timestamp, res.Index, nil
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	api "github.com/highgrav/munchkin/api/v1"
+	"github.com/highgrav/munchkin/internal/net"
+	"github.com/highgrav/munchkin/internal/wal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startWalServer starts a WAL gRPC server writing WAL files to a temporary directory, returning the
+// application and a client connected to it. Both are stopped when the test finishes.
+func startWalServer(t *testing.T) (*application, api.WalClient) {
+	t.Helper()
+	return startWalServerWith(t, webServerConfig{})
+}
+
+// startWalServerWith is startWalServer with the TLS settings in srv.
+func startWalServerWith(t *testing.T, srv webServerConfig) (*application, api.WalClient) {
+	t.Helper()
+	a := newTestApplication(t)
+	a.serverWg = new(sync.WaitGroup)
+	ports, _ := net.GetFreePorts(1, 6000, 0)
+	if len(ports) < 1 {
+		t.Fatal("No free port available for the WAL server!")
+	}
+	srv.bindTo, srv.port = "127.0.0.1", ports[0]
+	a.config.clusterServer = srv
+	a.config.walWrite = walFileConfig{
+		fileDirectory: t.TempDir(),
+		filePrefix:    "mwal-",
+		fsyncPolicy:   "always",
+	}
+	a.newWalLogger()
+	t.Cleanup(a.walFileMgr.closeWalFile)
+	if err := a.newWalServer(); err != nil {
+		t.Fatal("newWalServer: " + err.Error())
+	}
+	if err := a.runWalServerAsync(); err != nil {
+		t.Fatal("runWalServerAsync: " + err.Error())
+	}
+	t.Cleanup(a.serverWg.Wait)
+	t.Cleanup(a.walServer.server.Stop)
+
+	creds, err := a.rpcDialOption()
+	if err != nil {
+		t.Fatal("rpcDialOption: " + err.Error())
+	}
+	conn, err := grpc.Dial("127.0.0.1:"+strconv.Itoa(ports[0]), creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return a, api.NewWalClient(conn)
+}
+
+func TestWalServer(t *testing.T) {
+	a, client := startWalServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Entries that carry a timestamp keep it, and several can share one.
+	for _, key := range []string{"first-test-key", "second-test-key"} {
+		res, err := client.LogEntry(ctx, &api.LogEntryRequest{Entry: &api.WalEntry{
+			Timestamp: 100,
+			Key:       []byte(key),
+			Pattern:   []byte(`{"sys":["filestore"]}`),
+			Action:    uint32(wal.WAL_ADD),
+		}})
+		if err != nil {
+			t.Fatal("LogEntry: " + err.Error())
+		}
+		if res.GetTimestamp() != 100 {
+			t.Errorf("Expected %s to be logged at 100, got %d", key, res.GetTimestamp())
+		}
+	}
+	if !a.hasKey("first-test-key") || !a.hasKey("second-test-key") {
+		t.Error("The logged entries weren't applied")
+	}
+	_, err := client.LogEntry(ctx, &api.LogEntryRequest{Entry: &api.WalEntry{
+		Key:     []byte("third-test-key"),
+		Pattern: []byte(`{"sys":"filestore"}`),
+		Action:  uint32(wal.WAL_ADD),
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an invalid pattern, got %v", err)
+	}
+
+	// Streaming from the shared timestamp sends both entries.
+	stream, err := client.PublishEntryStream(ctx, &api.PublishEntryRequest{Timestamp: 100})
+	if err != nil {
+		t.Fatal("PublishEntryStream: " + err.Error())
+	}
+	for _, key := range []string{"first-test-key", "second-test-key"} {
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal("Recv: " + err.Error())
+		}
+		if e := res.GetEntry(); string(e.GetKey()) != key || e.GetTimestamp() != 100 {
+			t.Errorf("Expected %s at 100, got %s at %d", key, e.GetKey(), e.GetTimestamp())
+		}
+	}
+}
+
+func TestLogEntryStreamAcks(t *testing.T) {
+	a, client := startWalServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.LogEntryStream(ctx)
+	if err != nil {
+		t.Fatal("LogEntryStream: " + err.Error())
+	}
+	send := func(ts uint64, key string) (*api.LogEntryResponse, error) {
+		err := stream.Send(&api.LogEntryRequest{Entry: &api.WalEntry{
+			Timestamp: ts,
+			Key:       []byte(key),
+			Pattern:   []byte(`{"sys":["filestore"]}`),
+			Action:    uint32(wal.WAL_ADD),
+		}})
+		if err != nil {
+			t.Fatal("Send: " + err.Error())
+		}
+		return stream.Recv()
+	}
+
+	// A timestamp within the allowed skew is kept.
+	near := uint64(time.Now().Add(maxTimestampSkew / 2).UnixNano())
+	res, err := send(near, "first-test-key")
+	if err != nil || res.GetTimestamp() != near {
+		t.Fatalf("Expected first-test-key to be logged at %d, got %d (%v)", near, res.GetTimestamp(), err)
+	}
+	// Local entries are stamped after it, even though the clock is behind it.
+	res, err = send(0, "second-test-key")
+	if err != nil || res.GetTimestamp() != near+1 {
+		t.Fatalf("Expected second-test-key to be stamped %d, got %d (%v)", near+1, res.GetTimestamp(), err)
+	}
+	// An entry older than the last applied change is skipped, and acknowledged with 0.
+	res, err = send(100, "third-test-key")
+	if err != nil || res.GetTimestamp() != 0 {
+		t.Fatalf("Expected the stale entry to be acknowledged with 0, got %d (%v)", res.GetTimestamp(), err)
+	}
+	// A timestamp too far ahead ends the stream, and isn't applied.
+	_, err = send(uint64(time.Now().Add(time.Hour).UnixNano()), "fourth-test-key")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a timestamp an hour ahead, got %v", err)
+	}
+	if !a.hasKey("first-test-key") || !a.hasKey("second-test-key") {
+		t.Error("The acknowledged entries weren't applied")
+	}
+	if a.hasKey("third-test-key") || a.hasKey("fourth-test-key") {
+		t.Error("An entry that wasn't acknowledged was applied")
+	}
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if a.lastUpdatedOn != near+1 {
+		t.Errorf("Expected lastUpdatedOn to stay at %d, got %d", near+1, a.lastUpdatedOn)
+	}
+}
+
+func TestPublishEntryStreamHandoff(t *testing.T) {
+	a, client := startWalServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	const before, during = 500, 500
+	commit := func(x int) {
+		if _, err := a.commitEntries([]wal.WalEntry{newWalEntry(wal.WAL_ADD, fmt.Sprintf("key-%04d", x), `{"sys":["filestore"]}`)}); err != nil {
+			t.Error("commitEntries: " + err.Error())
+		}
+	}
+	for x := 0; x < before; x++ {
+		commit(x)
+	}
+
+	// Keep writing while the stream replays the files and switches over to live entries.
+	stream, err := client.PublishEntryStream(ctx, &api.PublishEntryRequest{Timestamp: 0})
+	if err != nil {
+		t.Fatal("PublishEntryStream: " + err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for x := before; x < before+during; x++ {
+			commit(x)
+		}
+	}()
+	for x := 0; x < before+during; x++ {
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal("Recv: " + err.Error())
+		}
+		if key := fmt.Sprintf("key-%04d", x); string(res.GetEntry().GetKey()) != key {
+			t.Fatalf("Expected entry %d to be %s, got %s", x, key, res.GetEntry().GetKey())
+		}
+	}
+	<-done
+
+	// Entries written once the stream has caught up are sent too.
+	commit(before + during)
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal("Recv: " + err.Error())
+	}
+	if key := fmt.Sprintf("key-%04d", before+during); string(res.GetEntry().GetKey()) != key {
+		t.Errorf("Expected %s, got %s", key, res.GetEntry().GetKey())
+	}
+}
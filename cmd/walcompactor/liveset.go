@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/registry"
+	"github.com/highgrav/munchkin/internal/wal"
+	"sort"
+)
+
+// livePattern is a pattern that is still attached to a key, along with the timestamp of the
+// entry that attached it.
+type livePattern struct {
+	pattern   string
+	timestamp uint64
+}
+
+// liveSet folds a sequence of WAL entries down to the patterns that survive them. It also keeps
+// the deletes that still matter: the files being compacted may not start from an empty rule set
+// (older files may have been removed once a snapshot covered them), so a delete in the compacted
+// range can remove a pattern that was added before it. The latest delete for each key, and for
+// each pattern that hasn't been added back since, is kept as a tombstone.
+type liveSet struct {
+	keys          map[string][]livePattern
+	keyTombstones map[string]uint64
+	patTombstones map[string][]livePattern
+}
+
+func newLiveSet() *liveSet {
+	return &liveSet{
+		keys:          make(map[string][]livePattern),
+		keyTombstones: make(map[string]uint64),
+		patTombstones: make(map[string][]livePattern),
+	}
+}
+
+// apply folds a single WAL entry into the live set, following the same rules the server uses
+// when it replays a log.
+func (ls *liveSet) apply(e wal.WalEntry) error {
+	key := string(e.Key)
+	if len(key) == 0 {
+		return nil
+	}
+	switch e.Action {
+	case wal.WAL_ADD:
+		if len(e.Pattern) == 0 {
+			return nil
+		}
+		ls.add(key, string(e.Pattern), e.Timestamp)
+	case wal.WAL_DEL:
+		if len(e.Pattern) <= 1 {
+			ls.deleteKey(key, e.Timestamp)
+			return nil
+		}
+		c := registry.Canonical(string(e.Pattern))
+		ls.keys[key] = without(ls.keys[key], c)
+		if len(ls.keys[key]) == 0 {
+			delete(ls.keys, key)
+		}
+		ls.patTombstones[key] = append(without(ls.patTombstones[key], c), livePattern{pattern: string(e.Pattern), timestamp: e.Timestamp})
+	case wal.WAL_REPLACE:
+		var pats []json.RawMessage
+		if err := json.Unmarshal(e.Pattern, &pats); err != nil {
+			return err
+		}
+		ls.deleteKey(key, e.Timestamp)
+		for _, p := range pats {
+			ls.add(key, string(p), e.Timestamp)
+		}
+	default:
+		return fmt.Errorf("unknown WAL action %d", e.Action)
+	}
+	return nil
+}
+
+func (ls *liveSet) add(key, pattern string, ts uint64) {
+	c := registry.Canonical(pattern)
+	// A pattern that is added back no longer needs its delete.
+	if pats := without(ls.patTombstones[key], c); len(pats) > 0 {
+		ls.patTombstones[key] = pats
+	} else {
+		delete(ls.patTombstones, key)
+	}
+	for _, lp := range ls.keys[key] {
+		if registry.Canonical(lp.pattern) == c {
+			return
+		}
+	}
+	ls.keys[key] = append(ls.keys[key], livePattern{pattern: pattern, timestamp: ts})
+}
+
+// deleteKey removes every pattern for a key, replacing any earlier tombstones for it with one for
+// the whole key.
+func (ls *liveSet) deleteKey(key string, ts uint64) {
+	delete(ls.keys, key)
+	delete(ls.patTombstones, key)
+	ls.keyTombstones[key] = ts
+}
+
+// without returns the patterns that don't match the canonical pattern c.
+func without(pats []livePattern, c string) []livePattern {
+	remaining := make([]livePattern, 0, len(pats))
+	for _, lp := range pats {
+		if registry.Canonical(lp.pattern) != c {
+			remaining = append(remaining, lp)
+		}
+	}
+	return remaining
+}
+
+// entries returns the live set as WAL_DEL tombstones and WAL_ADD entries, ordered by their
+// original timestamps. A tombstone sorts ahead of the patterns for its key with the same timestamp,
+// since a replace is written as a delete of the whole key followed by the new patterns.
+func (ls *liveSet) entries() []wal.WalEntry {
+	entries := make([]wal.WalEntry, 0)
+	for k, ts := range ls.keyTombstones {
+		entries = append(entries, wal.WalEntry{
+			Timestamp: ts,
+			Key:       []byte(k),
+			Pattern:   []byte("-"),
+			Action:    wal.WAL_DEL,
+		})
+	}
+	for k, pats := range ls.patTombstones {
+		for _, lp := range pats {
+			entries = append(entries, wal.WalEntry{
+				Timestamp: lp.timestamp,
+				Key:       []byte(k),
+				Pattern:   []byte(lp.pattern),
+				Action:    wal.WAL_DEL,
+			})
+		}
+	}
+	for k, pats := range ls.keys {
+		for _, lp := range pats {
+			entries = append(entries, wal.WalEntry{
+				Timestamp: lp.timestamp,
+				Key:       []byte(k),
+				Pattern:   []byte(lp.pattern),
+				Action:    wal.WAL_ADD,
+			})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp < entries[j].Timestamp
+		}
+		if ki, kj := string(entries[i].Key), string(entries[j].Key); ki != kj {
+			return ki < kj
+		}
+		return entries[i].Action == wal.WAL_DEL && entries[j].Action != wal.WAL_DEL
+	})
+	return entries
+}
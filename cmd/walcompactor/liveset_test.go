@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/highgrav/munchkin/internal/wal"
+	"testing"
+)
+
+func entry(ts uint64, action uint16, key, pattern string) wal.WalEntry {
+	return wal.WalEntry{
+		Timestamp: ts,
+		Key:       []byte(key),
+		Pattern:   []byte(pattern),
+		Action:    action,
+	}
+}
+
+// replay applies entries to a starting rule set the way the server does, returning the result.
+func replay(start map[string][]string, entries []wal.WalEntry) map[string][]string {
+	keys := make(map[string][]string)
+	for k, pats := range start {
+		keys[k] = append([]string(nil), pats...)
+	}
+	for _, e := range entries {
+		key, pattern := string(e.Key), string(e.Pattern)
+		switch e.Action {
+		case wal.WAL_ADD:
+			keys[key] = append(keys[key], pattern)
+		case wal.WAL_DEL:
+			if len(pattern) <= 1 {
+				delete(keys, key)
+				continue
+			}
+			remaining := make([]string, 0)
+			for _, p := range keys[key] {
+				if p != pattern {
+					remaining = append(remaining, p)
+				}
+			}
+			if len(remaining) == 0 {
+				delete(keys, key)
+			} else {
+				keys[key] = remaining
+			}
+		}
+	}
+	return keys
+}
+
+func TestLiveSetKeepsTombstones(t *testing.T) {
+	// The compacted files don't start from an empty rule set: these were added in older files
+	// that have since been removed.
+	before := map[string][]string{
+		"first-test-key":  {`{"sys":["filestore"]}`},
+		"second-test-key": {`{"sys":["authnz"]}`, `{"sys":["infra"]}`},
+		"third-test-key":  {`{"sys":["infra"]}`},
+		"fourth-test-key": {`{"sys":["infra"]}`},
+	}
+	ls := newLiveSet()
+	for _, e := range []wal.WalEntry{
+		entry(10, wal.WAL_DEL, "first-test-key", "-"),
+		entry(11, wal.WAL_DEL, "second-test-key", `{"sys":["authnz"]}`),
+		entry(12, wal.WAL_ADD, "third-test-key", `{"sys":["filestore"]}`),
+		entry(13, wal.WAL_DEL, "third-test-key", `{"sys":["filestore"]}`),
+		entry(14, wal.WAL_ADD, "third-test-key", `{"sys":["filestore"]}`),
+		entry(15, wal.WAL_REPLACE, "fourth-test-key", `[{"sys":["authnz"]}]`),
+		entry(16, wal.WAL_ADD, "fifth-test-key", `{"sys":["infra"]}`),
+	} {
+		if err := ls.apply(e); err != nil {
+			t.Fatal("apply: " + err.Error())
+		}
+	}
+
+	entries := ls.entries()
+	for x := 1; x < len(entries); x++ {
+		if entries[x].Timestamp < entries[x-1].Timestamp {
+			t.Fatalf("Entries out of order at %d", x)
+		}
+	}
+	got := replay(before, entries)
+	want := map[string][]string{
+		"second-test-key": {`{"sys":["infra"]}`},
+		"third-test-key":  {`{"sys":["infra"]}`, `{"sys":["filestore"]}`},
+		"fourth-test-key": {`{"sys":["authnz"]}`},
+		"fifth-test-key":  {`{"sys":["infra"]}`},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d keys after replaying the compacted entries, got %v", len(want), got)
+	}
+	for k, pats := range want {
+		if len(got[k]) != len(pats) {
+			t.Errorf("%s: expected %v, got %v", k, pats, got[k])
+			continue
+		}
+		for x := range pats {
+			if got[k][x] != pats[x] {
+				t.Errorf("%s: expected %v, got %v", k, pats, got[k])
+			}
+		}
+	}
+
+	// The pattern delete that was undone by a later add isn't kept.
+	for _, e := range entries {
+		if e.Action == wal.WAL_DEL && string(e.Key) == "third-test-key" {
+			t.Errorf("Unexpected tombstone for third-test-key at %d", e.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/wal"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type compactorConfig struct {
+	walDir         string
+	walPrefix      string
+	outDir         string
+	archiveDir     string
+	deleteOld      bool
+	includeNewest  bool
+	ignoreBadFiles bool
+}
+
+func main() {
+	cfg := compactorConfig{}
+	flag.StringVar(&cfg.walDir, "walDir", "", "Directory containing the WAL files to compact")
+	flag.StringVar(&cfg.walPrefix, "walPrefix", "mwal-", "Prefix of the WAL files to compact")
+	flag.StringVar(&cfg.outDir, "outDir", "", "Directory to write the compacted WAL file to (defaults to walDir)")
+	flag.StringVar(&cfg.archiveDir, "archiveDir", "", "Directory to move the compacted WAL files to once the new file is written")
+	flag.BoolVar(&cfg.deleteOld, "delete", false, "Delete the compacted WAL files once the new file is written")
+	flag.BoolVar(&cfg.includeNewest, "includeNewest", false, "Also compact the newest WAL file, which a running server may still be writing to")
+	flag.BoolVar(&cfg.ignoreBadFiles, "ignoreBadFiles", false, "Skip unreadable WAL files and records instead of stopping")
+	flag.Parse()
+
+	if cfg.walDir == "" {
+		log.Fatal("--walDir is required")
+	}
+	if cfg.outDir == "" {
+		cfg.outDir = cfg.walDir
+	}
+	if cfg.archiveDir != "" && cfg.deleteOld {
+		log.Fatal("--archiveDir and --delete can't be used together")
+	}
+	if cfg.archiveDir != "" {
+		s, err := os.Stat(cfg.archiveDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !s.IsDir() {
+			log.Fatal(cfg.archiveDir + " is not a directory!")
+		}
+	}
+
+	if err := compact(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// compact folds the WAL files in cfg.walDir into a single file holding only the patterns that
+// are still live (and the deletes needed to remove anything added before the first file), then
+// archives or deletes the files it replaced.
+func compact(cfg compactorConfig) error {
+	files, err := wal.ListWalFiles(cfg.walDir, cfg.walPrefix)
+	if err != nil {
+		return err
+	}
+	// The newest file is left alone by default, since a server may still be appending to it.
+	if !cfg.includeNewest && len(files) > 0 {
+		files = files[:len(files)-1]
+	}
+	if len(files) < 2 {
+		log.Printf("Nothing to compact (%d file(s) eligible)", len(files))
+		return nil
+	}
+
+	ls := newLiveSet()
+	var totalEntries, totalErrors int
+	for _, f := range files {
+		ct, errCt, err := foldFile(ls, f)
+		totalEntries += ct
+		totalErrors += errCt
+		if err != nil {
+			if !cfg.ignoreBadFiles {
+				return fmt.Errorf("%s: %w", f, err)
+			}
+			log.Printf("Skipping %s: %s", f, err.Error())
+		}
+	}
+	entries := ls.entries()
+	var live int
+	for _, e := range entries {
+		if e.Action == wal.WAL_ADD {
+			live++
+		}
+	}
+	log.Printf("Read %d entries from %d files (%d errors), %d patterns are live, %d deletes kept", totalEntries, len(files), totalErrors, live, len(entries)-live)
+
+	// Name the new file just after the newest file it replaces, so that it is replayed before
+	// anything written since.
+	lastTs, err := wal.FileTimestamp(files[len(files)-1], cfg.walPrefix)
+	if err != nil {
+		return err
+	}
+	outFile, err := wal.CreateWalFileAt(cfg.outDir, cfg.walPrefix, lastTs+1)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", outFile, err)
+	}
+	wf, err := wal.OpenWalFile(outFile)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = wf.Write(int64(e.Timestamp), e.Key, e.Pattern, e.Action); err != nil {
+			wf.Close()
+			return fmt.Errorf("writing %s: %w", outFile, err)
+		}
+	}
+	wf.Close()
+	log.Printf("Wrote %d entries to %s", len(entries), outFile)
+
+	for _, f := range files {
+		if f == outFile {
+			continue
+		}
+		if cfg.deleteOld {
+			if err = os.Remove(f); err != nil {
+				return err
+			}
+			log.Printf("Deleted %s", f)
+		} else if cfg.archiveDir != "" {
+			dest := filepath.Join(cfg.archiveDir, filepath.Base(f))
+			if err = os.Rename(f, dest); err != nil {
+				return err
+			}
+			log.Printf("Archived %s to %s", f, dest)
+		}
+	}
+	if !cfg.deleteOld && cfg.archiveDir == "" && cfg.outDir == cfg.walDir {
+		log.Printf("Compacted files were left in place; they can be removed, since %s supersedes them", outFile)
+	}
+	return nil
+}
+
+// foldFile applies every entry in a WAL file to the live set, returning the number of entries
+// read and the number that couldn't be applied. The file is opened read-only, so that a file
+// another process is still writing to is never truncated.
+func foldFile(ls *liveSet, fileName string) (int, int, error) {
+	wf, err := wal.OpenWalFileReadOnly(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer wf.Close()
+	var ct, errCt int
+	for wf.HasNext() {
+		e, err := wf.Next()
+		if err != nil {
+			return ct, errCt + 1, errors.New("wal.Next: " + err.Error())
+		}
+		ct++
+		if err = ls.apply(e); err != nil {
+			log.Printf("%s: entry %d: %s", fileName, ct, err.Error())
+			errCt++
+		}
+	}
+	return ct, errCt, nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/wal"
+	flag "github.com/spf13/pflag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+type inspectorConfig struct {
+	mode      string
+	walPrefix string
+	key       string
+	from      string
+	to        string
+	fromTs    uint64
+	toTs      uint64
+}
+
+// dumpRecord is a single line of dump output.
+type dumpRecord struct {
+	File      string      `json:"file"`
+	Offset    int64       `json:"offset"`
+	Timestamp uint64      `json:"timestamp"`
+	Time      string      `json:"time"`
+	Action    string      `json:"action"`
+	Key       string      `json:"key"`
+	Pattern   interface{} `json:"pattern"`
+}
+
+// verifyResult is a single line of verify output.
+type verifyResult struct {
+	File               string `json:"file"`
+	Version            string `json:"version,omitempty"`
+	Records            int    `json:"records"`
+	Ok                 bool   `json:"ok"`
+	CorruptRecords     int    `json:"corruptRecords"`
+	FirstCorruptOffset *int64 `json:"firstCorruptOffset,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+func main() {
+	cfg := inspectorConfig{}
+	flag.StringVar(&cfg.mode, "mode", "dump", "What to do: 'dump' records as NDJSON, 'verify' file structure, or print summary 'stats'")
+	flag.StringVar(&cfg.walPrefix, "walPrefix", "mwal-", "Prefix of the WAL files to read when given a directory")
+	flag.StringVar(&cfg.key, "key", "", "Only include records for this key")
+	flag.StringVar(&cfg.from, "from", "", "Only include records at or after this time (RFC3339 or nanoseconds since the epoch)")
+	flag.StringVar(&cfg.to, "to", "", "Only include records at or before this time (RFC3339 or nanoseconds since the epoch)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <WAL file or directory>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if cfg.fromTs, err = parseTime(cfg.from); err != nil {
+		log.Fatal("--from: " + err.Error())
+	}
+	if cfg.toTs, err = parseTime(cfg.to); err != nil {
+		log.Fatal("--to: " + err.Error())
+	}
+	files, err := expandPaths(flag.Args(), cfg.walPrefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cfg.mode {
+	case "dump":
+		err = dump(os.Stdout, cfg, files)
+	case "verify":
+		var ok bool
+		ok, err = verify(os.Stdout, files)
+		if err == nil && !ok {
+			os.Exit(1)
+		}
+	case "stats":
+		err = stats(os.Stdout, cfg, files)
+	default:
+		err = errors.New("unknown mode \"" + cfg.mode + "\" (expected dump, verify or stats)")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseTime accepts either an RFC3339 time or a timestamp in nanoseconds since the epoch. An empty
+// string is returned as 0.
+func parseTime(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(t.UnixNano()), nil
+}
+
+// expandPaths replaces any directories in paths with the WAL files in them, in replay order.
+func expandPaths(paths []string, prefix string) ([]string, error) {
+	files := make([]string, 0)
+	for _, p := range paths {
+		s, err := os.Stat(p)
+		if err != nil {
+			return files, err
+		}
+		if !s.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		dirFiles, err := wal.ListWalFiles(p, prefix)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// matches applies the key and time range filters to an entry.
+func (cfg inspectorConfig) matches(e wal.WalEntry) bool {
+	if cfg.key != "" && string(e.Key) != cfg.key {
+		return false
+	}
+	if cfg.fromTs > 0 && e.Timestamp < cfg.fromTs {
+		return false
+	}
+	if cfg.toTs > 0 && e.Timestamp > cfg.toTs {
+		return false
+	}
+	return true
+}
+
+// eachEntry calls fn with every readable entry in a file and its offset, and errFn with every
+// error. Files are opened read-only, so a torn final record is reported rather than cut off.
+func eachEntry(fileName string, fn func(offset int64, e wal.WalEntry), errFn func(offset int64, err error)) (string, error) {
+	wf, err := wal.OpenWalFileReadOnly(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer wf.Close()
+	for wf.HasNext() {
+		offset := wf.Offset()
+		e, err := wf.Next()
+		if err != nil {
+			errFn(offset, err)
+			continue
+		}
+		fn(offset, e)
+	}
+	return wf.Version, nil
+}
+
+// newDumpRecord formats an entry read from a file for dump output.
+func newDumpRecord(fileName string, offset int64, e wal.WalEntry) dumpRecord {
+	rec := dumpRecord{
+		File:      fileName,
+		Offset:    offset,
+		Timestamp: e.Timestamp,
+		Time:      time.Unix(0, int64(e.Timestamp)).UTC().Format(time.RFC3339Nano),
+		Action:    wal.ActionName(e.Action),
+		Key:       string(e.Key),
+	}
+	// Patterns are embedded as JSON where possible, and as strings otherwise.
+	if js, err := e.GetPatternAsJson(); err == nil {
+		rec.Pattern = json.RawMessage(js)
+	} else {
+		rec.Pattern = string(e.Pattern)
+	}
+	return rec
+}
+
+// dump writes every entry in the files that passes the filters to w, one JSON record per line.
+// Damaged records are logged and skipped.
+func dump(w io.Writer, cfg inspectorConfig, files []string) error {
+	enc := json.NewEncoder(w)
+	for _, f := range files {
+		var encErr error
+		_, err := eachEntry(f, func(offset int64, e wal.WalEntry) {
+			if encErr != nil || !cfg.matches(e) {
+				return
+			}
+			encErr = enc.Encode(newDumpRecord(f, offset, e))
+		}, func(offset int64, err error) {
+			log.Printf("%s: %s", f, err.Error())
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		if encErr != nil {
+			return encErr
+		}
+	}
+	return nil
+}
+
+// verify checks every record in each file, writing a result line per file to w. It returns false
+// if any file is damaged.
+func verify(w io.Writer, files []string) (bool, error) {
+	enc := json.NewEncoder(w)
+	allOk := true
+	for _, f := range files {
+		res := verifyResult{File: f, Ok: true}
+		version, err := eachEntry(f, func(offset int64, e wal.WalEntry) {
+			res.Records++
+		}, func(offset int64, err error) {
+			res.Ok = false
+			res.CorruptRecords++
+			if res.FirstCorruptOffset == nil {
+				o := offset
+				res.FirstCorruptOffset = &o
+				res.Error = err.Error()
+			}
+		})
+		res.Version = version
+		if err != nil {
+			res.Ok = false
+			res.Error = err.Error()
+		}
+		if !res.Ok {
+			allOk = false
+		}
+		if err = enc.Encode(res); err != nil {
+			return allOk, err
+		}
+	}
+	return allOk, nil
+}
+
+// fileStats summarizes the records in one file, or across all of them.
+type fileStats struct {
+	File           string         `json:"file,omitempty"`
+	Version        string         `json:"version,omitempty"`
+	Bytes          int64          `json:"bytes"`
+	Records        int            `json:"records"`
+	Actions        map[string]int `json:"actions"`
+	Keys           int            `json:"keys"`
+	CorruptRecords int            `json:"corruptRecords"`
+	FirstTime      string         `json:"firstTime,omitempty"`
+	LastTime       string         `json:"lastTime,omitempty"`
+	keys           map[string]bool
+	firstTs        uint64
+	lastTs         uint64
+}
+
+func newFileStats(fileName string) *fileStats {
+	return &fileStats{
+		File:    fileName,
+		Actions: make(map[string]int),
+		keys:    make(map[string]bool),
+	}
+}
+
+func (s *fileStats) add(e wal.WalEntry) {
+	s.Records++
+	s.Actions[wal.ActionName(e.Action)]++
+	s.keys[string(e.Key)] = true
+	if s.firstTs == 0 || e.Timestamp < s.firstTs {
+		s.firstTs = e.Timestamp
+	}
+	if e.Timestamp > s.lastTs {
+		s.lastTs = e.Timestamp
+	}
+}
+
+func (s *fileStats) finish() {
+	s.Keys = len(s.keys)
+	if s.Records > 0 {
+		s.FirstTime = time.Unix(0, int64(s.firstTs)).UTC().Format(time.RFC3339Nano)
+		s.LastTime = time.Unix(0, int64(s.lastTs)).UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// stats writes a summary of each file to w, followed by the totals across all of them.
+func stats(w io.Writer, cfg inspectorConfig, files []string) error {
+	type statsOutput struct {
+		Files []*fileStats `json:"files"`
+		Total *fileStats   `json:"total"`
+	}
+	out := statsOutput{
+		Files: make([]*fileStats, 0, len(files)),
+		Total: newFileStats(""),
+	}
+	for _, f := range files {
+		fs := newFileStats(f)
+		if s, err := os.Stat(f); err == nil {
+			fs.Bytes = s.Size()
+		}
+		version, err := eachEntry(f, func(offset int64, e wal.WalEntry) {
+			if !cfg.matches(e) {
+				return
+			}
+			fs.add(e)
+			out.Total.add(e)
+		}, func(offset int64, err error) {
+			fs.CorruptRecords++
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		fs.Version = version
+		fs.finish()
+		out.Files = append(out.Files, fs)
+		out.Total.Bytes += fs.Bytes
+		out.Total.CorruptRecords += fs.CorruptRecords
+	}
+	out.Total.finish()
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/highgrav/munchkin/internal/wal"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// walHeaderSize is the size of the header at the start of every WAL file.
+const walHeaderSize = 256
+
+// writeWalFile writes a WAL file in the given format holding the same three entries, returning its
+// name. New files are always V3, so older formats are created by writing their header first.
+func writeWalFile(t *testing.T, dir, version string) string {
+	t.Helper()
+	fileName := filepath.Join(dir, "mwal-"+version+".wal")
+	hdr := make([]byte, walHeaderSize)
+	copy(hdr, version)
+	if err := os.WriteFile(fileName, hdr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wf, err := wal.OpenWalFile(fileName)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wf.Close()
+	if wf.Version != version {
+		t.Fatalf("Expected a %s file, got %s", version, wf.Version)
+	}
+	for _, e := range []struct {
+		ts      int64
+		key     string
+		pattern string
+		action  uint16
+	}{
+		{100, "first-test-key", `{ "sys": [ "filestore" ] }`, wal.WAL_ADD},
+		{200, "second-test-key", `{"evt":["file-created"]}`, wal.WAL_ADD},
+		{300, "first-test-key", "-", wal.WAL_DEL},
+	} {
+		if err = wf.Write(e.ts, []byte(e.key), []byte(e.pattern), e.action); err != nil {
+			t.Fatal("wf.Write: " + err.Error())
+		}
+	}
+	return fileName
+}
+
+// decodeLines decodes each line of NDJSON output into a map.
+func decodeLines(t *testing.T, out []byte) []map[string]any {
+	t.Helper()
+	lines := make([]map[string]any, 0)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		var m map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("Output line isn't JSON: %s", sc.Text())
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestDump(t *testing.T) {
+	for _, version := range []string{wal.WAL_HEADER_V1, wal.WAL_HEADER_V2, wal.WAL_HEADER_V3} {
+		t.Run(version, func(t *testing.T) {
+			fileName := writeWalFile(t, t.TempDir(), version)
+			var out bytes.Buffer
+			if err := dump(&out, inspectorConfig{}, []string{fileName}); err != nil {
+				t.Fatal("dump: " + err.Error())
+			}
+			recs := decodeLines(t, out.Bytes())
+			if len(recs) != 3 {
+				t.Fatalf("Expected 3 records, got %d: %s", len(recs), out.String())
+			}
+			for x, want := range []struct {
+				key     string
+				action  string
+				pattern string
+			}{
+				{"first-test-key", "add", `{"sys":["filestore"]}`},
+				{"second-test-key", "add", `{"evt":["file-created"]}`},
+				{"first-test-key", "delete", "null"},
+			} {
+				rec := recs[x]
+				pattern, _ := json.Marshal(rec["pattern"])
+				if rec["file"] != fileName || rec["key"] != want.key || rec["action"] != want.action || string(pattern) != want.pattern {
+					t.Errorf("Unexpected record %d: %v", x, rec)
+				}
+				if rec["timestamp"] != float64(100*(x+1)) {
+					t.Errorf("Expected record %d at %d, got %v", x, 100*(x+1), rec["timestamp"])
+				}
+			}
+			if recs[0]["offset"] != float64(walHeaderSize) || recs[1]["offset"].(float64) <= recs[0]["offset"].(float64) {
+				t.Errorf("Expected offsets to start after the header and increase, got %v and %v", recs[0]["offset"], recs[1]["offset"])
+			}
+			if recs[0]["time"] != "1970-01-01T00:00:00.0000001Z" {
+				t.Errorf("Unexpected time %v", recs[0]["time"])
+			}
+
+			// Filters are applied to every format.
+			out.Reset()
+			if err := dump(&out, inspectorConfig{key: "first-test-key", fromTs: 150}, []string{fileName}); err != nil {
+				t.Fatal("dump: " + err.Error())
+			}
+			if recs = decodeLines(t, out.Bytes()); len(recs) != 1 || recs[0]["action"] != "delete" {
+				t.Errorf("Expected only the delete to pass the filters, got %s", out.String())
+			}
+		})
+	}
+}
+
+func TestNewDumpRecordKeepsInvalidPatterns(t *testing.T) {
+	rec := newDumpRecord("mwal-1.wal", walHeaderSize, wal.WalEntry{
+		Timestamp: 100,
+		Key:       []byte("first-test-key"),
+		Pattern:   []byte(`{"sys":`),
+		Action:    wal.WAL_ADD,
+	})
+	if rec.Pattern != `{"sys":` {
+		t.Errorf("Expected a pattern that isn't JSON to be kept as a string, got %v", rec.Pattern)
+	}
+	if _, err := json.Marshal(rec); err != nil {
+		t.Error("Expected the record to encode, got " + err.Error())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	versions := []string{wal.WAL_HEADER_V1, wal.WAL_HEADER_V2, wal.WAL_HEADER_V3}
+	files := make([]string, len(versions))
+	for x, version := range versions {
+		files[x] = writeWalFile(t, dir, version)
+	}
+	var out bytes.Buffer
+	ok, err := verify(&out, files)
+	if err != nil || !ok {
+		t.Fatalf("Expected every file to verify, got %v (%v): %s", ok, err, out.String())
+	}
+	for x, res := range decodeLines(t, out.Bytes()) {
+		if res["version"] != versions[x] || res["records"] != float64(3) || res["ok"] != true {
+			t.Errorf("Unexpected result for %s: %v", files[x], res)
+		}
+	}
+
+	// Damage the payload of the V2 file's first record; the checksum catches it and reading resumes
+	// at the next record.
+	b, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[walHeaderSize+20] ^= 0xFF
+	if err = os.WriteFile(files[1], b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if ok, err = verify(&out, files[1:2]); err != nil || ok {
+		t.Fatalf("Expected the damaged file to fail verification, got %v (%v)", ok, err)
+	}
+	res := decodeLines(t, out.Bytes())[0]
+	if res["records"] != float64(2) || res["corruptRecords"] != float64(1) || res["firstCorruptOffset"] != float64(walHeaderSize) {
+		t.Errorf("Unexpected result for the damaged file: %v", res)
+	}
+}
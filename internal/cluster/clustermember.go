@@ -8,12 +8,26 @@ import (
 	"os"
 )
 
+// Tags that members advertise their service addresses under.
+const (
+	TagRpcAddr   = "rpc-addr"
+	TagMatchAddr = "match-addr"
+	TagAdminAddr = "admin-addr"
+)
+
+// SerfEventHandler is told about changes to the other members of the cluster. addr is the
+// member's advertised rpc-addr tag.
 type SerfEventHandler interface {
+	// Join is called when a member joins, or comes back after failing.
 	Join(name, addr string) error
+	// Leave is called when a member leaves gracefully.
 	Leave(name, addr string) error
+	// Fail is called when a member stops responding.
 	Fail(name, addr string) error
+	// Reap is called when a failed or departed member is forgotten for good.
 	Reap(name, addr string) error
-	Update() error
+	// Update is called when a member's tags change.
+	Update(name, addr string) error
 }
 
 type ClusterMember struct {
@@ -31,36 +45,69 @@ func (m *ClusterMember) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// MemberTags returns the tags advertised by the named member, or false if it isn't known.
+func (m *ClusterMember) MemberTags(name string) (map[string]string, bool) {
+	for _, mem := range m.serf.Members() {
+		if mem.Name == name {
+			return mem.Tags, true
+		}
+	}
+	return nil, false
+}
+
+// SetTags replaces the tags this member advertises, and lets the rest of the cluster know.
+func (m *ClusterMember) SetTags(tags map[string]string) error {
+	if err := m.serf.SetTags(tags); err != nil {
+		return err
+	}
+	m.Tags = tags
+	return nil
+}
+
 func (m *ClusterMember) Leave() error {
 	return m.serf.Leave()
 }
 
+// Shutdown leaves the cluster and stops taking part in it.
+func (m *ClusterMember) Shutdown() error {
+	if err := m.serf.Leave(); err != nil {
+		m.logger.Warn("serf: leave failed", zap.Error(err))
+	}
+	return m.serf.Shutdown()
+}
+
 func (m *ClusterMember) isLocal(member serf.Member) bool {
 	return m.serf.LocalMember().Name == member.Name
 }
 
 func (m *ClusterMember) handleMemberJoined(member serf.Member) {
-	if err := m.handler.Join(member.Name, member.Tags["rpc-addr"]); err != nil {
-		m.logger.Error("serf: join failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags["rpc_addr"]))
+	if err := m.handler.Join(member.Name, member.Tags[TagRpcAddr]); err != nil {
+		m.logger.Error("serf: join failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags[TagRpcAddr]))
 	}
 }
 
 func (m *ClusterMember) handleMemberLeft(member serf.Member) {
-	if err := m.handler.Leave(member.Name, member.Tags["rpc-addr"]); err != nil {
-		m.logger.Error("serf: leave failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags["rpc_addr"]))
+	if err := m.handler.Leave(member.Name, member.Tags[TagRpcAddr]); err != nil {
+		m.logger.Error("serf: leave failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags[TagRpcAddr]))
 	}
 }
 
 func (m *ClusterMember) handleMemberFailed(member serf.Member) {
-
+	if err := m.handler.Fail(member.Name, member.Tags[TagRpcAddr]); err != nil {
+		m.logger.Error("serf: fail failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags[TagRpcAddr]))
+	}
 }
 
 func (m *ClusterMember) handleMemberReaped(member serf.Member) {
-
+	if err := m.handler.Reap(member.Name, member.Tags[TagRpcAddr]); err != nil {
+		m.logger.Error("serf: reap failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags[TagRpcAddr]))
+	}
 }
 
 func (m *ClusterMember) handleMemberUpdated(member serf.Member) {
-
+	if err := m.handler.Update(member.Name, member.Tags[TagRpcAddr]); err != nil {
+		m.logger.Error("serf: update failed", zap.Error(err), zap.String("name", member.Name), zap.String("rpc_addr", member.Tags[TagRpcAddr]))
+	}
 }
 
 func (m *ClusterMember) eventHandler() {
@@ -90,9 +137,19 @@ func (m *ClusterMember) eventHandler() {
 		case serf.EventMemberReap:
 			// Serf reaps members that have timed out and exceeded the
 			// recovery duration.
-			// TODO
+			for _, mem := range e.(serf.MemberEvent).Members {
+				if m.isLocal(mem) {
+					continue
+				}
+				m.handleMemberReaped(mem)
+			}
 		case serf.EventMemberUpdate:
-			// TODO
+			for _, mem := range e.(serf.MemberEvent).Members {
+				if m.isLocal(mem) {
+					continue
+				}
+				m.handleMemberUpdated(mem)
+			}
 		case serf.EventQuery:
 			// TODO
 		case serf.EventUser:
@@ -101,13 +158,16 @@ func (m *ClusterMember) eventHandler() {
 	}
 }
 
-func NewClusterMember(nodeName, addr string, tags map[string]string, addrsToJoin []string, logger *zap.Logger) (*ClusterMember, error) {
+// NewClusterMember starts a Serf member bound to addr and joins it to the cluster through any of
+// addrsToJoin. Membership changes for other members are passed to handler.
+func NewClusterMember(nodeName, addr string, tags map[string]string, addrsToJoin []string, handler SerfEventHandler, logger *zap.Logger) (*ClusterMember, error) {
 	m := &ClusterMember{
 		NodeName: nodeName,
 		Address:  addr,
 		Tags:     tags,
 		Peers:    addrsToJoin,
 		logger:   logger,
+		handler:  handler,
 	}
 	if err := m.setUpSerf(); err != nil {
 		return nil, err
@@ -147,7 +207,7 @@ func (m *ClusterMember) setUpSerf() error {
 	go m.eventHandler()
 
 	// Join cluster
-	if m.Peers != nil {
+	if len(m.Peers) > 0 {
 		_, err = m.serf.Join(m.Peers, true)
 		if err != nil {
 			return err
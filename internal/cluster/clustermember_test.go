@@ -2,92 +2,181 @@ package cluster
 
 import (
 	"fmt"
-	"github.com/cmertens/munchkin/internal/net"
+	"github.com/highgrav/munchkin/internal/net"
 	"go.uber.org/zap"
-	"log"
 	"strconv"
 	"testing"
+	"time"
 )
 
 var zaplog *zap.Logger
-var memberCount int = 5
+var memberCount int = 3
+
+// eventWait is how long to wait for a membership change to reach another member. Failures take
+// the longest, since they have to go unanswered for a while before Serf gives up on a member.
+const eventWait = 30 * time.Second
+
+type testClusterEvent struct {
+	name string
+	addr string
+}
 
 type testClusterHandler struct {
-	chJoin  chan map[string]string
-	chLeave chan string
+	chJoin   chan testClusterEvent
+	chLeave  chan testClusterEvent
+	chFail   chan testClusterEvent
+	chReap   chan testClusterEvent
+	chUpdate chan testClusterEvent
 }
 
-func (h *testClusterHandler) Join(name, addr string) error {
-	if h.chJoin != nil {
-		h.chJoin <- map[string]string{
-			"id":   name,
-			"addr": addr,
-		}
+func newTestClusterHandler() *testClusterHandler {
+	return &testClusterHandler{
+		chJoin:   make(chan testClusterEvent, memberCount*2),
+		chLeave:  make(chan testClusterEvent, memberCount*2),
+		chFail:   make(chan testClusterEvent, memberCount*2),
+		chReap:   make(chan testClusterEvent, memberCount*2),
+		chUpdate: make(chan testClusterEvent, memberCount*2),
 	}
+}
+
+func (h *testClusterHandler) Join(name, addr string) error {
+	h.chJoin <- testClusterEvent{name, addr}
 	return nil
 }
 
 func (h *testClusterHandler) Leave(name, addr string) error {
-	if h.chLeave != nil {
-		h.chLeave <- name
-	}
+	h.chLeave <- testClusterEvent{name, addr}
 	return nil
 }
 
 func (h *testClusterHandler) Fail(name, addr string) error {
+	h.chFail <- testClusterEvent{name, addr}
 	return nil
 }
 
 func (h *testClusterHandler) Reap(name, addr string) error {
+	h.chReap <- testClusterEvent{name, addr}
 	return nil
 }
 
-func (h *testClusterHandler) Update() error {
+func (h *testClusterHandler) Update(name, addr string) error {
+	h.chUpdate <- testClusterEvent{name, addr}
 	return nil
 }
 
+// waitFor waits for an event about the named member, skipping events about other members.
+func waitFor(t *testing.T, ch chan testClusterEvent, kind, name string) testClusterEvent {
+	t.Helper()
+	timeout := time.After(eventWait)
+	for {
+		select {
+		case evt := <-ch:
+			if evt.name == name {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s of member %s", kind, name)
+			return testClusterEvent{}
+		}
+	}
+}
+
 func TestClusterMembership(t *testing.T) {
 	zaplog = zap.NewExample()
 	var mems []*ClusterMember
+	var handlers []*testClusterHandler
 	for x := 0; x < memberCount; x++ {
-		mems, _ = setUpClusterMember(t, nil)
+		var h *testClusterHandler
+		mems, h = setUpClusterMember(t, mems)
+		handlers = append(handlers, h)
+	}
+	defer func() {
+		for _, m := range mems {
+			_ = m.serf.Shutdown()
+		}
+	}()
+
+	// The first member should hear about everyone else joining, with their rpc-addr tags.
+	for _, m := range mems[1:] {
+		evt := waitFor(t, handlers[0].chJoin, "join", m.NodeName)
+		if evt.addr != m.Tags[TagRpcAddr] {
+			t.Errorf("Expected member %s to join with rpc-addr %s, got %s", m.NodeName, m.Tags[TagRpcAddr], evt.addr)
+		}
+	}
+	if len(mems[0].Members()) != memberCount {
+		t.Errorf("Expected %d members, found %d", memberCount, len(mems[0].Members()))
 	}
-	mems[0].Leave()
 }
 
-// setUpClusterMember adds a new ClusterMember to an array of ClusterMembers
-func setUpClusterMember(t *testing.T, members []*ClusterMember) ([]*ClusterMember, SerfEventHandler) {
-	var clmbr *ClusterMember = nil
-	var err error
+func TestClusterMemberUpdateLeaveAndFail(t *testing.T) {
+	zaplog = zap.NewExample()
+	var mems []*ClusterMember
+	var handlers []*testClusterHandler
+	for x := 0; x < memberCount; x++ {
+		var h *testClusterHandler
+		mems, h = setUpClusterMember(t, mems)
+		handlers = append(handlers, h)
+	}
+	defer func() {
+		for _, m := range mems {
+			_ = m.serf.Shutdown()
+		}
+	}()
+	for _, m := range mems[1:] {
+		waitFor(t, handlers[0].chJoin, "join", m.NodeName)
+	}
+
+	// A changed rpc-addr should be passed on as an update.
+	newAddr := "127.0.0.1:1"
+	if err := mems[1].SetTags(map[string]string{TagRpcAddr: newAddr}); err != nil {
+		t.Fatal("SetTags: " + err.Error())
+	}
+	evt := waitFor(t, handlers[0].chUpdate, "update", mems[1].NodeName)
+	if evt.addr != newAddr {
+		t.Errorf("Expected updated rpc-addr %s, got %s", newAddr, evt.addr)
+	}
+	if tags, ok := mems[0].MemberTags(mems[1].NodeName); !ok || tags[TagRpcAddr] != newAddr {
+		t.Errorf("Expected member tags to show rpc-addr %s, got %v", newAddr, tags)
+	}
+
+	// A graceful leave is reported as a leave...
+	if err := mems[2].Leave(); err != nil {
+		t.Fatal("Leave: " + err.Error())
+	}
+	waitFor(t, handlers[0].chLeave, "leave", mems[2].NodeName)
+
+	// ...while a member that just stops responding is reported as failed.
+	if err := mems[1].serf.Shutdown(); err != nil {
+		t.Fatal("Shutdown: " + err.Error())
+	}
+	evt = waitFor(t, handlers[0].chFail, "failure", mems[1].NodeName)
+	if evt.addr != newAddr {
+		t.Errorf("Expected the failed member's last rpc-addr %s, got %s", newAddr, evt.addr)
+	}
+}
+
+// setUpClusterMember adds a new ClusterMember to an array of ClusterMembers, joining it to the
+// first member, and returns the array along with the new member's handler.
+func setUpClusterMember(t *testing.T, members []*ClusterMember) ([]*ClusterMember, *testClusterHandler) {
 	// Get a unique ID for this cluster based on total number of cluster members
 	// (This works because it's a single-threaded, single-process test scenario)
 	id := len(members)
 
-	addrs, _ := net.GetFreePorts(1, 5000, 0)
-	if len(addrs) < 1 {
-		log.Fatal("No free ports available for cluster!")
-	}
-	addr := fmt.Sprintf("127.0.0.1:%d", addrs[0])
-	fmt.Println("Binding to " + addr)
-	tags := map[string]string{"rpc_addr": addr}
-	handler := &testClusterHandler{}
-
-	if (len(members)) == 0 {
-		handler.chJoin = make(chan map[string]string, memberCount)
-		handler.chLeave = make(chan string, memberCount)
-		clmbr, err = NewClusterMember(strconv.Itoa(id), addr, tags, []string{}, zaplog)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		mems := []string{
-			members[0].Address,
-		}
-		clmbr, err = NewClusterMember(strconv.Itoa(id), addr, tags, mems, zaplog)
-		if err != nil {
-			log.Fatal(err)
-		}
+	ports, _ := net.GetFreePorts(1, 5000, 0)
+	if len(ports) < 1 {
+		t.Fatal("No free ports available for cluster!")
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	tags := map[string]string{TagRpcAddr: addr}
+	handler := newTestClusterHandler()
+
+	peers := []string{}
+	if len(members) > 0 {
+		peers = append(peers, members[0].Address)
+	}
+	clmbr, err := NewClusterMember(strconv.Itoa(id), addr, tags, peers, handler, zaplog)
+	if err != nil {
+		t.Fatal(err)
 	}
-	members = append(members, clmbr)
-	return members, handler
+	return append(members, clmbr), handler
 }
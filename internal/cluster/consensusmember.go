@@ -1,9 +1,339 @@
 package cluster
 
 import (
-	"google.golang.org/grpc"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
+// TagRaftAddr is the tag members advertise their Raft transport address under.
+const TagRaftAddr = "raft-addr"
+
+const (
+	raftMaxPool          = 3
+	raftTransportTimeout = 10 * time.Second
+	raftSnapshotsRetain  = 2
+)
+
+// ErrNotLeader is returned when a change is submitted to a member that isn't the Raft leader.
+var ErrNotLeader = raft.ErrNotLeader
+
+// IsLeadershipError reports whether a change failed because the member it was submitted to isn't
+// the leader, or stopped being the leader before the change was committed. Such changes may
+// succeed if they're submitted again to the current leader, although a change that was in flight
+// when leadership was lost may also have been committed.
+func IsLeadershipError(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) ||
+		errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress)
+}
+
+// ConsensusConfig configures a ConsensusMember.
+type ConsensusConfig struct {
+	// NodeID identifies the member in the Raft configuration. It should match the member's Serf
+	// node name, so that Serf membership changes can be applied to the Raft configuration.
+	NodeID string
+	// BindAddr is the address (host:port) the Raft transport listens on.
+	BindAddr string
+	// AdvertiseAddr is the address other members reach the transport on, if BindAddr isn't
+	// routable (as when it binds to all interfaces).
+	AdvertiseAddr string
+	// DataDir holds the Raft log, stable store and snapshots.
+	DataDir string
+	// Bootstrap starts a new cluster with this member as its only voter, if DataDir doesn't
+	// already hold Raft state.
+	Bootstrap bool
+	// HeartbeatTimeout and ElectionTimeout override Raft's defaults if they're set.
+	HeartbeatTimeout time.Duration
+	ElectionTimeout  time.Duration
+}
+
+// ConsensusMember commits changes through a Raft log, so that every member applies the same
+// changes in the same order to its StateMachine.
 type ConsensusMember struct {
-	DialOptions []grpc.DialOption
+	NodeID    string
+	Address   string
+	raft      *raft.Raft
+	fsm       *replicator
+	transport *raft.NetworkTransport
+	store     *raftboltdb.BoltStore
+	logger    *zap.Logger
+}
+
+// NewConsensusMember starts a Raft member backed by sm. A member that isn't bootstrapped waits to
+// be added to an existing cluster by its leader.
+func NewConsensusMember(cfg ConsensusConfig, sm StateMachine, logger *zap.Logger) (*ConsensusMember, error) {
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	m := &ConsensusMember{
+		NodeID: cfg.NodeID,
+		logger: logger,
+	}
+	var err error
+	m.store, err = raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cfg.DataDir, raftSnapshotsRetain, os.Stderr)
+	if err != nil {
+		m.store.Close()
+		return nil, err
+	}
+
+	var advertise net.Addr
+	if cfg.AdvertiseAddr != "" {
+		if advertise, err = net.ResolveTCPAddr("tcp", cfg.AdvertiseAddr); err != nil {
+			m.store.Close()
+			return nil, err
+		}
+	}
+	m.transport, err = raft.NewTCPTransport(cfg.BindAddr, advertise, raftMaxPool, raftTransportTimeout, os.Stderr)
+	if err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	m.Address = string(m.transport.LocalAddr())
+
+	// Batches the state machine logged before this member was restarted are only replayed.
+	// Stores written before the logged index was kept fall back to the last index in the log.
+	loggedIndex, err := m.store.GetUint64(keyLoggedIndex)
+	if errors.Is(err, raftboltdb.ErrKeyNotFound) {
+		loggedIndex, err = m.store.LastIndex()
+	}
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	var snapshotIndex uint64
+	metas, err := snapshots.List()
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	if len(metas) > 0 {
+		snapshotIndex = metas[0].Index
+	}
+	m.fsm = newReplicator(sm, loggedIndex, snapshotIndex)
+	go m.fsm.trackLogged(m.store, logger)
+
+	rcfg := raft.DefaultConfig()
+	rcfg.LocalID = raft.ServerID(cfg.NodeID)
+	rcfg.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Info,
+		Output: os.Stderr,
+	})
+	if cfg.HeartbeatTimeout > 0 {
+		rcfg.HeartbeatTimeout = cfg.HeartbeatTimeout
+		rcfg.LeaderLeaseTimeout = cfg.HeartbeatTimeout
+	}
+	if cfg.ElectionTimeout > 0 {
+		rcfg.ElectionTimeout = cfg.ElectionTimeout
+	}
+	m.raft, err = raft.NewRaft(rcfg, m.fsm, m.store, m.store, snapshots, m.transport)
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	atomic.StoreInt32(&m.fsm.started, 1)
+
+	if cfg.Bootstrap {
+		hasState, err := raft.HasExistingState(m.store, m.store, snapshots)
+		if err != nil {
+			m.Shutdown()
+			return nil, err
+		}
+		if !hasState {
+			err = m.raft.BootstrapCluster(raft.Configuration{
+				Servers: []raft.Server{{
+					ID:      raft.ServerID(cfg.NodeID),
+					Address: m.transport.LocalAddr(),
+				}},
+			}).Error()
+			if err != nil {
+				m.Shutdown()
+				return nil, err
+			}
+			m.logger.Info("raft: bootstrapped a new cluster", zap.String("id", cfg.NodeID), zap.String("addr", m.Address))
+		}
+	}
+	return m, nil
+}
+
+// Apply commits entries through the Raft log and waits for this member to apply them. It must be
+// called on the leader; other members return ErrNotLeader.
+func (m *ConsensusMember) Apply(entries []wal.WalEntry, timeout time.Duration) (ApplyResult, error) {
+	cmd, err := encodeCommand(entries)
+	if err != nil {
+		return ApplyResult{}, err
+	}
+	f := m.raft.Apply(cmd, timeout)
+	if err = f.Error(); err != nil {
+		return ApplyResult{}, err
+	}
+	res, ok := f.Response().(ApplyResult)
+	if !ok {
+		return ApplyResult{}, fmt.Errorf("unexpected response %T from the state machine", f.Response())
+	}
+	return res, res.Err
+}
+
+// Join adds a member to the Raft configuration as a voter. Only the leader changes the
+// configuration, so it is a no-op on other members. A member that comes back under a new address
+// replaces its old entry.
+func (m *ConsensusMember) Join(id, addr string) error {
+	if !m.IsLeader() {
+		return nil
+	}
+	cf := m.raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		return err
+	}
+	for _, srv := range cf.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(addr) {
+			return nil
+		}
+		if srv.ID == raft.ServerID(id) || srv.Address == raft.ServerAddress(addr) {
+			if err := m.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return m.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0).Error()
+}
+
+// Remove takes a member out of the Raft configuration. Like Join, it is a no-op on members other
+// than the leader.
+func (m *ConsensusMember) Remove(id string) error {
+	if !m.IsLeader() {
+		return nil
+	}
+	return m.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// IsLeader reports whether this member is currently the leader.
+func (m *ConsensusMember) IsLeader() bool {
+	return m.raft.State() == raft.Leader
+}
+
+// Leader returns the Raft address and ID of the current leader, which are empty if there isn't
+// one.
+func (m *ConsensusMember) Leader() (string, string) {
+	addr, id := m.raft.LeaderWithID()
+	return string(addr), string(id)
+}
+
+// LeaderCh receives true when this member becomes the leader, and false when it stops being the
+// leader.
+func (m *ConsensusMember) LeaderCh() <-chan bool {
+	return m.raft.LeaderCh()
+}
+
+// WaitForLeader waits until the cluster has a leader, returning its Raft address.
+func (m *ConsensusMember) WaitForLeader(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if addr, _ := m.Leader(); addr != "" {
+			return addr, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("timed out waiting for a Raft leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// ConsensusServer is a member of the Raft configuration.
+type ConsensusServer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+}
+
+// Servers returns the members in the current Raft configuration.
+func (m *ConsensusMember) Servers() ([]ConsensusServer, error) {
+	cf := m.raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		return nil, err
+	}
+	servers := make([]ConsensusServer, 0, len(cf.Configuration().Servers))
+	for _, srv := range cf.Configuration().Servers {
+		servers = append(servers, ConsensusServer{
+			ID:      string(srv.ID),
+			Address: string(srv.Address),
+			Voter:   srv.Suffrage == raft.Voter,
+		})
+	}
+	return servers, nil
+}
+
+// State returns this member's Raft state (Leader, Follower, Candidate or Shutdown).
+func (m *ConsensusMember) State() string {
+	return m.raft.State().String()
+}
+
+// AppliedIndex returns the index of the last log entry applied on this member.
+func (m *ConsensusMember) AppliedIndex() uint64 {
+	return m.raft.AppliedIndex()
+}
+
+// WaitForApplied waits until this member has applied the log entry at index, returning false if it
+// hasn't by the time timeout runs out.
+func (m *ConsensusMember) WaitForApplied(index uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for m.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Leave prepares this member to stop for good. The leader removes departing followers from the
+// Raft configuration when they leave the Serf cluster, but a departing leader has to remove
+// itself. The last member of a cluster stays in the configuration, so that it can be restarted.
+func (m *ConsensusMember) Leave() error {
+	if !m.IsLeader() {
+		return nil
+	}
+	servers, err := m.Servers()
+	if err != nil {
+		return err
+	}
+	if len(servers) <= 1 {
+		return nil
+	}
+	return m.raft.RemoveServer(raft.ServerID(m.NodeID), 0, 0).Error()
+}
+
+// Shutdown stops taking part in the cluster. It doesn't change the Raft configuration; call Leave
+// first to do that.
+func (m *ConsensusMember) Shutdown() error {
+	err := m.raft.Shutdown().Error()
+	if cerr := m.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (m *ConsensusMember) close() error {
+	if m.fsm != nil {
+		m.fsm.stopTracking()
+	}
+	err := m.transport.Close()
+	if cerr := m.store.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -0,0 +1,322 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/highgrav/munchkin/internal/net"
+	"github.com/highgrav/munchkin/internal/snapshot"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const consensusWait = 10 * time.Second
+
+// testStateMachine keeps a key -> patterns map, and counts how many entries it was asked to log.
+// If logErr is set, logging the entries fails with it.
+type testStateMachine struct {
+	mu       sync.Mutex
+	keys     map[string][]string
+	gen      uint64
+	ts       uint64
+	logged   int
+	replayed int
+	logErr   error
+}
+
+func newTestStateMachine() *testStateMachine {
+	return &testStateMachine{keys: make(map[string][]string)}
+}
+
+func (sm *testStateMachine) ApplyEntries(entries []wal.WalEntry, replayed bool) ApplyResult {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, e := range entries {
+		switch e.Action {
+		case wal.WAL_ADD:
+			sm.keys[string(e.Key)] = append(sm.keys[string(e.Key)], string(e.Pattern))
+		case wal.WAL_DEL:
+			delete(sm.keys, string(e.Key))
+		default:
+			return ApplyResult{Generation: sm.gen, Err: fmt.Errorf("unknown action %d", e.Action)}
+		}
+		sm.ts++
+	}
+	sm.gen++
+	if replayed {
+		sm.replayed += len(entries)
+		return ApplyResult{Generation: sm.gen}
+	}
+	sm.logged += len(entries)
+	logged := make(chan error, 1)
+	logged <- sm.logErr
+	return ApplyResult{Generation: sm.gen, Timestamp: sm.ts, Logged: logged}
+}
+
+func (sm *testStateMachine) failLogging(err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.logErr = err
+}
+
+func (sm *testStateMachine) Snapshot() snapshot.Snapshot {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	keys := make(map[string][]string, len(sm.keys))
+	for k, v := range sm.keys {
+		keys[k] = append([]string(nil), v...)
+	}
+	return snapshot.Snapshot{Timestamp: sm.ts, Keys: keys}
+}
+
+func (sm *testStateMachine) Restore(s snapshot.Snapshot, replayed bool) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.keys = s.Keys
+	sm.ts = s.Timestamp
+	sm.gen++
+	return nil
+}
+
+func (sm *testStateMachine) patterns(key string) []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	p := append([]string(nil), sm.keys[key]...)
+	sort.Strings(p)
+	return p
+}
+
+func (sm *testStateMachine) counts() (int, int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.logged, sm.replayed
+}
+
+type testConsensusNode struct {
+	cfg    ConsensusConfig
+	sm     *testStateMachine
+	member *ConsensusMember
+}
+
+func startConsensusNode(t *testing.T, cfg ConsensusConfig, sm *testStateMachine) *testConsensusNode {
+	t.Helper()
+	m, err := NewConsensusMember(cfg, sm, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testConsensusNode{cfg: cfg, sm: sm, member: m}
+}
+
+func setUpConsensusCluster(t *testing.T, count int) []*testConsensusNode {
+	t.Helper()
+	ports, _ := net.GetFreePorts(count, 6000, 0)
+	if len(ports) < count {
+		t.Fatal("No free ports available for the cluster!")
+	}
+	nodes := make([]*testConsensusNode, 0, count)
+	for x := 0; x < count; x++ {
+		nodes = append(nodes, startConsensusNode(t, ConsensusConfig{
+			NodeID:           strconv.Itoa(x),
+			BindAddr:         fmt.Sprintf("127.0.0.1:%d", ports[x]),
+			DataDir:          t.TempDir(),
+			Bootstrap:        x == 0,
+			HeartbeatTimeout: 200 * time.Millisecond,
+			ElectionTimeout:  200 * time.Millisecond,
+		}, newTestStateMachine()))
+	}
+	if _, err := nodes[0].member.WaitForLeader(consensusWait); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes[1:] {
+		if err := nodes[0].member.Join(n.member.NodeID, n.member.Address); err != nil {
+			t.Fatal("Join: " + err.Error())
+		}
+	}
+	return nodes
+}
+
+// waitForPatterns waits until a node's state machine holds the expected patterns for a key.
+func waitForPatterns(t *testing.T, n *testConsensusNode, key string, expected ...string) {
+	t.Helper()
+	sort.Strings(expected)
+	deadline := time.Now().Add(consensusWait)
+	for {
+		got := n.sm.patterns(key)
+		if fmt.Sprint(got) == fmt.Sprint(expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Node %s: expected patterns %v for %s, got %v", n.member.NodeID, expected, key, got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func waitForNewLeader(t *testing.T, nodes []*testConsensusNode) *testConsensusNode {
+	t.Helper()
+	deadline := time.Now().Add(consensusWait)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n.member.IsLeader() {
+				return n
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for a new leader")
+	return nil
+}
+
+func addEntry(key, pattern string) []wal.WalEntry {
+	return []wal.WalEntry{{Action: wal.WAL_ADD, Key: []byte(key), Pattern: []byte(pattern)}}
+}
+
+func TestConsensusReplicatesAndSurvivesLeaderLoss(t *testing.T) {
+	nodes := setUpConsensusCluster(t, 3)
+	defer func() {
+		for _, n := range nodes {
+			_ = n.member.Shutdown()
+		}
+	}()
+
+	if _, err := nodes[1].member.Apply(addEntry("k", `{"a":[1]}`), time.Second); err != ErrNotLeader {
+		t.Errorf("Expected ErrNotLeader from a follower, got %v", err)
+	}
+	res, err := nodes[0].member.Apply(addEntry("k", `{"a":[1]}`), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Generation == 0 || res.Index == 0 {
+		t.Errorf("Expected the leader's generation and the log index in the result, got %+v", res)
+	}
+	if !nodes[2].member.WaitForApplied(res.Index, consensusWait) {
+		t.Errorf("Timed out waiting for node 2 to apply index %d", res.Index)
+	}
+	for _, n := range nodes {
+		waitForPatterns(t, n, "k", `{"a":[1]}`)
+	}
+
+	// Errors from the state machine come back to the caller.
+	if _, err = nodes[0].member.Apply([]wal.WalEntry{{Action: 1, Key: []byte("k")}}, time.Second); err == nil {
+		t.Error("Expected an error applying an unknown action")
+	}
+
+	// Losing the leader leaves a majority that elects a new one and keeps committing.
+	if err = nodes[0].member.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	leader := waitForNewLeader(t, nodes[1:])
+	if _, err = leader.member.Apply(addEntry("k", `{"b":[2]}`), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes[1:] {
+		waitForPatterns(t, n, "k", `{"a":[1]}`, `{"b":[2]}`)
+	}
+}
+
+func TestConsensusRestartReplaysWithoutLogging(t *testing.T) {
+	nodes := setUpConsensusCluster(t, 1)
+	n := nodes[0]
+	for x := 0; x < 3; x++ {
+		if _, err := n.member.Apply(addEntry("k", fmt.Sprintf(`{"a":[%d]}`, x)), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Snapshot partway through, so that the restart restores the snapshot and replays the rest.
+	if err := n.member.raft.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.member.Apply(addEntry("k", `{"a":[3]}`), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.member.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := startConsensusNode(t, n.cfg, newTestStateMachine())
+	defer restarted.member.Shutdown()
+	waitForPatterns(t, restarted, "k", `{"a":[0]}`, `{"a":[1]}`, `{"a":[2]}`, `{"a":[3]}`)
+	if logged, replayed := restarted.sm.counts(); logged != 0 || replayed != 1 {
+		t.Errorf("Expected 1 replayed and no logged entries after restarting, got %d replayed and %d logged", replayed, logged)
+	}
+
+	if _, err := restarted.member.Apply(addEntry("k", `{"a":[4]}`), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if logged, _ := restarted.sm.counts(); logged != 1 {
+		t.Errorf("Expected new entries to be logged, got %d", logged)
+	}
+}
+
+func TestConsensusRestartLogsWhatWasntLogged(t *testing.T) {
+	nodes := setUpConsensusCluster(t, 1)
+	n := nodes[0]
+	apply := func(m *ConsensusMember, pattern string) {
+		t.Helper()
+		if _, err := m.Apply(addEntry("k", pattern), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(n.member, `{"a":[0]}`)
+	apply(n.member, `{"a":[1]}`)
+	// Once a batch fails to be logged, neither it nor anything after it counts as logged.
+	n.sm.failLogging(errors.New("disk full"))
+	apply(n.member, `{"a":[2]}`)
+	n.sm.failLogging(nil)
+	apply(n.member, `{"a":[3]}`)
+	if err := n.member.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := startConsensusNode(t, n.cfg, newTestStateMachine())
+	defer restarted.member.Shutdown()
+	waitForPatterns(t, restarted, "k", `{"a":[0]}`, `{"a":[1]}`, `{"a":[2]}`, `{"a":[3]}`)
+	if logged, replayed := restarted.sm.counts(); logged != 2 || replayed != 2 {
+		t.Errorf("Expected 2 replayed and 2 logged entries after restarting, got %d replayed and %d logged", replayed, logged)
+	}
+	if err := restarted.member.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once they have been logged, they're only replayed.
+	again := startConsensusNode(t, n.cfg, newTestStateMachine())
+	defer again.member.Shutdown()
+	waitForPatterns(t, again, "k", `{"a":[0]}`, `{"a":[1]}`, `{"a":[2]}`, `{"a":[3]}`)
+	if logged, replayed := again.sm.counts(); logged != 0 || replayed != 4 {
+		t.Errorf("Expected 4 replayed and no logged entries after restarting again, got %d replayed and %d logged", replayed, logged)
+	}
+}
+
+func TestConsensusLeaderLeave(t *testing.T) {
+	nodes := setUpConsensusCluster(t, 2)
+	defer func() {
+		for _, n := range nodes {
+			_ = n.member.Shutdown()
+		}
+	}()
+
+	// A departing leader takes itself out of the configuration, leaving the rest to elect a leader.
+	if err := nodes[0].member.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	leader := waitForNewLeader(t, nodes[1:])
+	servers, err := leader.member.Servers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].ID != leader.member.NodeID {
+		t.Errorf("Expected only %s in the configuration, got %v", leader.member.NodeID, servers)
+	}
+
+	// The last member stays, so that it can be restarted.
+	if err = leader.member.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	if servers, _ = leader.member.Servers(); len(servers) != 1 {
+		t.Errorf("Expected the last member to stay in the configuration, got %v", servers)
+	}
+}
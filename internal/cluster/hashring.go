@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// TagShard is the tag members that hold a share of a sharded rule set advertise, set to the number
+// of copies of each key the cluster keeps.
+const TagShard = "shard-replicas"
+
+// DefaultVnodes is how many points each member is given on a HashRing. More points spread keys
+// more evenly, at the cost of a larger ring.
+const DefaultVnodes = 64
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// HashRing assigns keys to members by consistent hashing, so that adding or removing a member only
+// moves the keys next to its points on the ring. Each key is owned by the first replicas distinct
+// members found walking clockwise from the key's hash. A HashRing is never changed once it has
+// been built, so it can be shared between goroutines.
+type HashRing struct {
+	points   []ringPoint
+	members  []string
+	replicas int
+}
+
+// NewHashRing builds a ring over members, giving each of them vnodes points. Keys are given to
+// replicas members each, or to every member if there are fewer of them.
+func NewHashRing(members []string, vnodes, replicas int) *HashRing {
+	if vnodes < 1 {
+		vnodes = DefaultVnodes
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	r := &HashRing{replicas: replicas}
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		r.members = append(r.members, m)
+		for x := 0; x < vnodes; x++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(m + "#" + strconv.Itoa(x)), member: m})
+		}
+	}
+	sort.Strings(r.members)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].member < r.points[j].member
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	if r.replicas > len(r.members) {
+		r.replicas = len(r.members)
+	}
+	return r
+}
+
+// ringHash hashes a key or point name onto the ring. FNV-1a is mixed with the SplitMix64
+// finalizer, since on its own it spreads similar names (like a member's points) poorly.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Members returns the members on the ring, in sorted order.
+func (r *HashRing) Members() []string {
+	return append([]string(nil), r.members...)
+}
+
+// Replicas returns how many members each key is given to.
+func (r *HashRing) Replicas() int {
+	return r.replicas
+}
+
+// Owners returns the members a key belongs to, starting with its primary owner. It returns nil if
+// the ring is empty.
+func (r *HashRing) Owners(key string) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	idx := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	return r.ownersAt(idx)
+}
+
+// Owns reports whether member is one of a key's owners.
+func (r *HashRing) Owns(member, key string) bool {
+	for _, m := range r.Owners(key) {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// ownersAt returns the owners of the arc of the ring that ends at the point at idx.
+func (r *HashRing) ownersAt(idx int) []string {
+	owners := make([]string, 0, r.replicas)
+	for x := 0; x < len(r.points) && len(owners) < r.replicas; x++ {
+		m := r.points[(idx+x)%len(r.points)].member
+		dup := false
+		for _, o := range owners {
+			if o == m {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			owners = append(owners, m)
+		}
+	}
+	return owners
+}
+
+// Cover picks members that between them own every key, so that asking each of them about the keys
+// they hold reaches at least one copy of every key. Members in prefer are picked ahead of the rest
+// (as long as they are on the ring), and members in exclude are never picked. It returns false if
+// some keys are only owned by excluded members.
+func (r *HashRing) Cover(prefer []string, exclude map[string]bool) ([]string, bool) {
+	picked := make(map[string]bool)
+	cover := make([]string, 0, len(r.members))
+	onRing := make(map[string]bool, len(r.members))
+	for _, m := range r.members {
+		onRing[m] = true
+	}
+	for _, m := range prefer {
+		if onRing[m] && !exclude[m] && !picked[m] {
+			picked[m] = true
+			cover = append(cover, m)
+		}
+	}
+	for idx := range r.points {
+		owners := r.ownersAt(idx)
+		if anyPicked(owners, picked) {
+			continue
+		}
+		candidate := ""
+		for _, o := range owners {
+			if !exclude[o] {
+				candidate = o
+				break
+			}
+		}
+		if candidate == "" {
+			return cover, false
+		}
+		picked[candidate] = true
+		cover = append(cover, candidate)
+	}
+	return cover, true
+}
+
+func anyPicked(members []string, picked map[string]bool) bool {
+	for _, m := range members {
+		if picked[m] {
+			return true
+		}
+	}
+	return false
+}
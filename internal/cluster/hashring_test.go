@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringKeys(count int) []string {
+	keys := make([]string, 0, count)
+	for x := 0; x < count; x++ {
+		keys = append(keys, fmt.Sprintf("key-%d", x))
+	}
+	return keys
+}
+
+func TestHashRingOwners(t *testing.T) {
+	ring := NewHashRing([]string{"a", "b", "c", "d"}, DefaultVnodes, 2)
+	counts := make(map[string]int)
+	for _, k := range ringKeys(10000) {
+		owners := ring.Owners(k)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("Expected two distinct owners for %s, got %v", k, owners)
+		}
+		if !ring.Owns(owners[1], k) {
+			t.Errorf("Expected %s to own %s", owners[1], k)
+		}
+		counts[owners[0]]++
+	}
+	// Each member should be the primary owner of roughly a quarter of the keys.
+	for _, m := range ring.Members() {
+		if counts[m] < 1500 || counts[m] > 3500 {
+			t.Errorf("Member %s is the primary owner of %d keys out of 10000", m, counts[m])
+		}
+	}
+
+	// There can't be more copies than members.
+	if owners := NewHashRing([]string{"a"}, DefaultVnodes, 3).Owners("k"); len(owners) != 1 {
+		t.Errorf("Expected a single owner on a ring of one, got %v", owners)
+	}
+	if owners := NewHashRing(nil, DefaultVnodes, 3).Owners("k"); owners != nil {
+		t.Errorf("Expected no owners on an empty ring, got %v", owners)
+	}
+}
+
+func TestHashRingMovesFewKeys(t *testing.T) {
+	before := NewHashRing([]string{"a", "b", "c", "d"}, DefaultVnodes, 1)
+	after := NewHashRing([]string{"a", "b", "c", "d", "e"}, DefaultVnodes, 1)
+	moved := 0
+	for _, k := range ringKeys(10000) {
+		prev, next := before.Owners(k)[0], after.Owners(k)[0]
+		if prev != next {
+			if next != "e" {
+				t.Fatalf("Key %s moved from %s to %s rather than to the new member", k, prev, next)
+			}
+			moved++
+		}
+	}
+	// Roughly a fifth of the keys should move to the new member.
+	if moved < 1000 || moved > 3000 {
+		t.Errorf("Expected about 2000 of 10000 keys to move, got %d", moved)
+	}
+}
+
+func TestHashRingCover(t *testing.T) {
+	members := []string{"a", "b", "c", "d", "e"}
+
+	// With every key on every member, any one member covers the ring.
+	full := NewHashRing(members, DefaultVnodes, len(members))
+	if cover, ok := full.Cover([]string{"c"}, nil); !ok || len(cover) != 1 || cover[0] != "c" {
+		t.Errorf("Expected c alone to cover a fully replicated ring, got %v", cover)
+	}
+
+	// With a single copy of each key, every member is needed.
+	single := NewHashRing(members, DefaultVnodes, 1)
+	if cover, ok := single.Cover(nil, nil); !ok || len(cover) != len(members) {
+		t.Errorf("Expected every member in the cover, got %v", cover)
+	}
+	if _, ok := single.Cover(nil, map[string]bool{"b": true}); ok {
+		t.Error("Expected no cover with the only copy of some keys excluded")
+	}
+
+	// Otherwise the cover has to reach an owner of every key, skipping excluded members.
+	ring := NewHashRing(members, DefaultVnodes, 2)
+	exclude := map[string]bool{"a": true}
+	cover, ok := ring.Cover([]string{"b", "zz"}, exclude)
+	if !ok {
+		t.Fatalf("Expected a cover with one member excluded, got %v", cover)
+	}
+	if cover[0] != "b" {
+		t.Errorf("Expected the preferred member first, got %v", cover)
+	}
+	picked := make(map[string]bool)
+	for _, m := range cover {
+		if m == "a" || m == "zz" {
+			t.Errorf("Unexpected member %s in the cover %v", m, cover)
+		}
+		picked[m] = true
+	}
+	for _, k := range ringKeys(10000) {
+		if !anyPicked(ring.Owners(k), picked) {
+			t.Fatalf("No member of the cover %v owns %s (owners %v)", cover, k, ring.Owners(k))
+		}
+	}
+}
@@ -1 +1,221 @@
 package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/highgrav/munchkin/internal/snapshot"
+	"github.com/highgrav/munchkin/internal/wal"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// keyLoggedIndex is the stable store key holding the last log index this member has logged
+// through its StateMachine.
+var keyLoggedIndex = []byte("LoggedIndex")
+
+// StateMachine is the state a ConsensusMember keeps in step across the cluster. Raft calls it from
+// a single goroutine, in log order, on every member.
+type StateMachine interface {
+	// ApplyEntries applies a committed batch of entries as a single change. replayed is set for
+	// entries this member had already logged before it was restarted, which don't need to be
+	// logged again. The entries are already durable in the Raft log, so rather than holding up
+	// the entries after them while they are logged, it can return as soon as they're applied,
+	// with ApplyResult.Logged reporting when they have been logged.
+	ApplyEntries(entries []wal.WalEntry, replayed bool) ApplyResult
+	// Snapshot captures the current state. It is persisted on another goroutine, so it must not
+	// share anything that later changes will modify.
+	Snapshot() snapshot.Snapshot
+	// Restore replaces the current state with a snapshot, as when a member has fallen too far
+	// behind to catch up from the log. replayed is set while a restarted member is restoring its
+	// own snapshot.
+	Restore(s snapshot.Snapshot, replayed bool) error
+}
+
+// ApplyResult is what applying a batch of committed entries produced on a member.
+type ApplyResult struct {
+	// Generation is the matcher generation the entries were published in.
+	Generation uint64
+	// Timestamp is the timestamp the last entry was logged under.
+	Timestamp uint64
+	// Index is the Raft log index the entries were committed at. Once a member's applied index
+	// reaches it, the member has applied them too.
+	Index uint64
+	// Err is set if the entries couldn't be applied. Applying is deterministic, so every member
+	// rejects the same entries.
+	Err error
+	// Logged, if set, receives the outcome of logging the entries. They only count as logged,
+	// and so are only skipped when the member replays the Raft log after a restart, once it has
+	// received nil. If it isn't set, there was nothing to wait for.
+	Logged <-chan error
+}
+
+// command is a batch of entries as carried in the Raft log. Entries are stamped when they are
+// applied, so timestamps aren't included.
+type command struct {
+	Entries []commandEntry `json:"entries"`
+}
+
+type commandEntry struct {
+	Action  uint16 `json:"action"`
+	Key     string `json:"key"`
+	Pattern string `json:"pattern"`
+}
+
+func encodeCommand(entries []wal.WalEntry) ([]byte, error) {
+	cmd := command{Entries: make([]commandEntry, 0, len(entries))}
+	for _, e := range entries {
+		cmd.Entries = append(cmd.Entries, commandEntry{
+			Action:  e.Action,
+			Key:     string(e.Key),
+			Pattern: string(e.Pattern),
+		})
+	}
+	return json.Marshal(cmd)
+}
+
+func decodeCommand(buf []byte) ([]wal.WalEntry, error) {
+	var cmd command
+	if err := json.Unmarshal(buf, &cmd); err != nil {
+		return nil, err
+	}
+	entries := make([]wal.WalEntry, 0, len(cmd.Entries))
+	for _, e := range cmd.Entries {
+		entries = append(entries, wal.WalEntry{
+			Action:  e.Action,
+			Key:     []byte(e.Key),
+			Pattern: []byte(e.Pattern),
+		})
+	}
+	return entries, nil
+}
+
+// replicator adapts a StateMachine to Raft's FSM interface.
+type replicator struct {
+	sm StateMachine
+	// replayThrough is the last log index this member had logged when it started.
+	replayThrough uint64
+	// snapshotIndex is the index of the newest snapshot this member had when it started, which
+	// Raft restores before replaying the log.
+	snapshotIndex uint64
+	// started is set once Raft has restored this member's own snapshot at startup.
+	started int32 // accessed atomically
+	// pending carries each batch applied since startup to trackLogged, in log order.
+	pending  chan pendingLog
+	tracked  chan struct{}
+	stopOnce sync.Once
+}
+
+// pendingLog is a batch waiting to be logged.
+type pendingLog struct {
+	index  uint64
+	logged <-chan error
+}
+
+var _ raft.FSM = (*replicator)(nil)
+
+func newReplicator(sm StateMachine, replayThrough, snapshotIndex uint64) *replicator {
+	return &replicator{
+		sm:            sm,
+		replayThrough: replayThrough,
+		snapshotIndex: snapshotIndex,
+		pending:       make(chan pendingLog, 1024),
+		tracked:       make(chan struct{}),
+	}
+}
+
+func (r *replicator) Apply(l *raft.Log) interface{} {
+	entries, err := decodeCommand(l.Data)
+	if err != nil {
+		return ApplyResult{Err: fmt.Errorf("log index %d: %w", l.Index, err)}
+	}
+	replayed := l.Index <= r.replayThrough
+	res := r.sm.ApplyEntries(entries, replayed)
+	res.Index = l.Index
+	if !replayed {
+		r.pending <- pendingLog{index: l.Index, logged: res.Logged}
+	}
+	return res
+}
+
+// trackLogged records in the stable store how far this member has logged the batches it has
+// applied, so that a restart only skips logging batches that were. Batches are logged in the
+// order they're applied; once one fails, nothing after it is recorded either, so that it's logged
+// again after a restart. It returns once pending is closed and drained.
+func (r *replicator) trackLogged(store raft.StableStore, logger *zap.Logger) {
+	defer close(r.tracked)
+	var logged, recorded uint64
+	failed := false
+	for p := range r.pending {
+		if !failed && p.logged != nil {
+			if err := <-p.logged; err != nil {
+				logger.Error(fmt.Sprintf("raft: log index %d wasn't logged; it will be logged again after a restart", p.index), zap.String("error", err.Error()))
+				failed = true
+			}
+		}
+		if !failed {
+			logged = p.index
+		}
+		// Record the index once the batches already waiting are done, rather than after each one.
+		if len(r.pending) == 0 && logged > recorded {
+			if err := store.SetUint64(keyLoggedIndex, logged); err != nil {
+				logger.Error("raft: could not record the logged index", zap.String("error", err.Error()))
+				failed = true
+				continue
+			}
+			recorded = logged
+		}
+	}
+}
+
+// stopTracking waits for trackLogged to record the batches applied so far. Raft must not apply
+// anything more.
+func (r *replicator) stopTracking() {
+	r.stopOnce.Do(func() {
+		close(r.pending)
+	})
+	<-r.tracked
+}
+
+func (r *replicator) Snapshot() (raft.FSMSnapshot, error) {
+	return &registrySnapshot{s: r.sm.Snapshot()}, nil
+}
+
+func (r *replicator) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	buf, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	s, err := snapshot.Decode("raft snapshot", buf)
+	if err != nil {
+		return err
+	}
+	// At startup, Raft restores this member's own newest snapshot, which only needs logging if the
+	// member hadn't logged everything it covers.
+	if atomic.LoadInt32(&r.started) == 0 {
+		return r.sm.Restore(s, r.snapshotIndex <= r.replayThrough)
+	}
+	return r.sm.Restore(s, false)
+}
+
+// registrySnapshot persists a Raft snapshot in the same format as snapshot files.
+type registrySnapshot struct {
+	s snapshot.Snapshot
+}
+
+func (rs *registrySnapshot) Persist(sink raft.SnapshotSink) error {
+	buf, err := snapshot.Encode(rs.s)
+	if err == nil {
+		_, err = sink.Write(buf)
+	}
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (rs *registrySnapshot) Release() {}
@@ -0,0 +1,283 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// bucketCount is how many buckets the keys are spread across. Clones share buckets until one is
+// changed, so a change copies a single bucket rather than the whole registry.
+const bucketCount = 256
+
+// storedPattern is a pattern as it was given, along with its canonical form.
+type storedPattern struct {
+	raw       string
+	canonical string
+}
+
+// bucket maps keys to their patterns. The pattern slices are never changed in place, since a
+// copied bucket shares them with the one it was copied from.
+type bucket map[string][]storedPattern
+
+// Registry keeps track of which patterns are attached to which keys. Quamina doesn't expose the
+// patterns it has been given, so anything that needs to know what is loaded (deleting a single
+// pattern, listing keys, snapshots) has to ask the registry instead.
+type Registry struct {
+	mu      sync.RWMutex
+	buckets [bucketCount]bucket
+	shared  [bucketCount]bool // the bucket is shared with a clone, so must be copied before changing
+	len     int
+	changed map[string]struct{}
+}
+
+func New() *Registry {
+	r := &Registry{
+		changed: make(map[string]struct{}),
+	}
+	for x := range r.buckets {
+		r.buckets[x] = make(bucket)
+	}
+	return r
+}
+
+// Clone returns a copy of the registry that can be changed without affecting the original. The
+// two share their buckets until either changes one, so cloning doesn't depend on the number of
+// keys. The clone starts with no changed keys.
+func (r *Registry) Clone() *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := &Registry{
+		buckets: r.buckets,
+		len:     r.len,
+		changed: make(map[string]struct{}),
+	}
+	for x := range r.shared {
+		r.shared[x] = true
+		c.shared[x] = true
+	}
+	return c
+}
+
+// Changed returns the keys whose patterns have been changed since the registry was created or
+// cloned, in no particular order.
+func (r *Registry) Changed() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]string, 0, len(r.changed))
+	for k := range r.changed {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func bucketIndex(key string) int {
+	// FNV-1a
+	h := uint32(2166136261)
+	for x := 0; x < len(key); x++ {
+		h ^= uint32(key[x])
+		h *= 16777619
+	}
+	return int(h % bucketCount)
+}
+
+// get returns a key's patterns. r.mu must be held.
+func (r *Registry) get(key string) []storedPattern {
+	return r.buckets[bucketIndex(key)][key]
+}
+
+// set attaches patterns to a key, or removes the key if there are none, copying its bucket first
+// if it is shared. r.mu must be held for writing.
+func (r *Registry) set(key string, pats []storedPattern) {
+	x := bucketIndex(key)
+	if r.shared[x] {
+		b := make(bucket, len(r.buckets[x])+1)
+		for k, v := range r.buckets[x] {
+			b[k] = v
+		}
+		r.buckets[x] = b
+		r.shared[x] = false
+	}
+	_, had := r.buckets[x][key]
+	if len(pats) == 0 {
+		delete(r.buckets[x], key)
+		if had {
+			r.len--
+		}
+	} else {
+		r.buckets[x][key] = pats
+		if !had {
+			r.len++
+		}
+	}
+	r.changed[key] = struct{}{}
+}
+
+// Canonical returns the canonical form of a JSON pattern, so that two patterns that only differ
+// in whitespace or member order compare as equal. Numbers are kept as written rather than being
+// converted to float64, which would make large integers that differ compare as equal. Invalid
+// JSON is returned unchanged.
+func Canonical(pattern string) string {
+	dec := json.NewDecoder(strings.NewReader(pattern))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return pattern
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return pattern
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return pattern
+	}
+	return string(b)
+}
+
+// Add attaches a pattern to a key. Adding a pattern the key already has is a no-op.
+func (r *Registry) Add(key, pattern string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := Canonical(pattern)
+	pats := r.get(key)
+	for _, p := range pats {
+		if p.canonical == c {
+			return
+		}
+	}
+	// Appending to a shared slice could write into its spare capacity, so always copy it.
+	r.set(key, append(pats[:len(pats):len(pats)], storedPattern{raw: pattern, canonical: c}))
+}
+
+// Replace swaps out every pattern attached to a key. Replacing with no patterns removes the key.
+func (r *Registry) Replace(key string, patterns []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pats := make([]storedPattern, 0, len(patterns))
+	seen := make(map[string]bool)
+	for _, p := range patterns {
+		c := Canonical(p)
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		pats = append(pats, storedPattern{raw: p, canonical: c})
+	}
+	r.set(key, pats)
+}
+
+// DeleteKey removes a key and all of its patterns, returning the number of patterns removed.
+func (r *Registry) DeleteKey(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ct := len(r.get(key))
+	if ct > 0 {
+		r.set(key, nil)
+	}
+	return ct
+}
+
+// DeletePattern removes a single pattern from a key, returning the number of patterns removed.
+// The key is removed once its last pattern is gone.
+func (r *Registry) DeletePattern(key, pattern string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := Canonical(pattern)
+	pats := r.get(key)
+	remaining := make([]storedPattern, 0, len(pats))
+	for _, p := range pats {
+		if p.canonical != c {
+			remaining = append(remaining, p)
+		}
+	}
+	ct := len(pats) - len(remaining)
+	if ct > 0 {
+		r.set(key, remaining)
+	}
+	return ct
+}
+
+// HasPattern checks whether a key has a pattern, ignoring differences in formatting.
+func (r *Registry) HasPattern(key, pattern string) bool {
+	return r.HasCanonical(key, Canonical(pattern))
+}
+
+// HasCanonical checks whether a key has a pattern, given the pattern's canonical form.
+func (r *Registry) HasCanonical(key, canonical string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range r.get(key) {
+		if p.canonical == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns returns a copy of the patterns attached to a key.
+func (r *Registry) Patterns(key string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pats := r.get(key)
+	raw := make([]string, len(pats))
+	for x, p := range pats {
+		raw[x] = p.raw
+	}
+	return raw
+}
+
+// HasKey checks whether a key has any patterns.
+func (r *Registry) HasKey(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.buckets[bucketIndex(key)][key]
+	return ok
+}
+
+// Len returns the number of keys in the registry.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.len
+}
+
+// Keys returns up to limit keys in sorted order that start with prefix and sort after the
+// key passed in as after, so the last key of one page can be used to fetch the next page.
+// Pass an empty after to start at the beginning, and a limit < 1 to return every key.
+// The boolean result indicates whether there are more keys to fetch.
+func (r *Registry) Keys(prefix, after string, limit int) ([]string, bool) {
+	r.mu.RLock()
+	keys := make([]string, 0)
+	for _, b := range r.buckets {
+		for k := range b {
+			if strings.HasPrefix(k, prefix) && (after == "" || k > after) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	r.mu.RUnlock()
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// Snapshot returns a copy of every key and its patterns, taken at a single point in time.
+func (r *Registry) Snapshot() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	snap := make(map[string][]string, r.len)
+	for _, b := range r.buckets {
+		for k, pats := range b {
+			raw := make([]string, len(pats))
+			for x, p := range pats {
+				raw[x] = p.raw
+			}
+			snap[k] = raw
+		}
+	}
+	return snap
+}
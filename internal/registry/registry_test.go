@@ -0,0 +1,188 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestRegistryAddDelete(t *testing.T) {
+	r := New()
+	r.Add("first-test-key", `{"sys":["filestore"],"evt":["file-created"]}`)
+	r.Add("first-test-key", `{"sys":["authnz"]}`)
+	r.Add("second-test-key", `{"sys":["infra"]}`)
+
+	// Same pattern with different whitespace and member order should not be added twice
+	r.Add("first-test-key", `{ "evt": ["file-created"], "sys": ["filestore"] }`)
+	if ct := len(r.Patterns("first-test-key")); ct != 2 {
+		t.Error("Expected 2 patterns for first-test-key, got " + strconv.Itoa(ct))
+	}
+
+	if !r.HasPattern("first-test-key", `{"evt":["file-created"],"sys":["filestore"]}`) {
+		t.Error("Expected first-test-key to have the filestore pattern")
+	}
+	if ct := r.DeletePattern("first-test-key", `{"evt":["file-created"], "sys":["filestore"]}`); ct != 1 {
+		t.Error("Expected to delete 1 pattern, deleted " + strconv.Itoa(ct))
+	}
+	pats := r.Patterns("first-test-key")
+	if len(pats) != 1 || pats[0] != `{"sys":["authnz"]}` {
+		t.Errorf("Unexpected patterns left for first-test-key: %v", pats)
+	}
+
+	if ct := r.DeletePattern("first-test-key", `{"sys":["infra"]}`); ct != 0 {
+		t.Error("Expected to delete 0 patterns, deleted " + strconv.Itoa(ct))
+	}
+
+	if ct := r.DeleteKey("second-test-key"); ct != 1 {
+		t.Error("Expected to delete 1 pattern, deleted " + strconv.Itoa(ct))
+	}
+	if ct := len(r.Patterns("second-test-key")); ct != 0 {
+		t.Error("Expected no patterns for second-test-key, got " + strconv.Itoa(ct))
+	}
+}
+
+func TestRegistryReplace(t *testing.T) {
+	r := New()
+	r.Add("first-test-key", `{"sys":["filestore"]}`)
+	r.Add("first-test-key", `{"sys":["authnz"]}`)
+
+	r.Replace("first-test-key", []string{`{"sys":["infra"]}`, `{ "sys": ["infra"] }`, `{"evt":["user-login"]}`})
+	pats := r.Patterns("first-test-key")
+	if len(pats) != 2 || pats[0] != `{"sys":["infra"]}` || pats[1] != `{"evt":["user-login"]}` {
+		t.Errorf("Unexpected patterns after replace: %v", pats)
+	}
+
+	snap := r.Snapshot()
+	r.Add("first-test-key", `{"sys":["filestore"]}`)
+	if len(snap["first-test-key"]) != 2 {
+		t.Errorf("Snapshot changed along with the registry: %v", snap["first-test-key"])
+	}
+
+	r.Replace("first-test-key", []string{})
+	if r.HasKey("first-test-key") {
+		t.Error("Expected first-test-key to be removed after replacing with no patterns")
+	}
+}
+
+func TestRegistryClone(t *testing.T) {
+	r := New()
+	r.Add("first-test-key", `{"sys":["filestore"]}`)
+	r.Add("second-test-key", `{"sys":["infra"]}`)
+
+	c := r.Clone()
+	c.Add("first-test-key", `{"sys":["authnz"]}`)
+	c.DeleteKey("second-test-key")
+	c.Add("third-test-key", `{"sys":["infra"]}`)
+
+	if ct := len(r.Patterns("first-test-key")); ct != 1 {
+		t.Error("Expected 1 pattern for first-test-key in the original, got " + strconv.Itoa(ct))
+	}
+	if !r.HasKey("second-test-key") || r.HasKey("third-test-key") {
+		t.Error("Changes to the clone showed up in the original")
+	}
+	if ct := len(c.Patterns("first-test-key")); ct != 2 {
+		t.Error("Expected 2 patterns for first-test-key in the clone, got " + strconv.Itoa(ct))
+	}
+}
+
+func TestRegistryCloneSharesBuckets(t *testing.T) {
+	r := New()
+	for x := 0; x < 1000; x++ {
+		r.Add(fmt.Sprintf("key-%03d", x), `{"sys":["filestore"]}`)
+	}
+	c := r.Clone()
+	if len(c.Changed()) != 0 {
+		t.Errorf("Expected a new clone to have no changed keys, got %v", c.Changed())
+	}
+	// Changing either side copies only the bucket it changes, and the other side doesn't see it.
+	c.Add("key-000", `{"sys":["authnz"]}`)
+	c.DeletePattern("key-001", `{"sys":["filestore"]}`)
+	r.Add("key-002", `{"sys":["infra"]}`)
+	if ct := len(r.Patterns("key-000")); ct != 1 {
+		t.Error("Expected 1 pattern for key-000 in the original, got " + strconv.Itoa(ct))
+	}
+	if !r.HasKey("key-001") || c.HasKey("key-001") {
+		t.Error("Expected key-001 to be removed from the clone only")
+	}
+	if ct := len(c.Patterns("key-002")); ct != 1 {
+		t.Error("Expected 1 pattern for key-002 in the clone, got " + strconv.Itoa(ct))
+	}
+	if r.Len() != 1000 || c.Len() != 999 {
+		t.Errorf("Expected 1000 keys in the original and 999 in the clone, got %d and %d", r.Len(), c.Len())
+	}
+	changed := c.Changed()
+	sort.Strings(changed)
+	if len(changed) != 2 || changed[0] != "key-000" || changed[1] != "key-001" {
+		t.Errorf("Expected key-000 and key-001 to be changed in the clone, got %v", changed)
+	}
+	if !c.HasCanonical("key-000", Canonical(`{ "sys": ["authnz"] }`)) {
+		t.Error("Expected HasCanonical to find the added pattern")
+	}
+}
+
+func TestRegistryKeys(t *testing.T) {
+	r := New()
+	for x := 0; x < 25; x++ {
+		r.Add(fmt.Sprintf("tenant-a/key-%02d", x), `{"sys":["filestore"]}`)
+		r.Add(fmt.Sprintf("tenant-b/key-%02d", x), `{"sys":["authnz"]}`)
+	}
+	if r.Len() != 50 {
+		t.Error("Expected 50 keys, got " + strconv.Itoa(r.Len()))
+	}
+	if !r.HasKey("tenant-a/key-00") || r.HasKey("tenant-c/key-00") {
+		t.Error("HasKey returned the wrong result")
+	}
+
+	// Page through tenant-a's keys 10 at a time
+	pages := 0
+	total := 0
+	after := ""
+	for {
+		keys, more := r.Keys("tenant-a/", after, 10)
+		pages++
+		total += len(keys)
+		for x, k := range keys {
+			if k != fmt.Sprintf("tenant-a/key-%02d", total-len(keys)+x) {
+				t.Error("Unexpected key " + k + " on page " + strconv.Itoa(pages))
+			}
+		}
+		if !more {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	if pages != 3 || total != 25 {
+		t.Errorf("Expected 25 keys over 3 pages, got %d keys over %d pages", total, pages)
+	}
+
+	keys, more := r.Keys("", "", 0)
+	if len(keys) != 50 || more {
+		t.Errorf("Expected all 50 keys in one page, got %d (more: %t)", len(keys), more)
+	}
+}
+
+func TestCanonicalKeepsNumbers(t *testing.T) {
+	// Both of these round to the same float64.
+	a := Canonical(`{"a":[9007199254740993]}`)
+	b := Canonical(`{"a":[9007199254740992]}`)
+	if a == b {
+		t.Errorf("Expected large integers that differ to stay distinct, both became %s", a)
+	}
+	if a != `{"a":[9007199254740993]}` {
+		t.Errorf("Unexpected canonical form: %s", a)
+	}
+	if c := Canonical(`{ "b": [1.50], "a": [2] }`); c != `{"a":[2],"b":[1.50]}` {
+		t.Errorf("Unexpected canonical form: %s", c)
+	}
+	if c := Canonical(`{"a":[1]} trailing`); c != `{"a":[1]} trailing` {
+		t.Errorf("Expected invalid JSON to be returned unchanged, got %s", c)
+	}
+
+	r := New()
+	r.Add("first-test-key", `{"a":[9007199254740993]}`)
+	r.Add("first-test-key", `{"a":[9007199254740992]}`)
+	if ct := len(r.Patterns("first-test-key")); ct != 2 {
+		t.Error("Expected 2 patterns for first-test-key, got " + strconv.Itoa(ct))
+	}
+}
@@ -0,0 +1,227 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A snapshot file holds the full key -> patterns registry as of a point in the WAL:
+//
+//	[header: "MSNAP-01"][timestamp: uint64][body: JSON][CRC32C of timestamp and body: uint32]
+//
+// The timestamp is that of the last WAL entry applied before the snapshot was taken, so that
+// replay can pick up with the entries after it. Files are written under a temporary name and
+// renamed into place, so a crash never leaves a partial snapshot under a snapshot name; the
+// checksum catches any damage after that.
+
+const SNAPSHOT_HEADER_V1 = "MSNAP-01"
+
+const (
+	headerSize  = 8
+	trailerSize = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrNoSnapshot is returned by LoadNewest when there are no valid snapshots to load.
+var ErrNoSnapshot = errors.New("no valid snapshot found")
+
+// ErrCorruptSnapshot is returned when a snapshot file fails its checksum or can't be decoded.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// Snapshot is the registry as of a point in the WAL.
+type Snapshot struct {
+	// Timestamp is that of the last WAL entry the snapshot includes.
+	Timestamp uint64
+	// Keys maps each key to its patterns.
+	Keys map[string][]string
+}
+
+type snapshotBody struct {
+	Keys map[string][]string `json:"keys"`
+}
+
+// FileName returns the name of the snapshot file for a timestamp.
+func FileName(dir, prefix string, ts uint64) string {
+	return filepath.Join(dir, prefix+strconv.FormatUint(ts, 10)+".snap")
+}
+
+// FileTimestamp parses the timestamp out of a snapshot file name.
+func FileTimestamp(fileName, prefix string) (uint64, error) {
+	ts := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(fileName), ".snap"), prefix)
+	return strconv.ParseUint(ts, 10, 64)
+}
+
+// List returns the snapshot files in a directory, oldest first.
+func List(dir, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []string{}, err
+	}
+	type tsFile struct {
+		ts   uint64
+		name string
+	}
+	found := make([]tsFile, 0)
+	for _, v := range entries {
+		if v.IsDir() || !strings.HasPrefix(v.Name(), prefix) || !strings.HasSuffix(v.Name(), ".snap") {
+			continue
+		}
+		ts, err := FileTimestamp(v.Name(), prefix)
+		if err != nil {
+			continue
+		}
+		found = append(found, tsFile{ts: ts, name: filepath.Join(dir, v.Name())})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ts < found[j].ts
+	})
+	files := make([]string, 0, len(found))
+	for _, f := range found {
+		files = append(files, f.name)
+	}
+	return files, nil
+}
+
+// Encode serializes a snapshot in the snapshot file format.
+func Encode(s Snapshot) ([]byte, error) {
+	keys := s.Keys
+	if keys == nil {
+		keys = make(map[string][]string)
+	}
+	body, err := json.Marshal(snapshotBody{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, headerSize+8+len(body)+trailerSize)
+	copy(buf, SNAPSHOT_HEADER_V1)
+	binary.BigEndian.PutUint64(buf[headerSize:headerSize+8], s.Timestamp)
+	copy(buf[headerSize+8:], body)
+	sum := crc32.Checksum(buf[headerSize:len(buf)-trailerSize], crcTable)
+	binary.BigEndian.PutUint32(buf[len(buf)-trailerSize:], sum)
+	return buf, nil
+}
+
+// Decode checks and deserializes a snapshot encoded with Encode. name is used in errors.
+func Decode(name string, buf []byte) (Snapshot, error) {
+	if len(buf) < headerSize+8+trailerSize {
+		return Snapshot{}, fmt.Errorf("%s is too short: %w", name, ErrCorruptSnapshot)
+	}
+	if string(buf[0:headerSize]) != SNAPSHOT_HEADER_V1 {
+		return Snapshot{}, errors.New(fmt.Sprintf("Incorrect snapshot header (got \"%s\")", string(buf[0:headerSize])))
+	}
+	sum := binary.BigEndian.Uint32(buf[len(buf)-trailerSize:])
+	if crc32.Checksum(buf[headerSize:len(buf)-trailerSize], crcTable) != sum {
+		return Snapshot{}, fmt.Errorf("%s failed its checksum: %w", name, ErrCorruptSnapshot)
+	}
+	var body snapshotBody
+	if err := json.Unmarshal(buf[headerSize+8:len(buf)-trailerSize], &body); err != nil {
+		return Snapshot{}, fmt.Errorf("%s: %s: %w", name, err.Error(), ErrCorruptSnapshot)
+	}
+	if body.Keys == nil {
+		body.Keys = make(map[string][]string)
+	}
+	return Snapshot{
+		Timestamp: binary.BigEndian.Uint64(buf[headerSize : headerSize+8]),
+		Keys:      body.Keys,
+	}, nil
+}
+
+// Write saves a snapshot to dir and returns its file name. The file is synced and renamed into
+// place before Write returns, so it is either complete or absent.
+func Write(dir, prefix string, s Snapshot) (string, error) {
+	buf, err := Encode(s)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := FileName(dir, prefix, s.Timestamp)
+	tmp, err := os.CreateTemp(dir, "."+prefix+"*.tmp")
+	if err != nil {
+		return fileName, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fileName, err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fileName, err
+	}
+	if err = tmp.Close(); err != nil {
+		return fileName, err
+	}
+	if err = os.Rename(tmp.Name(), fileName); err != nil {
+		return fileName, err
+	}
+	// Sync the directory so that the rename itself survives a crash.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return fileName, nil
+}
+
+// Read loads and checks a snapshot file.
+func Read(fileName string) (Snapshot, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Decode(fileName, buf)
+}
+
+// LoadNewest loads the newest valid snapshot in dir, along with its file name. If upTo isn't 0,
+// snapshots taken after that timestamp are ignored. Snapshots that can't be read are skipped and
+// reported through skipped, if it isn't nil. ErrNoSnapshot is returned if there is nothing to
+// load.
+func LoadNewest(dir, prefix string, upTo uint64, skipped func(fileName string, err error)) (Snapshot, string, error) {
+	files, err := List(dir, prefix)
+	if err != nil {
+		return Snapshot{}, "", err
+	}
+	for x := len(files) - 1; x >= 0; x-- {
+		if upTo > 0 {
+			if ts, err := FileTimestamp(files[x], prefix); err == nil && ts > upTo {
+				continue
+			}
+		}
+		s, err := Read(files[x])
+		if err != nil {
+			if skipped != nil {
+				skipped(files[x], err)
+			}
+			continue
+		}
+		if upTo > 0 && s.Timestamp > upTo {
+			continue
+		}
+		return s, files[x], nil
+	}
+	return Snapshot{}, "", ErrNoSnapshot
+}
+
+// Prune deletes all but the newest keep snapshots in dir, returning the files it deleted.
+func Prune(dir, prefix string, keep int) ([]string, error) {
+	files, err := List(dir, prefix)
+	if err != nil {
+		return []string{}, err
+	}
+	deleted := make([]string, 0)
+	for x := 0; x < len(files)-keep; x++ {
+		if err = os.Remove(files[x]); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, files[x])
+	}
+	return deleted, nil
+}
@@ -0,0 +1,102 @@
+package snapshot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestDir(t *testing.T) string {
+	dir := filepath.Join("/tmp", "snap-test-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSnapshotWriteRead(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s := Snapshot{
+		Timestamp: 1234,
+		Keys: map[string][]string{
+			"first-test-key":  {`{"sys":["filestore"]}`, `{"sys":["authnz"]}`},
+			"second-test-key": {`{"sys":["infra"]}`},
+		},
+	}
+	fileName, err := Write(dir, "msnap-", s)
+	if err != nil {
+		t.Fatal("snapshot.Write: " + err.Error())
+	}
+	if filepath.Base(fileName) != "msnap-1234.snap" {
+		t.Error("Unexpected file name " + fileName)
+	}
+	got, err := Read(fileName)
+	if err != nil {
+		t.Fatal("snapshot.Read: " + err.Error())
+	}
+	if got.Timestamp != 1234 || len(got.Keys) != 2 || len(got.Keys["first-test-key"]) != 2 || got.Keys["second-test-key"][0] != `{"sys":["infra"]}` {
+		t.Errorf("Snapshot did not round-trip: %v", got)
+	}
+	// No temporary files should be left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Error("Expected only the snapshot file, found " + strconv.Itoa(len(entries)) + " files")
+	}
+}
+
+func TestSnapshotLoadNewestSkipsCorrupt(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, ts := range []uint64{100, 200, 300} {
+		_, err := Write(dir, "msnap-", Snapshot{Timestamp: ts, Keys: map[string][]string{"key-" + strconv.FormatUint(ts, 10): {`{"sys":["infra"]}`}}})
+		if err != nil {
+			t.Fatal("snapshot.Write: " + err.Error())
+		}
+	}
+	// Damage the newest snapshot
+	newest := FileName(dir, "msnap-", 300)
+	f, _ := os.OpenFile(newest, os.O_RDWR, 0644)
+	f.WriteAt([]byte{'X'}, 20)
+	f.Close()
+
+	var skipped []string
+	s, fileName, err := LoadNewest(dir, "msnap-", 0, func(fileName string, err error) {
+		if !errors.Is(err, ErrCorruptSnapshot) {
+			t.Error("Expected ErrCorruptSnapshot, got " + err.Error())
+		}
+		skipped = append(skipped, fileName)
+	})
+	if err != nil {
+		t.Fatal("snapshot.LoadNewest: " + err.Error())
+	}
+	if s.Timestamp != 200 || fileName != FileName(dir, "msnap-", 200) {
+		t.Error("Expected the snapshot at 200, got " + fileName)
+	}
+	if len(skipped) != 1 || skipped[0] != newest {
+		t.Errorf("Expected to skip only the damaged snapshot, skipped %v", skipped)
+	}
+
+	s, fileName, err = LoadNewest(dir, "msnap-", 150, nil)
+	if err != nil || s.Timestamp != 100 {
+		t.Error("Expected the snapshot at 100 when loading up to 150, got " + fileName)
+	}
+
+	deleted, err := Prune(dir, "msnap-", 1)
+	if err != nil {
+		t.Fatal("snapshot.Prune: " + err.Error())
+	}
+	if len(deleted) != 2 {
+		t.Error("Expected to prune 2 snapshots, pruned " + strconv.Itoa(len(deleted)))
+	}
+
+	_, _, err = LoadNewest(dir, "msnap-", 0, nil)
+	if err != ErrNoSnapshot {
+		t.Error("Expected ErrNoSnapshot once only the damaged snapshot is left")
+	}
+}
@@ -1,7 +1,9 @@
 package wal
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -16,12 +18,35 @@ import (
 const (
 	WAL_ADD uint16 = 32
 	WAL_DEL uint16 = 64
+	// WAL_REPLACE swaps out every pattern for a key in one step; the pattern payload is a
+	// JSON array of the key's new patterns.
+	WAL_REPLACE uint16 = 128
 )
 
 const (
 	WAL_HEADER_V1 = "MUNCH-01"
+	// WAL_HEADER_V2 files frame each record with its length and a CRC32C checksum.
+	WAL_HEADER_V2 = "MUNCH-02"
+	// WAL_HEADER_V3 files are framed like V2, but store key and pattern lengths as varints so
+	// that they aren't limited to 64 KiB. New files are always created as V3; V1 and V2 files can
+	// still be read and appended to.
+	WAL_HEADER_V3 = "MUNCH-03"
 )
 
+const (
+	// MaxKeySize is the largest key that can be written to a V3 WAL file.
+	MaxKeySize = 1024 * 1024
+	// MaxPatternSize is the largest pattern that can be written to a V3 WAL file.
+	MaxPatternSize = 16 * 1024 * 1024
+	// maxV1FieldSize is the largest key or pattern that fits in a V1 or V2 record.
+	maxV1FieldSize = 0xFFFF
+)
+
+// ErrEntryTooLarge is returned when a key or pattern is too large to be written to a WAL file.
+var ErrEntryTooLarge = errors.New("WAL entry too large")
+
+const walHeaderSize = 256
+
 func i64ToByteArray(i int64) (arr []byte) {
 	arr = make([]byte, 8)
 	binary.BigEndian.PutUint64(arr[0:8], uint64(i))
@@ -52,7 +77,9 @@ func ui16ToByteArray(i uint16) (arr []byte) {
 	return
 }
 
-func FindFilesOnOrAfter(walDir, walPrefix string, timestamp uint64) ([]string, error) {
+// ListWalFiles returns the full paths of every WAL file in walDir with the given prefix, oldest
+// first.
+func ListWalFiles(walDir, walPrefix string) ([]string, error) {
 	s, err := os.Stat(walDir)
 	if err != nil {
 		return []string{}, err
@@ -64,65 +91,104 @@ func FindFilesOnOrAfter(walDir, walPrefix string, timestamp uint64) ([]string, e
 	if err != nil {
 		return []string{}, err
 	}
-
 	var files []string = make([]string, 0)
 	for _, v := range entries {
-		if !v.IsDir() && strings.HasPrefix(v.Name(), walPrefix) {
-			files = append(files, v.Name())
+		if !v.IsDir() && strings.HasPrefix(v.Name(), walPrefix) && strings.HasSuffix(v.Name(), ".wal") {
+			files = append(files, filepath.Join(walDir, v.Name()))
 		}
-		sort.Strings(files)
 	}
-	if len(files) == 0 {
-		return []string{}, nil
+	sort.Strings(files)
+	return files, nil
+}
+
+// FileTimestamp returns the creation timestamp encoded in a WAL file's name.
+func FileTimestamp(fileName, walPrefix string) (int64, error) {
+	ts := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(fileName), ".wal"), walPrefix)
+	return strconv.ParseInt(ts, 10, 64)
+}
+
+// FindFilesOnOrAfter returns the WAL files in walDir that may hold entries with a timestamp equal
+// to or greater than timestamp, oldest first. Every entry in a file is logged before the next file
+// is created, so a file can only be passed over if the file after it was created before timestamp.
+func FindFilesOnOrAfter(walDir, walPrefix string, timestamp uint64) ([]string, error) {
+	files, err := ListWalFiles(walDir, walPrefix)
+	if err != nil {
+		return []string{}, err
 	}
-	var tsBefore int64 = 0
-	var fileTs []int64 = make([]int64, 0)
-	for _, fname := range files {
-		ts := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(fname), ".wal"), walPrefix)
-		tsint, err := strconv.ParseInt(ts, 10, 64)
+	first := 0
+	for x := 1; x < len(files); x++ {
+		ts, err := FileTimestamp(files[x], walPrefix)
 		if err != nil {
 			return []string{}, err
 		}
-		if tsint > tsBefore && tsint <= int64(timestamp) {
-			tsBefore = tsint
-			fileTs = append(fileTs, tsint)
+		if uint64(ts) >= timestamp {
+			break
 		}
+		first = x
 	}
-	var fileList []string = make([]string, 0)
-	for _, f := range fileTs {
-		fileList = append(files, filepath.Join(walDir, (walPrefix+strconv.FormatInt(f, 10)+".wal")))
-	}
-	return fileList, nil
+	return files[first:], nil
 }
 
 // WalEntry represents a single entry in the WAL file.
 type WalEntry struct {
 	Timestamp  uint64
-	KeyLen     uint16
-	PatternLen uint16
+	KeyLen     uint32
+	PatternLen uint32
 	Key        []byte
 	Pattern    []byte
 	Action     uint16
 }
 
+// GetPatternAsJson returns the entry's pattern as compacted JSON. Deletes of a whole key carry no
+// pattern, so "null" is returned for them. An error is returned if the pattern isn't valid JSON.
 func (we *WalEntry) GetPatternAsJson() (string, error) {
-	return "", nil
+	if we.Action == WAL_DEL && len(we.Pattern) <= 1 {
+		return "null", nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, we.Pattern); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ActionName returns a readable name for a WAL action.
+func ActionName(act uint16) string {
+	switch act {
+	case WAL_ADD:
+		return "add"
+	case WAL_DEL:
+		return "delete"
+	case WAL_REPLACE:
+		return "replace"
+	}
+	return "unknown(" + strconv.Itoa(int(act)) + ")"
 }
 
 // WalFile is responsible for managing file state and read/writes.
 type WalFile struct {
 	FileName string
-	file     *os.File
-	size     int64
-	entry    int
-	currByte int64
-	mu       sync.Mutex
-	isClosed bool
+	// Version is the header of the file, which identifies its format.
+	Version string
+	// Recovered is the number of bytes of a torn final record that were cut off when the file
+	// was opened.
+	Recovered int64
+	file      *os.File
+	size      int64
+	entry     int
+	currByte  int64
+	mu        sync.Mutex
+	isClosed  bool
 }
 
 // CreateWalFile creates a new WAL file and generates a header.
 func CreateWalFile(dirName, filePrefix string) (string, error) {
-	ts := time.Now().UnixNano()
+	return CreateWalFileAt(dirName, filePrefix, time.Now().UnixNano())
+}
+
+// CreateWalFileAt creates a new WAL file named for the given timestamp and generates a header.
+// WAL files are replayed in name order, so this can be used to slot a file in between others.
+func CreateWalFileAt(dirName, filePrefix string, ts int64) (string, error) {
 	fileName := filepath.Join(dirName, (filePrefix + strconv.FormatInt(ts, 10) + ".wal"))
 	_, err := os.Stat(fileName)
 	if err != nil {
@@ -130,25 +196,32 @@ func CreateWalFile(dirName, filePrefix string) (string, error) {
 		if err != nil {
 			return fileName, err
 		}
-		_, err = f.Write([]byte(WAL_HEADER_V1))
+		defer f.Close()
+		hdr := make([]byte, walHeaderSize)
+		copy(hdr, WAL_HEADER_V3)
+		_, err = f.Write(hdr)
 		if err != nil {
 			return fileName, err
 		}
-		for x := 0; x < 248; x++ {
-			_, err = f.Write([]byte{0x00})
-			if err != nil {
-				return fileName, err
-			}
-		}
 		_ = f.Sync()
-		_, _ = f.Seek(0, 0)
 		return fileName, nil
 	}
 	return fileName, os.ErrExist
 }
 
-// OpenWalFile opens an existing WAL file created with CreateWalFile()
+// OpenWalFile opens an existing WAL file created with CreateWalFile(). If a V2 or V3 file ends with a
+// record that was only partly written, the partial record is cut off.
 func OpenWalFile(fileName string) (*WalFile, error) {
+	return openWalFile(fileName, false)
+}
+
+// OpenWalFileReadOnly opens an existing WAL file for reading without changing it. A partly written
+// final record is left in place, and Next() reports it as an error.
+func OpenWalFileReadOnly(fileName string) (*WalFile, error) {
+	return openWalFile(fileName, true)
+}
+
+func openWalFile(fileName string, readOnly bool) (*WalFile, error) {
 	s, err := os.Stat(fileName)
 	if err != nil {
 		return nil, err
@@ -156,7 +229,11 @@ func OpenWalFile(fileName string) (*WalFile, error) {
 	if s.IsDir() {
 		return nil, errors.New("File is directory!")
 	}
-	f, err := os.OpenFile(fileName, os.O_RDWR, s.Mode())
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(fileName, flags, s.Mode())
 	if err != nil {
 		return nil, err
 	}
@@ -175,8 +252,9 @@ func OpenWalFile(fileName string) (*WalFile, error) {
 		return nil, errors.New(fmt.Sprintf("Sought to read %d bytes, read %d", len(hdrBuf), rCt))
 	}
 
-	if string(hdrBuf[0:8]) != WAL_HEADER_V1 {
-		return nil, errors.New(fmt.Sprintf("Incorrect WAL header (got \"%s\"" + string(hdrBuf[0:8])))
+	version := string(hdrBuf[0:8])
+	if version != WAL_HEADER_V1 && version != WAL_HEADER_V2 && version != WAL_HEADER_V3 {
+		return nil, errors.New(fmt.Sprintf("Incorrect WAL header (got \"%s\")", version))
 	}
 	for x := 0; x < 248; x++ {
 		if hdrBuf[8+x] != 0x0 {
@@ -185,10 +263,18 @@ func OpenWalFile(fileName string) (*WalFile, error) {
 	}
 	wf := &WalFile{
 		FileName: fileName,
+		Version:  version,
 		file:     f,
 		mu:       sync.Mutex{},
 		size:     s.Size(),
 	}
+	if wf.isFramed() && !readOnly {
+		wf.Recovered, err = wf.recoverFramed()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 	_, err = wf.file.Seek(256, 0)
 	if err != nil {
 		return nil, err
@@ -245,10 +331,56 @@ func (wf *WalFile) HasNext() bool {
 	return wf.size > (wf.currByte + 256)
 }
 
-// Next retrieves the next WAL entry from the current file.
+// Size returns the size of the file in bytes, including the header.
+func (wf *WalFile) Size() int64 {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	return wf.size
+}
+
+// Offset returns the byte offset in the file of the next entry to be read.
+func (wf *WalFile) Offset() int64 {
+	return walHeaderSize + wf.currByte
+}
+
+// isFramed reports whether the file uses the checksummed V2/V3 record framing.
+func (wf *WalFile) isFramed() bool {
+	return wf.Version == WAL_HEADER_V2 || wf.Version == WAL_HEADER_V3
+}
+
+// Next retrieves the next WAL entry from the current file. If a V2/V3 record is damaged, Next skips
+// ahead to the next intact record and returns an error wrapping ErrCorruptRecord, so that reading
+// can carry on from there.
 func (wf *WalFile) Next() (WalEntry, error) {
 	wf.mu.Lock()
 	defer wf.mu.Unlock()
+	if wf.isFramed() {
+		return wf.nextFramed()
+	}
+	w, err := wf.nextV1()
+	if err != nil {
+		// V1 records can't be resynchronized after an error, so stop reading the file here.
+		wf.currByte = wf.size - walHeaderSize
+	}
+	return w, err
+}
+
+func (wf *WalFile) nextFramed() (WalEntry, error) {
+	offset := wf.Offset()
+	w, recSize, err := readFramedRecord(wf.file, wf.Version, offset, wf.size)
+	if err != nil {
+		// The damaged record's length can't be trusted, so look for the next record that checks
+		// out. If none turns up within the distance searched, the next call carries on from there.
+		next, _ := resyncFramed(wf.file, wf.Version, offset, wf.size)
+		wf.currByte = next - walHeaderSize
+		return WalEntry{}, fmt.Errorf("offset %d: %w", offset, err)
+	}
+	wf.currByte += recSize
+	wf.entry++
+	return w, nil
+}
+
+func (wf *WalFile) nextV1() (WalEntry, error) {
 	var bytesRead = 0
 	var timestamp uint64
 	var keyLen, patLen uint16
@@ -294,8 +426,8 @@ func (wf *WalFile) Next() (WalEntry, error) {
 	wf.entry++
 	w := WalEntry{
 		Timestamp:  timestamp,
-		KeyLen:     keyLen,
-		PatternLen: patLen,
+		KeyLen:     uint32(keyLen),
+		PatternLen: uint32(patLen),
 		Key:        keyBuf,
 		Pattern:    patBuf,
 		Action:     actVal,
@@ -307,14 +439,85 @@ func writeWalEntryHeader(f *os.File) error {
 	return nil
 }
 
-// Write writes a WAL entry to the current file.
+// CheckEntrySize returns an error wrapping ErrEntryTooLarge if the key or pattern can't be
+// written to a new WAL file.
+func CheckEntrySize(key, pattern []byte) error {
+	return checkEntrySize(WAL_HEADER_V3, key, pattern)
+}
+
+func checkEntrySize(version string, key, pattern []byte) error {
+	maxKey, maxPattern := MaxKeySize, MaxPatternSize
+	if version == WAL_HEADER_V1 || version == WAL_HEADER_V2 {
+		maxKey, maxPattern = maxV1FieldSize, maxV1FieldSize
+	}
+	if len(key) > maxKey {
+		return fmt.Errorf("key is %d bytes, limit is %d: %w", len(key), maxKey, ErrEntryTooLarge)
+	}
+	if len(pattern) > maxPattern {
+		return fmt.Errorf("pattern is %d bytes, limit is %d: %w", len(pattern), maxPattern, ErrEntryTooLarge)
+	}
+	return nil
+}
+
+// Write writes a WAL entry to the current file and syncs it to disk. Keys and patterns that are
+// too large for the file's format are rejected with an error wrapping ErrEntryTooLarge.
 func (wf *WalFile) Write(timestamp int64, key, pattern []byte, act uint16) error {
+	err := wf.Append([]WalEntry{{Timestamp: uint64(timestamp), Key: key, Pattern: pattern, Action: act}})
+	if err != nil {
+		return err
+	}
+	return wf.Sync()
+}
+
+// Append writes a batch of WAL entries to the end of the current file without syncing it, so
+// that several batches can share a call to Sync(). In V2 and V3 files the whole batch is written
+// with a single call. If any entry is too large for the file's format, nothing is written.
+func (wf *WalFile) Append(entries []WalEntry) error {
 	if wf.file == nil {
 		return os.ErrNotExist
 	}
+	for _, e := range entries {
+		if err := checkEntrySize(wf.Version, e.Key, e.Pattern); err != nil {
+			return err
+		}
+	}
 	wf.mu.Lock()
 	defer wf.mu.Unlock()
+	if wf.isFramed() {
+		return wf.writeFramed(entries)
+	}
+	for _, e := range entries {
+		if err := wf.writeV1(int64(e.Timestamp), e.Key, e.Pattern, e.Action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync commits everything written to the file so far to disk.
+func (wf *WalFile) Sync() error {
+	if wf.file == nil {
+		return os.ErrNotExist
+	}
+	return wf.file.Sync()
+}
+
+// writeFramed writes whole framed records with a single call, so that a crash leaves either
+// complete records or a torn one at the end that recoverFramed() can detect.
+func (wf *WalFile) writeFramed(entries []WalEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		buf = append(buf, encodeFramedRecord(wf.Version, int64(e.Timestamp), e.Key, e.Pattern, e.Action)...)
+	}
+	_, err := wf.file.WriteAt(buf, wf.size)
+	if err != nil {
+		return err
+	}
+	wf.size = wf.size + int64(len(buf))
+	return nil
+}
 
+func (wf *WalFile) writeV1(timestamp int64, key, pattern []byte, act uint16) error {
 	_, err := wf.file.Seek(0, 2)
 	if err != nil {
 		return err
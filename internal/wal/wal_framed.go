@@ -0,0 +1,259 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// V2 and V3 records are framed as
+//
+//	[payload length: uint32][CRC32C of payload: uint32][payload]
+//
+// In V2 files the payload holds the same fields as a V1 record, minus the leading null byte:
+//
+//	[timestamp: uint64][key length: uint16][pattern length: uint16][key][pattern][action: uint16]
+//
+// V3 files store the key and pattern lengths as unsigned varints, so that patterns aren't limited
+// to 64 KiB:
+//
+//	[timestamp: uint64][key length: uvarint][pattern length: uvarint][key][pattern][action: uint16]
+//
+// Fixed-size integers are big-endian. The framing lets a reader tell a complete record from one
+// that was cut short by a crash, and the checksum catches records that were damaged in place.
+
+const (
+	v2FrameSize      = 8
+	v2MinPayloadSize = 14
+	v3MinPayloadSize = 12
+	// maxPayloadSize is the largest payload a V2 or V3 record can have.
+	maxPayloadSize = 8 + 2*binary.MaxVarintLen32 + MaxKeySize + MaxPatternSize + 2
+	// maxResyncDistance is how far past a damaged record a single search for the next intact one
+	// goes, so that one call to Next() can't read an unbounded part of the file.
+	maxResyncDistance = 4 * 1024 * 1024
+	// resyncChunkSize is how much of the file is read at a time while searching.
+	resyncChunkSize = 64 * 1024
+	// resyncProbeSize is how many bytes plausibleFrame needs to check a frame.
+	resyncProbeSize = v2FrameSize + 8 + 2*binary.MaxVarintLen32
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptRecord is returned when a record fails its checksum or can't be decoded.
+var ErrCorruptRecord = errors.New("corrupt WAL record")
+
+// encodeFramedRecord builds a complete framed record in the given format version, so that it
+// can be written in one call. Lengths must already have been checked with checkEntrySize().
+func encodeFramedRecord(version string, timestamp int64, key, pattern []byte, act uint16) []byte {
+	var lens []byte
+	if version == WAL_HEADER_V2 {
+		lens = make([]byte, 4)
+		binary.BigEndian.PutUint16(lens[0:2], uint16(len(key)))
+		binary.BigEndian.PutUint16(lens[2:4], uint16(len(pattern)))
+	} else {
+		lens = make([]byte, 2*binary.MaxVarintLen32)
+		n := binary.PutUvarint(lens, uint64(len(key)))
+		n += binary.PutUvarint(lens[n:], uint64(len(pattern)))
+		lens = lens[:n]
+	}
+	payloadLen := 8 + len(lens) + len(key) + len(pattern) + 2
+	buf := make([]byte, v2FrameSize+payloadLen)
+	pos := v2FrameSize
+	binary.BigEndian.PutUint64(buf[pos:pos+8], uint64(timestamp))
+	pos += 8
+	pos += copy(buf[pos:], lens)
+	pos += copy(buf[pos:], key)
+	pos += copy(buf[pos:], pattern)
+	binary.BigEndian.PutUint16(buf[pos:pos+2], act)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(payloadLen))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[v2FrameSize:], crcTable))
+	return buf
+}
+
+// framedLengths decodes the key and pattern lengths at the start of a V2 or V3 payload, returning
+// them along with the offset the key starts at. The payload may be cut short after the lengths;
+// ok is false if the lengths can't be read or don't fit the record.
+func framedLengths(version string, payload []byte) (keyLen, patLen uint64, pos int, ok bool) {
+	if version == WAL_HEADER_V2 {
+		if len(payload) < 12 {
+			return 0, 0, 0, false
+		}
+		keyLen = uint64(binary.BigEndian.Uint16(payload[8:10]))
+		patLen = uint64(binary.BigEndian.Uint16(payload[10:12]))
+		pos = 12
+	} else {
+		if len(payload) < 10 {
+			return 0, 0, 0, false
+		}
+		var n int
+		pos = 8
+		keyLen, n = binary.Uvarint(payload[pos:])
+		if n <= 0 {
+			return 0, 0, 0, false
+		}
+		pos += n
+		patLen, n = binary.Uvarint(payload[pos:])
+		if n <= 0 {
+			return 0, 0, 0, false
+		}
+		pos += n
+	}
+	return keyLen, patLen, pos, keyLen <= MaxKeySize && patLen <= MaxPatternSize
+}
+
+// decodeFramedPayload decodes the payload of a V2 or V3 record whose checksum has already been
+// checked.
+func decodeFramedPayload(version string, payload []byte) (WalEntry, error) {
+	minSize := v3MinPayloadSize
+	if version == WAL_HEADER_V2 {
+		minSize = v2MinPayloadSize
+	}
+	if len(payload) < minSize {
+		return WalEntry{}, ErrCorruptRecord
+	}
+	keyLen, patLen, pos, ok := framedLengths(version, payload)
+	if !ok || uint64(len(payload)) != uint64(pos)+keyLen+patLen+2 {
+		return WalEntry{}, ErrCorruptRecord
+	}
+	keyEnd := pos + int(keyLen)
+	patEnd := keyEnd + int(patLen)
+	w := WalEntry{
+		Timestamp:  binary.BigEndian.Uint64(payload[0:8]),
+		KeyLen:     uint32(keyLen),
+		PatternLen: uint32(patLen),
+		Key:        append([]byte(nil), payload[pos:keyEnd]...),
+		Pattern:    append([]byte(nil), payload[keyEnd:patEnd]...),
+		Action:     binary.BigEndian.Uint16(payload[patEnd : patEnd+2]),
+	}
+	return w, nil
+}
+
+// readFramedRecord reads the record starting at offset. It returns the decoded entry and the size
+// of the whole record on disk. If the frame is readable but the payload is damaged, the record
+// size is still returned along with ErrCorruptRecord, so the caller can skip past it.
+func readFramedRecord(r io.ReaderAt, version string, offset, fileSize int64) (WalEntry, int64, error) {
+	if fileSize-offset < v2FrameSize {
+		return WalEntry{}, 0, io.ErrUnexpectedEOF
+	}
+	frame := make([]byte, v2FrameSize)
+	if _, err := r.ReadAt(frame, offset); err != nil {
+		return WalEntry{}, 0, err
+	}
+	payloadLen := int64(binary.BigEndian.Uint32(frame[0:4]))
+	sum := binary.BigEndian.Uint32(frame[4:8])
+	if payloadLen < v3MinPayloadSize || payloadLen > maxPayloadSize {
+		return WalEntry{}, 0, ErrCorruptRecord
+	}
+	recSize := v2FrameSize + payloadLen
+	if fileSize-offset < recSize {
+		return WalEntry{}, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, payloadLen)
+	if _, err := r.ReadAt(payload, offset+v2FrameSize); err != nil {
+		return WalEntry{}, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return WalEntry{}, recSize, ErrCorruptRecord
+	}
+	w, err := decodeFramedPayload(version, payload)
+	if err != nil {
+		return WalEntry{}, recSize, err
+	}
+	return w, recSize, nil
+}
+
+// plausibleFrame checks whether b, which starts remaining bytes from the end of the file, could
+// start a record, using only the frame and the lengths at the start of the payload. It is used to
+// rule out most offsets before reading a whole payload to check its checksum.
+func plausibleFrame(version string, b []byte, remaining int64) bool {
+	if len(b) < v2FrameSize {
+		return false
+	}
+	payloadLen := int64(binary.BigEndian.Uint32(b[0:4]))
+	if payloadLen < v3MinPayloadSize || payloadLen > maxPayloadSize || v2FrameSize+payloadLen > remaining {
+		return false
+	}
+	payload := b[v2FrameSize:]
+	if int64(len(payload)) > payloadLen {
+		payload = payload[:payloadLen]
+	}
+	keyLen, patLen, pos, ok := framedLengths(version, payload)
+	return ok && uint64(payloadLen) == uint64(pos)+keyLen+patLen+2
+}
+
+// resyncFramed looks for the first intact record after a damaged one at offset, reading the file
+// a chunk at a time and only reading a payload in full when its frame is plausible. It searches
+// at most maxResyncDistance bytes past offset. It returns the offset of the record and true if it
+// finds one; otherwise it returns the offset it stopped at (the end of the file, or the first
+// offset beyond the distance searched) and false, and the search can be picked up from there.
+func resyncFramed(r io.ReaderAt, version string, offset, fileSize int64) (int64, bool) {
+	stop := offset + maxResyncDistance
+	if stop > fileSize {
+		stop = fileSize
+	}
+	// Each chunk is read with enough extra bytes to check the frame at its last offset.
+	buf := make([]byte, resyncChunkSize+resyncProbeSize)
+	for base := offset + 1; base < stop; base += resyncChunkSize {
+		n, err := r.ReadAt(buf, base)
+		if n == 0 && err != nil {
+			break
+		}
+		for x := 0; x < n && x < resyncChunkSize && base+int64(x) < stop; x++ {
+			next := base + int64(x)
+			if !plausibleFrame(version, buf[x:n], fileSize-next) {
+				continue
+			}
+			if _, _, err = readFramedRecord(r, version, next, fileSize); err == nil {
+				return next, true
+			}
+		}
+	}
+	return stop, false
+}
+
+// recoverFramed scans a V2 or V3 file for a torn final record, as left behind by a crash in the
+// middle of a write, and truncates the file back to the end of the last complete record. Only
+// damage that runs to the end of the file is cut off: a damaged record (even one whose length is
+// damaged) that is followed by intact records is left in place for Next() to report and skip.
+// Returns the number of bytes cut off.
+func (wf *WalFile) recoverFramed() (int64, error) {
+	offset := int64(walHeaderSize)
+	for offset < wf.size {
+		_, recSize, err := readFramedRecord(wf.file, wf.Version, offset, wf.size)
+		if err == nil {
+			offset += recSize
+			continue
+		}
+		if err != io.ErrUnexpectedEOF && err != ErrCorruptRecord {
+			return 0, err
+		}
+		// The damage may run on past the distance one search covers, so keep searching until
+		// either a record turns up or the end of the file is reached.
+		damaged := offset
+		next, found := resyncFramed(wf.file, wf.Version, offset, wf.size)
+		for !found && next < wf.size {
+			if _, _, err = readFramedRecord(wf.file, wf.Version, next, wf.size); err == nil {
+				found = true
+				break
+			}
+			next, found = resyncFramed(wf.file, wf.Version, next, wf.size)
+		}
+		if found {
+			offset = next
+			continue
+		}
+		cut := wf.size - damaged
+		if err = wf.file.Truncate(damaged); err != nil {
+			return 0, fmt.Errorf("truncating torn record at offset %d: %w", damaged, err)
+		}
+		if err = wf.file.Sync(); err != nil {
+			return 0, err
+		}
+		wf.size = damaged
+		return cut, nil
+	}
+	return 0, nil
+}
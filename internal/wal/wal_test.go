@@ -1,7 +1,14 @@
 package wal
 
 import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -150,3 +157,531 @@ func TestNewWalFileReadWrite(t *testing.T) {
 	}
 	wal.Delete()
 }
+
+func TestListWalFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("/tmp", "wal-list-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stamps := []int64{3000, 1000, 2000}
+	for _, ts := range stamps {
+		_, err := CreateWalFileAt(dir, "mwal-", ts)
+		if err != nil {
+			t.Error("wal.CreateWalFileAt: " + err.Error())
+		}
+	}
+	_, err = CreateWalFileAt(dir, "mwal-", 1000)
+	if err != os.ErrExist {
+		t.Error("Expected os.ErrExist creating a duplicate file")
+	}
+	// Files with another prefix or extension should be ignored
+	_, _ = CreateWalFileAt(dir, "other-", 500)
+	_ = os.WriteFile(filepath.Join(dir, "mwal-notes.txt"), []byte("notes"), 0644)
+
+	files, err := ListWalFiles(dir, "mwal-")
+	if err != nil {
+		t.Error("wal.ListWalFiles: " + err.Error())
+	}
+	if len(files) != 3 {
+		t.Fatal("Expected 3 files, got " + strconv.Itoa(len(files)))
+	}
+	for x, f := range files {
+		ts, err := FileTimestamp(f, "mwal-")
+		if err != nil {
+			t.Error("wal.FileTimestamp: " + err.Error())
+		}
+		if ts != int64((x+1)*1000) {
+			t.Error("Files out of order: " + f + " at position " + strconv.Itoa(x))
+		}
+	}
+}
+
+func TestFindFilesOnOrAfter(t *testing.T) {
+	dir, err := os.MkdirTemp("/tmp", "wal-find-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ts := range []int64{1000, 2000, 3000} {
+		if _, err = CreateWalFileAt(dir, "mwal-", ts); err != nil {
+			t.Fatal("wal.CreateWalFileAt: " + err.Error())
+		}
+	}
+	cases := []struct {
+		ts    uint64
+		first int64
+		count int
+	}{
+		{0, 1000, 3},
+		{1500, 1000, 3},
+		{2000, 1000, 3},
+		{2001, 2000, 2},
+		{3500, 3000, 1},
+	}
+	for _, c := range cases {
+		files, err := FindFilesOnOrAfter(dir, "mwal-", c.ts)
+		if err != nil {
+			t.Fatal("wal.FindFilesOnOrAfter: " + err.Error())
+		}
+		if len(files) != c.count {
+			t.Errorf("At %d: expected %d files, got %v", c.ts, c.count, files)
+			continue
+		}
+		if first, _ := FileTimestamp(files[0], "mwal-"); first != c.first {
+			t.Errorf("At %d: expected to start with the file at %d, got %v", c.ts, c.first, files)
+		}
+	}
+}
+
+func TestWalTornWriteRecovery(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-torn-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	wal, err := OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	if wal.Version != WAL_HEADER_V3 {
+		t.Error("Expected new files to be " + WAL_HEADER_V3 + ", got " + wal.Version)
+	}
+	for x := 0; x < 3; x++ {
+		wal.Write(time.Now().UnixNano(), []byte("key-"+strconv.Itoa(x)), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	}
+	wal.Close()
+	s, _ := os.Stat(fileDest)
+	goodSize := s.Size()
+
+	// Simulate a crash partway through writing a fourth record
+	rec := encodeFramedRecord(WAL_HEADER_V3, time.Now().UnixNano(), []byte("key-3"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	f, _ := os.OpenFile(fileDest, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(rec[:len(rec)-5])
+	f.Close()
+
+	wal, err = OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	if wal.Recovered != int64(len(rec)-5) {
+		t.Error("Expected to cut off " + strconv.Itoa(len(rec)-5) + " bytes, cut off " + strconv.FormatInt(wal.Recovered, 10))
+	}
+	s, _ = os.Stat(fileDest)
+	if s.Size() != goodSize {
+		t.Error("File was not truncated back to the last complete record")
+	}
+	x := 0
+	for wal.HasNext() {
+		val, err := wal.Next()
+		if err != nil {
+			t.Error("wal.Next: " + err.Error())
+			break
+		}
+		if string(val.Key) != "key-"+strconv.Itoa(x) {
+			t.Error("Unexpected key " + string(val.Key))
+		}
+		x++
+	}
+	if x != 3 {
+		t.Error("Expected 3 entries, got " + strconv.Itoa(x))
+	}
+	// The file should be writable again after recovery
+	wal.Write(time.Now().UnixNano(), []byte("key-3"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	wal.Close()
+	wal, _ = OpenWalFile(fileDest)
+	if wal.Recovered != 0 {
+		t.Error("Expected nothing to recover after a clean write")
+	}
+	wal.Close()
+}
+
+func TestWalCorruptRecordSkipped(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-corrupt-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	wal, _ := OpenWalFile(fileDest)
+	var offsets []int64
+	for x := 0; x < 3; x++ {
+		offsets = append(offsets, wal.size)
+		wal.Write(time.Now().UnixNano(), []byte("key-"+strconv.Itoa(x)), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	}
+	wal.Close()
+
+	// Flip a byte in the middle record's key
+	f, _ := os.OpenFile(fileDest, os.O_RDWR, 0644)
+	f.WriteAt([]byte{'X'}, offsets[1]+v2FrameSize+12)
+	f.Close()
+
+	wal, err = OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wal.Close()
+	if wal.Recovered != 0 {
+		t.Error("A damaged record in the middle of a file should not be cut off")
+	}
+	keys := make([]string, 0)
+	errs := 0
+	for wal.HasNext() {
+		val, err := wal.Next()
+		if err != nil {
+			if !errors.Is(err, ErrCorruptRecord) {
+				t.Error("Expected ErrCorruptRecord, got " + err.Error())
+			}
+			errs++
+			continue
+		}
+		keys = append(keys, string(val.Key))
+	}
+	if errs != 1 || len(keys) != 2 || keys[0] != "key-0" || keys[1] != "key-2" {
+		t.Errorf("Expected to skip only the damaged record, got keys %v and %d errors", keys, errs)
+	}
+}
+
+func TestWalCorruptLengthMidFile(t *testing.T) {
+	for _, length := range []uint32{0xffff0000, 20} {
+		fileDest, err := CreateWalFile("/tmp", "wal-corrupt-len-")
+		if err != nil {
+			t.Fatal("wal.CreateWalFile: " + err.Error())
+		}
+		defer os.Remove(fileDest)
+
+		wal, _ := OpenWalFile(fileDest)
+		var offsets []int64
+		for x := 0; x < 4; x++ {
+			offsets = append(offsets, wal.size)
+			wal.Write(time.Now().UnixNano(), []byte("key-"+strconv.Itoa(x)), []byte(`{"sys":["infra"]}`), WAL_ADD)
+		}
+		wal.Close()
+		s, _ := os.Stat(fileDest)
+
+		// Damage the second record's length, so that it claims to run past the end of the file (or
+		// to end partway through the next record).
+		f, _ := os.OpenFile(fileDest, os.O_RDWR, 0644)
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, length)
+		f.WriteAt(b, offsets[1])
+		f.Close()
+
+		wal, err = OpenWalFile(fileDest)
+		if err != nil {
+			t.Fatal("wal.OpenWalFile: " + err.Error())
+		}
+		if wal.Recovered != 0 {
+			t.Errorf("Length %d: a damaged record followed by intact ones was cut off (%d bytes)", length, wal.Recovered)
+		}
+		s2, _ := os.Stat(fileDest)
+		if s2.Size() != s.Size() {
+			t.Errorf("Length %d: file was truncated from %d to %d bytes", length, s.Size(), s2.Size())
+		}
+		keys := make([]string, 0)
+		errs := 0
+		for wal.HasNext() {
+			val, err := wal.Next()
+			if err != nil {
+				if !errors.Is(err, ErrCorruptRecord) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Error("Unexpected error " + err.Error())
+				}
+				errs++
+				continue
+			}
+			keys = append(keys, string(val.Key))
+		}
+		wal.Close()
+		if errs != 1 || len(keys) != 3 || keys[0] != "key-0" || keys[1] != "key-2" || keys[2] != "key-3" {
+			t.Errorf("Length %d: expected to skip only the damaged record, got keys %v and %d errors", length, keys, errs)
+		}
+	}
+}
+
+func TestWalTornTailAfterDamagedRecord(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-torn-damaged-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	wal, _ := OpenWalFile(fileDest)
+	var offsets []int64
+	for x := 0; x < 3; x++ {
+		offsets = append(offsets, wal.size)
+		wal.Write(time.Now().UnixNano(), []byte("key-"+strconv.Itoa(x)), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	}
+	wal.Close()
+	s, _ := os.Stat(fileDest)
+
+	// A damaged record in the middle and a torn one at the end: only the torn one is cut off.
+	f, _ := os.OpenFile(fileDest, os.O_RDWR, 0644)
+	f.WriteAt([]byte{'X'}, offsets[1]+v2FrameSize+12)
+	rec := encodeFramedRecord(WAL_HEADER_V3, time.Now().UnixNano(), []byte("key-3"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	f.WriteAt(rec[:len(rec)-4], s.Size())
+	f.Close()
+
+	wal, err = OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wal.Close()
+	if wal.Recovered != int64(len(rec)-4) {
+		t.Errorf("Expected to cut off %d bytes, cut off %d", len(rec)-4, wal.Recovered)
+	}
+	if wal.Size() != s.Size() {
+		t.Errorf("Expected the file to be truncated to %d bytes, got %d", s.Size(), wal.Size())
+	}
+}
+
+func TestWalLongDamagedRegion(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-damaged-region-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	// Intact records either side of more damage than a single search covers.
+	wal, _ := OpenWalFile(fileDest)
+	wal.Write(time.Now().UnixNano(), []byte("key-0"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	garbage := make([]byte, maxResyncDistance+maxResyncDistance/2)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	if _, err = wal.file.WriteAt(garbage, wal.size); err != nil {
+		t.Fatal(err)
+	}
+	wal.size += int64(len(garbage))
+	wal.Write(time.Now().UnixNano(), []byte("key-1"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	wal.Close()
+	s, _ := os.Stat(fileDest)
+
+	wal, err = OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wal.Close()
+	if wal.Recovered != 0 || wal.Size() != s.Size() {
+		t.Errorf("Damage followed by an intact record was cut off (%d bytes)", wal.Recovered)
+	}
+	keys := make([]string, 0)
+	errs := 0
+	for wal.HasNext() {
+		val, err := wal.Next()
+		if err != nil {
+			errs++
+			continue
+		}
+		keys = append(keys, string(val.Key))
+	}
+	// Each failed call searches at most maxResyncDistance bytes.
+	if errs != 2 || len(keys) != 2 || keys[0] != "key-0" || keys[1] != "key-1" {
+		t.Errorf("Expected both intact records after 2 errors, got keys %v and %d errors", keys, errs)
+	}
+}
+
+func TestWalLargePattern(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-large-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	key := []byte(strings.Repeat("k", 70*1024))
+	pattern := []byte(`{"name":["` + strings.Repeat("x", 200*1024) + `"]}`)
+	wal, _ := OpenWalFile(fileDest)
+	if err = wal.Write(time.Now().UnixNano(), key, pattern, WAL_ADD); err != nil {
+		t.Fatal("wal.Write: " + err.Error())
+	}
+	err = wal.Write(time.Now().UnixNano(), []byte("key"), make([]byte, MaxPatternSize+1), WAL_ADD)
+	if !errors.Is(err, ErrEntryTooLarge) {
+		t.Error("Expected ErrEntryTooLarge for an oversized pattern")
+	}
+	wal.Close()
+
+	wal, _ = OpenWalFile(fileDest)
+	defer wal.Close()
+	if wal.Recovered != 0 {
+		t.Error("Expected nothing to recover")
+	}
+	val, err := wal.Next()
+	if err != nil {
+		t.Fatal("wal.Next: " + err.Error())
+	}
+	if string(val.Key) != string(key) || string(val.Pattern) != string(pattern) || val.PatternLen != uint32(len(pattern)) {
+		t.Error("Large entry did not round-trip")
+	}
+	if wal.HasNext() {
+		t.Error("The rejected entry should not have been written")
+	}
+}
+
+func TestWalV2RejectsLargePattern(t *testing.T) {
+	fileDest := filepath.Join("/tmp", "wal-v2-"+strconv.FormatInt(time.Now().UnixNano(), 10)+".wal")
+	hdr := make([]byte, walHeaderSize)
+	copy(hdr, WAL_HEADER_V2)
+	if err := os.WriteFile(fileDest, hdr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fileDest)
+
+	wal, err := OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	defer wal.Close()
+	err = wal.Write(time.Now().UnixNano(), []byte("key"), make([]byte, 70*1024), WAL_ADD)
+	if !errors.Is(err, ErrEntryTooLarge) {
+		t.Error("Expected ErrEntryTooLarge writing a 70 KiB pattern to a V2 file")
+	}
+	if err = wal.Write(time.Now().UnixNano(), []byte("key"), []byte(`{"sys":["infra"]}`), WAL_ADD); err != nil {
+		t.Fatal("wal.Write: " + err.Error())
+	}
+	wal.Rewind()
+	val, err := wal.Next()
+	if err != nil || string(val.Key) != "key" {
+		t.Error("Expected the V2 file to hold only the small entry")
+	}
+}
+
+func TestWalAppendBatch(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-batch-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	wal, _ := OpenWalFile(fileDest)
+	entries := make([]WalEntry, 0)
+	for x := 0; x < 5; x++ {
+		entries = append(entries, WalEntry{Timestamp: uint64(x + 1), Key: []byte("key-" + strconv.Itoa(x)), Pattern: []byte(`{"sys":["infra"]}`), Action: WAL_ADD})
+	}
+	if err = wal.Append(entries[:3]); err != nil {
+		t.Fatal("wal.Append: " + err.Error())
+	}
+	if err = wal.Append(entries[3:]); err != nil {
+		t.Fatal("wal.Append: " + err.Error())
+	}
+	bad := []WalEntry{{Timestamp: 6, Key: []byte("key-5"), Pattern: []byte(`{"sys":["infra"]}`), Action: WAL_ADD}, {Timestamp: 7, Key: []byte("key-6"), Pattern: make([]byte, MaxPatternSize+1), Action: WAL_ADD}}
+	if err = wal.Append(bad); !errors.Is(err, ErrEntryTooLarge) {
+		t.Error("Expected ErrEntryTooLarge")
+	}
+	if err = wal.Sync(); err != nil {
+		t.Fatal("wal.Sync: " + err.Error())
+	}
+	wal.Close()
+
+	wal, _ = OpenWalFile(fileDest)
+	defer wal.Close()
+	x := 0
+	for wal.HasNext() {
+		val, err := wal.Next()
+		if err != nil {
+			t.Fatal("wal.Next: " + err.Error())
+		}
+		if val.Timestamp != uint64(x+1) || string(val.Key) != "key-"+strconv.Itoa(x) {
+			t.Error("Unexpected entry " + string(val.Key))
+		}
+		x++
+	}
+	if x != 5 {
+		t.Error("Expected 5 entries (a batch with an oversized entry should write nothing), got " + strconv.Itoa(x))
+	}
+}
+
+func TestWalReadOnlyLeavesTornRecord(t *testing.T) {
+	fileDest, err := CreateWalFile("/tmp", "wal-readonly-")
+	if err != nil {
+		t.Fatal("wal.CreateWalFile: " + err.Error())
+	}
+	defer os.Remove(fileDest)
+
+	wal, _ := OpenWalFile(fileDest)
+	wal.Write(time.Now().UnixNano(), []byte("key-0"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	wal.Close()
+	rec := encodeFramedRecord(WAL_HEADER_V3, time.Now().UnixNano(), []byte("key-1"), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	f, _ := os.OpenFile(fileDest, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(rec[:len(rec)-3])
+	f.Close()
+	s, _ := os.Stat(fileDest)
+
+	wal, err = OpenWalFileReadOnly(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFileReadOnly: " + err.Error())
+	}
+	defer wal.Close()
+	if _, err = wal.Next(); err != nil {
+		t.Fatal("wal.Next: " + err.Error())
+	}
+	offset := wal.Offset()
+	if _, err = wal.Next(); err == nil {
+		t.Error("Expected an error reading the torn record at offset " + strconv.FormatInt(offset, 10))
+	}
+	if wal.HasNext() {
+		t.Error("Expected reading to stop at the torn record")
+	}
+	s2, _ := os.Stat(fileDest)
+	if s2.Size() != s.Size() {
+		t.Error("A read-only open should not truncate the file")
+	}
+}
+
+func TestWalEntryPatternAsJson(t *testing.T) {
+	e := WalEntry{Action: WAL_ADD, Pattern: []byte(`{ "sys": [ "infra" ] }`)}
+	js, err := e.GetPatternAsJson()
+	if err != nil || js != `{"sys":["infra"]}` {
+		t.Error("Unexpected pattern JSON " + js)
+	}
+	e = WalEntry{Action: WAL_DEL, Pattern: []byte("-")}
+	if js, err = e.GetPatternAsJson(); err != nil || js != "null" {
+		t.Error("Expected null for a whole-key delete, got " + js)
+	}
+	e = WalEntry{Action: WAL_ADD, Pattern: []byte(`{"sys":`)}
+	if _, err = e.GetPatternAsJson(); err == nil {
+		t.Error("Expected an error for a pattern that isn't JSON")
+	}
+	if ActionName(WAL_REPLACE) != "replace" || ActionName(7) != "unknown(7)" {
+		t.Error("Unexpected action names")
+	}
+}
+
+func TestWalReadV1(t *testing.T) {
+	fileDest := filepath.Join("/tmp", "wal-v1-"+strconv.FormatInt(time.Now().UnixNano(), 10)+".wal")
+	hdr := make([]byte, walHeaderSize)
+	copy(hdr, WAL_HEADER_V1)
+	if err := os.WriteFile(fileDest, hdr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fileDest)
+
+	wal, err := OpenWalFile(fileDest)
+	if err != nil {
+		t.Fatal("wal.OpenWalFile: " + err.Error())
+	}
+	if wal.Version != WAL_HEADER_V1 {
+		t.Error("Expected " + WAL_HEADER_V1 + ", got " + wal.Version)
+	}
+	for x := 0; x < 3; x++ {
+		wal.Write(time.Now().UnixNano(), []byte("key-"+strconv.Itoa(x)), []byte(`{"sys":["infra"]}`), WAL_ADD)
+	}
+	wal.Close()
+
+	wal, _ = OpenWalFile(fileDest)
+	defer wal.Close()
+	x := 0
+	for wal.HasNext() {
+		val, err := wal.Next()
+		if err != nil {
+			t.Error("wal.Next: " + err.Error())
+			break
+		}
+		if string(val.Key) != "key-"+strconv.Itoa(x) {
+			t.Error("Unexpected key " + string(val.Key))
+		}
+		x++
+	}
+	if x != 3 {
+		t.Error("Expected 3 entries, got " + strconv.Itoa(x))
+	}
+}